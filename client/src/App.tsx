@@ -7,6 +7,17 @@ import ManagePasskeys from "./pages/ManagePasskeys.tsx";
 import DeleteAccount from "./pages/DeleteAccount.tsx";
 import EditEmail from "./pages/EditEmail.tsx";
 import EditPassword from "./pages/EditPassword.tsx";
+import ForgotPassword from "./pages/ForgotPassword.tsx";
+import ResetPassword from "./pages/ResetPassword.tsx";
+import EmailVerified from "./pages/EmailVerified.tsx";
+import VerifyEmail from "./pages/VerifyEmail.tsx";
+import MagicLink from "./pages/MagicLink.tsx";
+import ConfirmMagicLink from "./pages/ConfirmMagicLink.tsx";
+import ConfirmUnlock from "./pages/ConfirmUnlock.tsx";
+import TOTPLogin from "./pages/TOTPLogin.tsx";
+import TwoFactor from "./pages/TwoFactor.tsx";
+import RecoveryLogin from "./pages/RecoveryLogin.tsx";
+import RecoveryCodes from "./pages/RecoveryCodes.tsx";
 
 function App(): React.ReactElement {
   return (
@@ -14,6 +25,17 @@ function App(): React.ReactElement {
       <Routes>
         <Route path="/" element={<Login />} />
         <Route path="/sign-up" element={<Register />} />
+        <Route path="/forgot_password" element={<ForgotPassword />} />
+        <Route path="/reset_password" element={<ResetPassword />} />
+        <Route path="/verify_email" element={<VerifyEmail />} />
+        <Route path="/email_verified" element={<EmailVerified />} />
+        <Route path="/magic_link" element={<MagicLink />} />
+        <Route path="/login/magic_link" element={<ConfirmMagicLink />} />
+        <Route path="/login/totp" element={<TOTPLogin />} />
+        <Route path="/login/unlock" element={<ConfirmUnlock />} />
+        <Route path="/two_factor" element={<TwoFactor />} />
+        <Route path="/login/recovery" element={<RecoveryLogin />} />
+        <Route path="/recovery_codes" element={<RecoveryCodes />} />
         <Route path="/home" element={<Homepage />} />
         <Route path="/passkeys" element={<ManagePasskeys />} />
         <Route path="/delete_account" element={<DeleteAccount />} />
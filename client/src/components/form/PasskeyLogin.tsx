@@ -25,8 +25,6 @@ export function PasskeyLogin(): React.ReactElement {
 
   useEffect(() => {
     isAutofill && passkeyAutofill(
-      email,
-      "login",
       () => { console.log("success from autofill"); navigate("/home") },
       (errorMessage) => { console.log("error from autofill", errorMessage); setNotification(errorMessage) }
     );
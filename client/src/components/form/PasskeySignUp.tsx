@@ -15,7 +15,10 @@ export function PasskeySignUp(): React.ReactElement {
     await registerPasskey(
       email,
       "signup",
-      () => navigate("/home"),
+      (code) =>
+        code === "check_email"
+          ? setNotification("Check your inbox to continue.")
+          : navigate("/home"),
       (errorMessage) => setNotification(errorMessage)
     );
   }
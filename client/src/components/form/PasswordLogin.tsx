@@ -1,10 +1,12 @@
 import React, { useState } from "react";
+import { WebAuthnAbortService } from "@simplewebauthn/browser";
 import { AuthResponse } from "../../utils/types";
 import { Button } from "../input/Button";
 import { Input } from "../input/Input";
 import { useNavigate } from "react-router-dom";
 import { Notification } from "../layout/Notification";
 import { SubHeading } from "../layout/SubHeading";
+import { upgradeToPasskey } from "../../hooks/webauth_api";
 
 export function PasswordLogin(): React.ReactElement {
   const [email, setEmail] = useState("");
@@ -32,7 +34,14 @@ export function PasswordLogin(): React.ReactElement {
     });
     const loginJSON: AuthResponse = await response.json();
     if (loginJSON.status === "ok") {
+      // the passkey autofill is still waiting, the server discarded its challenge
+      WebAuthnAbortService.cancelCeremony();
+    }
+    if (loginJSON.status === "ok" && loginJSON.code === "totp_required") {
+      navigate("/login/totp");
+    } else if (loginJSON.status === "ok") {
       setNotification("Successfully logged in.");
+      upgradeToPasskey();
       navigate("/home");
     } else {
       setNotification(loginJSON.errorMessage);
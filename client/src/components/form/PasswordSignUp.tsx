@@ -33,7 +33,9 @@ export function PasswordSignUp(): React.ReactElement {
     });
 
     const registrationJSON: AuthResponse = await response.json();
-    if (registrationJSON.status === "ok") {
+    if (registrationJSON.status === "ok" && registrationJSON.code === "check_email") {
+      setNotification("Check your inbox to continue.");
+    } else if (registrationJSON.status === "ok") {
       setNotification("Successfully registered.");
       navigate("/home");
     } else {
@@ -13,7 +13,7 @@ import { AuthResponse } from "../utils/types";
 export async function registerPasskey(
   email: string,
   context: string = "none",
-  onSuccessCallback: () => void,
+  onSuccessCallback: (code?: string) => void,
   onFailureCallback: (errorMessage: string) => void
 ) {
   if (context === "signup" && !isValidEmail(email)) {
@@ -61,12 +61,45 @@ export async function registerPasskey(
   const verificationJSON: AuthResponse = await verificationResponse.json();
 
   if (verificationJSON.status === "ok") {
-    onSuccessCallback();
+    onSuccessCallback(verificationJSON.code);
   } else {
     onFailureCallback("Registration failed.");
   }
 }
 
+// upgradeToPasskey asks the browser to create a passkey without prompting
+// (conditional create) right after a password sign in. Browsers that do not
+// support it, or decide against it, fail quietly.
+export async function upgradeToPasskey() {
+  const response = await fetch("/register/begin?context=upgrade", {
+    method: "POST",
+  });
+  if (!response.ok) {
+    return;
+  }
+  const credentialCreationOptions: {
+    publicKey: PublicKeyCredentialCreationOptionsJSON;
+  } = await response.json();
+
+  let registrationResponse: RegistrationResponseJSON;
+  try {
+    registrationResponse = await startRegistration({
+      optionsJSON: credentialCreationOptions.publicKey,
+      useAutoRegister: true,
+    });
+  } catch {
+    return;
+  }
+
+  await fetch("/register/finish?context=upgrade", {
+    method: "POST",
+    body: JSON.stringify(registrationResponse),
+    headers: {
+      "Content-Type": "application/json",
+    },
+  });
+}
+
 export async function loginPasskey(
   email: string,
   context: string = "none",
@@ -126,19 +159,18 @@ export async function loginPasskey(
   }
 }
 
+// the challenge of /conditional_login/begin stays valid until it is used, so
+// remounting the page does not start a new ceremony
 export async function passkeyAutofill(
-  email: string,
-  context: string = "none",
   onSuccessCallback: () => void,
   onFailureCallback: (errorMessage: string) => void
 ) {
-  const response = await fetch(`/discoverable_login/begin?context=${context}`, {
+  const response = await fetch("/conditional_login/begin", {
     method: "POST",
-    body: JSON.stringify({ email }),
-    headers: {
-      "Content-Type": "application/json",
-    },
   });
+  if (!response.ok) {
+    return;
+  }
   const credentialRequestOptions: {
     publicKey: PublicKeyCredentialCreationOptionsJSON;
   } = await response.json();
@@ -163,16 +195,13 @@ export async function passkeyAutofill(
     return;
   }
 
-  const verificationResponse = await fetch(
-    `/discoverable_login/finish?context=${context}`,
-    {
-      method: "POST",
-      body: JSON.stringify(assertion),
-      headers: {
-        "Content-Type": "application/json",
-      },
-    }
-  );
+  const verificationResponse = await fetch("/conditional_login/finish", {
+    method: "POST",
+    body: JSON.stringify(assertion),
+    headers: {
+      "Content-Type": "application/json",
+    },
+  });
 
   const verificationJSON: AuthResponse = await verificationResponse.json();
   if (verificationJSON.status === "ok") {
@@ -198,6 +227,28 @@ export async function deletePasskey(
   if (response.ok) {
     onSuccessCallback();
   } else {
-    onFailureCallback("Failed to delete passkey.");
+    const responseJSON: AuthResponse = await response.json();
+    onFailureCallback(responseJSON.errorMessage || "Failed to delete passkey.");
+  }
+}
+
+export async function renamePasskey(
+  credentialId: string,
+  name: string,
+  onSuccessCallback: () => void,
+  onFailureCallback: (errorMessage: string) => void
+) {
+  const response = await fetch("/credentials", {
+    method: "PATCH",
+    body: JSON.stringify({ credentialId: credentialId, name: name }),
+    headers: {
+      "Content-Type": "application/json",
+    },
+  });
+  if (response.ok) {
+    onSuccessCallback();
+  } else {
+    const responseJSON: AuthResponse = await response.json();
+    onFailureCallback(responseJSON.errorMessage || "Failed to rename passkey.");
   }
 }
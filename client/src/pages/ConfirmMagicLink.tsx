@@ -0,0 +1,41 @@
+import React from "react";
+import { useNavigate, useSearchParams } from "react-router-dom";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Button } from "../components/input/Button";
+import { AuthResponse } from "../utils/types";
+
+// the link in the email only opens this page, the token is used up when the
+// user confirms, not when a mail scanner follows the link
+export default function ConfirmMagicLink(): React.ReactElement {
+  const [searchParams] = useSearchParams();
+  const navigate = useNavigate();
+
+  async function handleSignIn() {
+    const response = await fetch("/login/magic_link/confirm", {
+      method: "POST",
+      body: JSON.stringify({ token: searchParams.get("token") ?? "" }),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    const responseJSON: AuthResponse = await response.json();
+    if (responseJSON.status !== "ok") {
+      navigate("/magic_link?status=invalid");
+    } else if (responseJSON.code === "totp_required") {
+      navigate("/login/totp?prompt=register");
+    } else {
+      navigate("/passkeys?prompt=register");
+    }
+  }
+
+  return (
+    <Layout>
+      <Heading>Sign in with email</Heading>
+      <p className="text-sm text-center font-normal text-gray-500 mb-4">
+        Sign in to add a new passkey to your account.
+      </p>
+      <Button buttonText="Sign in" onClickFunc={handleSignIn} />
+    </Layout>
+  );
+}
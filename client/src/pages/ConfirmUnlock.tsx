@@ -0,0 +1,39 @@
+import React from "react";
+import { useNavigate, useSearchParams } from "react-router-dom";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Button } from "../components/input/Button";
+import { AuthResponse } from "../utils/types";
+
+// the link in the email only opens this page, the token is used up when the
+// user confirms, not when a mail scanner follows the link
+export default function ConfirmUnlock(): React.ReactElement {
+  const [searchParams] = useSearchParams();
+  const navigate = useNavigate();
+
+  async function handleUnlock() {
+    const response = await fetch("/login/unlock", {
+      method: "POST",
+      body: JSON.stringify({ token: searchParams.get("token") ?? "" }),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    const responseJSON: AuthResponse = await response.json();
+    if (responseJSON.status !== "ok") {
+      navigate("/?status=unlock_invalid");
+    } else {
+      navigate("/?status=unlocked");
+    }
+  }
+
+  return (
+    <Layout>
+      <Heading>Unlock sign in</Heading>
+      <p className="text-sm text-center font-normal text-gray-500 mb-4">
+        Unlock sign in to your account if the failed attempts were yours.
+      </p>
+      <Button buttonText="Unlock" onClickFunc={handleUnlock} />
+    </Layout>
+  );
+}
@@ -29,7 +29,9 @@ export default function EditEmail(): React.ReactElement {
           },
         });
         if (response.ok) {
-          setNotification("Email changed successfully");
+          setNotification(
+            "Check your new inbox and open the link to confirm the change"
+          );
         } else {
           setNotification("Failed to change email");
         }
@@ -5,33 +5,64 @@ import { Input } from "../components/input/Input";
 import { Button } from "../components/input/Button";
 import { loginPasskey } from "../hooks/webauth_api";
 import { Notification } from "../components/layout/Notification";
+import { AuthResponse } from "../utils/types";
 
 export default function EditPassword(): React.ReactElement {
+  const [currentPassword, setCurrentPassword] = useState("");
   const [newPassword, setNewPassword] = useState("");
   const [notification, setNotification] = useState("");
 
+  async function submit(path: string, body: object): Promise<AuthResponse> {
+    const response = await fetch(path, {
+      method: "POST",
+      body: JSON.stringify(body),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    return response.json();
+  }
+
+  function showResult(responseJSON: AuthResponse) {
+    if (responseJSON.status === "ok") {
+      setCurrentPassword("");
+      setNotification("Password changed successfully");
+    } else {
+      setNotification(responseJSON.errorMessage);
+    }
+  }
+
   async function handleChangePassword() {
     if (newPassword === "" || newPassword.length < 8) {
       setNotification("New password is short");
       return;
     }
 
+    if (currentPassword !== "") {
+      showResult(
+        await submit("/change_password", {
+          currentPassword,
+          password: newPassword,
+        })
+      );
+      return;
+    }
+
+    // without the current password a passkey has to confirm the change,
+    // accounts that never had a password set their first one
     loginPasskey(
       "",
       "password_change",
       async () => {
-        const response = await fetch("/change_password", {
-          method: "POST",
-          body: JSON.stringify({ password: newPassword }),
-          headers: {
-            "Content-Type": "application/json",
-          },
+        let responseJSON = await submit("/change_password", {
+          password: newPassword,
         });
-        if (response.ok) {
-          setNotification("Password changed successfully");
-        } else {
-          setNotification("Failed to change password");
+        if (responseJSON.code === "no_password") {
+          responseJSON = await submit("/set_password", {
+            password: newPassword,
+          });
         }
+        showResult(responseJSON);
       },
       (errorMessage) => setNotification(errorMessage)
     );
@@ -42,9 +73,16 @@ export default function EditPassword(): React.ReactElement {
       <Notification notification={notification} />
       <Heading>Edit Password</Heading>
       <p className="text-sm text-center font-normal text-gray-500 mb-4">
-        Confirm that you have passkey to change your password.
+        Enter your current password, or leave it empty to confirm with a
+        passkey.
       </p>
       <div className="space-y-6">
+        <Input
+          type="password"
+          placeholder="Current password"
+          value={currentPassword}
+          onChange={setCurrentPassword}
+        />
         <Input
           type="password"
           placeholder="New password"
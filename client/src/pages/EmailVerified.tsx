@@ -0,0 +1,22 @@
+import React from "react";
+import { useSearchParams } from "react-router-dom";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Link } from "../components/input/Link";
+
+export default function EmailVerified(): React.ReactElement {
+  const [searchParams] = useSearchParams();
+  const verified = searchParams.get("status") === "ok";
+
+  return (
+    <Layout>
+      <Heading>{verified ? "Email verified" : "Link expired"}</Heading>
+      <p className="text-sm text-center font-normal text-gray-500 mb-4">
+        {verified
+          ? "Your email address has been confirmed."
+          : "This link is invalid or has expired. Request a new one and try again."}
+      </p>
+      <Link href="/home" linkText="Continue" />
+    </Layout>
+  );
+}
@@ -0,0 +1,53 @@
+import React, { useState } from "react";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Input } from "../components/input/Input";
+import { Button } from "../components/input/Button";
+import { isValidEmail } from "../utils/shared";
+import { Notification } from "../components/layout/Notification";
+import { AuthResponse } from "../utils/types";
+
+export default function ForgotPassword(): React.ReactElement {
+  const [email, setEmail] = useState("");
+  const [notification, setNotification] = useState("");
+
+  async function handleForgotPassword() {
+    if (email === "" || !isValidEmail(email)) {
+      setNotification("Please enter a valid email.");
+      return;
+    }
+
+    const response = await fetch("/password/forgot", {
+      method: "POST",
+      body: JSON.stringify({ email }),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    const responseJSON: AuthResponse = await response.json();
+    if (responseJSON.status === "ok") {
+      setNotification(
+        "If an account exists for this email, we sent a link to reset the password."
+      );
+    } else {
+      setNotification(responseJSON.errorMessage);
+    }
+  }
+
+  return (
+    <Layout parent="/">
+      <Notification notification={notification} />
+      <Heading>Forgot password</Heading>
+      <div className="space-y-6">
+        <Input
+          type="email"
+          placeholder="email"
+          value={email}
+          onChange={setEmail}
+        />
+
+        <Button buttonText="Send reset link" onClickFunc={handleForgotPassword} />
+      </div>
+    </Layout>
+  );
+}
@@ -0,0 +1,62 @@
+import React, { useState } from "react";
+import { useSearchParams } from "react-router-dom";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Input } from "../components/input/Input";
+import { Button } from "../components/input/Button";
+import { isValidEmail } from "../utils/shared";
+import { Notification } from "../components/layout/Notification";
+import { AuthResponse } from "../utils/types";
+
+export default function MagicLink(): React.ReactElement {
+  const [searchParams] = useSearchParams();
+  const [email, setEmail] = useState("");
+  const [notification, setNotification] = useState(
+    searchParams.get("status") === "invalid"
+      ? "This sign in link is invalid or has expired."
+      : ""
+  );
+
+  async function handleSendLink() {
+    if (email === "" || !isValidEmail(email)) {
+      setNotification("Please enter a valid email.");
+      return;
+    }
+
+    const response = await fetch("/login/magic_link", {
+      method: "POST",
+      body: JSON.stringify({ email }),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    const responseJSON: AuthResponse = await response.json();
+    if (responseJSON.status === "ok") {
+      setNotification(
+        "If an account exists for this email, we sent a link to sign in."
+      );
+    } else {
+      setNotification(responseJSON.errorMessage);
+    }
+  }
+
+  return (
+    <Layout parent="/">
+      <Notification notification={notification} />
+      <Heading>Sign in with email</Heading>
+      <p className="text-sm text-center font-normal text-gray-500 mb-4">
+        We will send you a link to sign in and add a new passkey.
+      </p>
+      <div className="space-y-6">
+        <Input
+          type="email"
+          placeholder="email"
+          value={email}
+          onChange={setEmail}
+        />
+
+        <Button buttonText="Send sign in link" onClickFunc={handleSendLink} />
+      </div>
+    </Layout>
+  );
+}
@@ -1,21 +1,38 @@
 import React, { useState, useEffect } from "react";
+import { useSearchParams } from "react-router-dom";
 import { Layout } from "../components/layout/Layout";
 import { LinkButton } from "../components/input/LinkButton";
 import { Button } from "../components/input/Button";
 import { Heading } from "../components/layout/Heading";
 import { HorizontalLine } from "../components/layout/HorizontalLine";
 import { Passkey } from "../utils/types";
-import { registerPasskey, deletePasskey } from "../hooks/webauth_api";
+import {
+  registerPasskey,
+  deletePasskey,
+  renamePasskey,
+} from "../hooks/webauth_api";
 import { formatDate } from "../utils/shared";
 import { Notification } from "../components/layout/Notification";
 
 export default function ManagePasskeys(): React.ReactElement {
   const [registeredPasskeys, setRegisteredPasskeys] = useState<Passkey[]>([]);
   const [notification, setNotification] = useState("");
+  const [searchParams] = useSearchParams();
 
   useEffect(() => {
     getPasskeys();
-  }, []);
+    // set after signing in with an email link or a recovery code
+    if (searchParams.get("prompt") === "register") {
+      setNotification(
+        "You signed in with an email link. Add a new passkey to sign in next time."
+      );
+    }
+    if (searchParams.get("prompt") === "recovery") {
+      setNotification(
+        "You signed in with a recovery code. Add a new passkey to continue."
+      );
+    }
+  }, [searchParams]);
 
   async function getPasskeys() {
     const res = await fetch("/credentials");
@@ -27,7 +44,10 @@ export default function ManagePasskeys(): React.ReactElement {
     await registerPasskey(
       "",
       "normal",
-      () => window.location.reload(),
+      () =>
+        searchParams.get("prompt") === "recovery"
+          ? (window.location.href = "/home")
+          : window.location.reload(),
       (errorMessage) => setNotification(errorMessage)
     );
   }
@@ -41,6 +61,19 @@ export default function ManagePasskeys(): React.ReactElement {
     );
   }
 
+  async function handleRenamePasskey(passkey: Passkey) {
+    const name = window.prompt("Passkey name", passkey.name);
+    if (name === null) {
+      return;
+    }
+    await renamePasskey(
+      passkey.credential_id,
+      name,
+      () => window.location.reload(),
+      (errorMessage) => setNotification(errorMessage)
+    );
+  }
+
   return (
     <Layout parent="/home">
       <div className="w-full max-w-sm">
@@ -65,14 +98,28 @@ export default function ManagePasskeys(): React.ReactElement {
                     alt={passkey.passkey_provider.name}
                     className="w-6 h-6"
                   />
-                  {passkey.passkey_provider.name}
+                  {passkey.name}
                 </div>
                 <div className="font-light text-xs text-gray-400 mt-1">
                   <p>Registered: {formatDate(passkey.created_at)}</p>
-                  <p>Last-Used: {formatDate(passkey.updated_at)}</p>
+                  <p>
+                    Last-Used:{" "}
+                    {passkey.last_used_at
+                      ? formatDate(passkey.last_used_at)
+                      : "Never"}
+                  </p>
+                  {passkey.clone_warning && (
+                    <p className="text-red-500">
+                      Possibly cloned, sign-in is blocked
+                    </p>
+                  )}
                 </div>
               </div>
-              <div className="flex justify-end">
+              <div className="flex justify-end gap-2">
+                <LinkButton
+                  onClickFunc={() => handleRenamePasskey(passkey)}
+                  buttonText="rename"
+                />
                 <LinkButton
                   onClickFunc={() => handleDeletePasskey(passkey.credential_id)}
                   buttonText="delete"
@@ -0,0 +1,69 @@
+import React, { useEffect, useState } from "react";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Button } from "../components/input/Button";
+import { Notification } from "../components/layout/Notification";
+import { loginPasskey } from "../hooks/webauth_api";
+import { AuthResponse } from "../utils/types";
+
+export default function RecoveryCodes(): React.ReactElement {
+  const [remaining, setRemaining] = useState(0);
+  const [codes, setCodes] = useState<string[]>([]);
+  const [notification, setNotification] = useState("");
+
+  useEffect(() => {
+    getStatus();
+  }, []);
+
+  async function getStatus() {
+    const response = await fetch("/recovery_codes");
+    const status = await response.json();
+    setRemaining(status.remaining);
+  }
+
+  // new codes need a fresh passkey confirmation
+  function handleRegenerate() {
+    loginPasskey(
+      "",
+      "reauth",
+      async () => {
+        const response = await fetch("/recovery_codes", { method: "POST" });
+        if (response.ok) {
+          const result = await response.json();
+          setCodes(result.codes);
+          setRemaining(result.codes.length);
+        } else {
+          const responseJSON: AuthResponse = await response.json();
+          setNotification(responseJSON.errorMessage);
+        }
+      },
+      (errorMessage) => setNotification(errorMessage)
+    );
+  }
+
+  return (
+    <Layout parent="/home">
+      <Notification notification={notification} />
+      <Heading>Recovery codes</Heading>
+      <p className="text-sm text-center font-normal text-gray-500 mb-4">
+        Use a recovery code to sign in if you lose all your passkeys. You have{" "}
+        {remaining} unused codes.
+      </p>
+
+      {codes.length > 0 && (
+        <div className="space-y-2 mb-6">
+          <p className="text-sm text-gray-500">
+            Save these codes now, they will not be shown again:
+          </p>
+          <ul className="font-mono text-sm text-center">
+            {codes.map((code) => (
+              <li key={code}>{code}</li>
+            ))}
+          </ul>
+        </div>
+      )}
+
+      <Button buttonText="Generate new codes" onClickFunc={handleRegenerate} />
+    </Layout>
+  );
+}
@@ -0,0 +1,47 @@
+import React, { useState } from "react";
+import { useNavigate } from "react-router-dom";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Input } from "../components/input/Input";
+import { Button } from "../components/input/Button";
+import { Notification } from "../components/layout/Notification";
+import { AuthResponse } from "../utils/types";
+
+export default function RecoveryLogin(): React.ReactElement {
+  const [email, setEmail] = useState("");
+  const [code, setCode] = useState("");
+  const [notification, setNotification] = useState("");
+  const navigate = useNavigate();
+
+  async function handleLogin() {
+    const response = await fetch("/login/recovery", {
+      method: "POST",
+      body: JSON.stringify({ email, code }),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    const responseJSON: AuthResponse = await response.json();
+    if (responseJSON.status === "ok") {
+      navigate("/passkeys?prompt=recovery");
+    } else {
+      setNotification(responseJSON.errorMessage);
+    }
+  }
+
+  return (
+    <Layout parent="/">
+      <Notification notification={notification} />
+      <Heading>Use a recovery code</Heading>
+      <p className="text-sm text-center font-normal text-gray-500 mb-4">
+        Each code works once. You will be asked to add a new passkey.
+      </p>
+      <div className="space-y-6">
+        <Input type="email" placeholder="Email" value={email} onChange={setEmail} />
+        <Input type="text" placeholder="abcde-fghij-klmno" value={code} onChange={setCode} />
+
+        <Button buttonText="Sign in" onClickFunc={handleLogin} />
+      </div>
+    </Layout>
+  );
+}
@@ -0,0 +1,56 @@
+import React, { useState } from "react";
+import { useNavigate, useSearchParams } from "react-router-dom";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Input } from "../components/input/Input";
+import { Button } from "../components/input/Button";
+import { Notification } from "../components/layout/Notification";
+import { AuthResponse } from "../utils/types";
+
+export default function ResetPassword(): React.ReactElement {
+  const [searchParams] = useSearchParams();
+  const [newPassword, setNewPassword] = useState("");
+  const [notification, setNotification] = useState("");
+  const navigate = useNavigate();
+
+  async function handleResetPassword() {
+    if (newPassword === "" || newPassword.length < 8) {
+      setNotification("New password is short");
+      return;
+    }
+
+    const response = await fetch("/password/reset", {
+      method: "POST",
+      body: JSON.stringify({
+        token: searchParams.get("token") ?? "",
+        password: newPassword,
+      }),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    const responseJSON: AuthResponse = await response.json();
+    if (responseJSON.status === "ok") {
+      navigate("/");
+    } else {
+      setNotification(responseJSON.errorMessage);
+    }
+  }
+
+  return (
+    <Layout parent="/">
+      <Notification notification={notification} />
+      <Heading>Choose a new password</Heading>
+      <div className="space-y-6">
+        <Input
+          type="password"
+          placeholder="New password"
+          value={newPassword}
+          onChange={setNewPassword}
+        />
+
+        <Button buttonText="Reset password" onClickFunc={handleResetPassword} />
+      </div>
+    </Layout>
+  );
+}
@@ -0,0 +1,51 @@
+import React, { useState } from "react";
+import { useNavigate, useSearchParams } from "react-router-dom";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Input } from "../components/input/Input";
+import { Button } from "../components/input/Button";
+import { Notification } from "../components/layout/Notification";
+import { AuthResponse } from "../utils/types";
+
+export default function TOTPLogin(): React.ReactElement {
+  const [code, setCode] = useState("");
+  const [notification, setNotification] = useState("");
+  const navigate = useNavigate();
+  // set after a sign in link, which leads on to adding a new passkey
+  const [searchParams] = useSearchParams();
+
+  async function handleLogin() {
+    const response = await fetch("/login/totp", {
+      method: "POST",
+      body: JSON.stringify({ code }),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    const responseJSON: AuthResponse = await response.json();
+    if (responseJSON.status === "ok") {
+      navigate(
+        searchParams.get("prompt") === "register"
+          ? "/passkeys?prompt=register"
+          : "/home"
+      );
+    } else {
+      setNotification(responseJSON.errorMessage);
+    }
+  }
+
+  return (
+    <Layout parent="/">
+      <Notification notification={notification} />
+      <Heading>Two-factor authentication</Heading>
+      <p className="text-sm text-center font-normal text-gray-500 mb-4">
+        Enter the 6 digit code from your authenticator app.
+      </p>
+      <div className="space-y-6">
+        <Input type="text" placeholder="123456" value={code} onChange={setCode} />
+
+        <Button buttonText="Verify" onClickFunc={handleLogin} />
+      </div>
+    </Layout>
+  );
+}
@@ -0,0 +1,114 @@
+import React, { useEffect, useState } from "react";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Input } from "../components/input/Input";
+import { Button } from "../components/input/Button";
+import { Notification } from "../components/layout/Notification";
+import { loginPasskey } from "../hooks/webauth_api";
+import { AuthResponse } from "../utils/types";
+
+type Enrollment = {
+  secret: string;
+  uri: string;
+};
+
+export default function TwoFactor(): React.ReactElement {
+  const [enabled, setEnabled] = useState(false);
+  const [enrollment, setEnrollment] = useState<Enrollment | null>(null);
+  const [code, setCode] = useState("");
+  const [notification, setNotification] = useState("");
+
+  useEffect(() => {
+    getStatus();
+  }, []);
+
+  async function getStatus() {
+    const response = await fetch("/totp");
+    const status = await response.json();
+    setEnabled(status.enabled);
+  }
+
+  // changes to the second factor need a fresh passkey confirmation
+  function withPasskey(action: () => Promise<void>) {
+    loginPasskey("", "reauth", action, (errorMessage) =>
+      setNotification(errorMessage)
+    );
+  }
+
+  function handleEnroll() {
+    withPasskey(async () => {
+      const response = await fetch("/totp/enroll", { method: "POST" });
+      if (response.ok) {
+        setEnrollment(await response.json());
+      } else {
+        const responseJSON: AuthResponse = await response.json();
+        setNotification(responseJSON.errorMessage);
+      }
+    });
+  }
+
+  async function handleConfirm() {
+    const response = await fetch("/totp/confirm", {
+      method: "POST",
+      body: JSON.stringify({ code }),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    const responseJSON: AuthResponse = await response.json();
+    if (responseJSON.status === "ok") {
+      setEnrollment(null);
+      setEnabled(true);
+      setNotification("Authenticator app enabled");
+    } else {
+      setNotification(responseJSON.errorMessage);
+    }
+  }
+
+  function handleDisable() {
+    withPasskey(async () => {
+      const response = await fetch("/totp", { method: "DELETE" });
+      if (response.ok) {
+        setEnabled(false);
+        setNotification("Authenticator app removed");
+      } else {
+        setNotification("Failed to remove authenticator app");
+      }
+    });
+  }
+
+  return (
+    <Layout parent="/home">
+      <Notification notification={notification} />
+      <Heading>Two-factor authentication</Heading>
+      <p className="text-sm text-center font-normal text-gray-500 mb-4">
+        Password sign ins ask for a code from your authenticator app.
+      </p>
+
+      {enabled && (
+        <Button
+          buttonText="Remove authenticator app"
+          onClickFunc={handleDisable}
+          className="bg-red-500/10 hover:bg-red-500/20 text-red-500 border border-red-500/20 hover:border-red-500/30 hover:shadow-red-500/10"
+        />
+      )}
+
+      {!enabled && !enrollment && (
+        <Button buttonText="Set up authenticator app" onClickFunc={handleEnroll} />
+      )}
+
+      {enrollment && (
+        <div className="space-y-6">
+          <p className="text-sm text-gray-500 break-all">
+            Add this key to your authenticator app:{" "}
+            <a href={enrollment.uri} className="font-mono text-indigo-600">
+              {enrollment.secret}
+            </a>
+          </p>
+          <Input type="text" placeholder="123456" value={code} onChange={setCode} />
+          <Button buttonText="Confirm" onClickFunc={handleConfirm} />
+        </div>
+      )}
+    </Layout>
+  );
+}
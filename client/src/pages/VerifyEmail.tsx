@@ -0,0 +1,39 @@
+import React from "react";
+import { useNavigate, useSearchParams } from "react-router-dom";
+import { Layout } from "../components/layout/Layout";
+import { Heading } from "../components/layout/Heading";
+import { Button } from "../components/input/Button";
+import { AuthResponse } from "../utils/types";
+
+// the link in the email only opens this page, the token is used up when the
+// user confirms, not when a mail scanner follows the link
+export default function VerifyEmail(): React.ReactElement {
+  const [searchParams] = useSearchParams();
+  const navigate = useNavigate();
+
+  async function handleVerify() {
+    const response = await fetch("/verify_email", {
+      method: "POST",
+      body: JSON.stringify({ token: searchParams.get("token") ?? "" }),
+      headers: {
+        "Content-Type": "application/json",
+      },
+    });
+    const responseJSON: AuthResponse = await response.json();
+    navigate(
+      responseJSON.status === "ok"
+        ? "/email_verified?status=ok"
+        : "/email_verified?status=invalid"
+    );
+  }
+
+  return (
+    <Layout>
+      <Heading>Confirm your email address</Heading>
+      <p className="text-sm text-center font-normal text-gray-500 mb-4">
+        Confirm that this email address belongs to your account.
+      </p>
+      <Button buttonText="Confirm email address" onClickFunc={handleVerify} />
+    </Layout>
+  );
+}
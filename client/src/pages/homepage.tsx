@@ -7,6 +7,8 @@ const MenuItems = [
   { title: "Manage Passkeys", link: "/passkeys" },
   { title: "Change email address", link: "/edit_email" },
   { title: "Change password", link: "/edit_password" },
+  { title: "Two-factor authentication", link: "/two_factor" },
+  { title: "Recovery codes", link: "/recovery_codes" },
   { title: "Lost passkey?", link: "#" },
   { title: "Delete Account", link: "/delete_account" },
 ];
@@ -1,19 +1,32 @@
 import React from "react";
+import { useSearchParams } from "react-router-dom";
 import { Divider } from "../components/layout/Divider";
 import { Link } from "../components/input/Link";
 import { Layout } from "../components/layout/Layout";
+import { Notification } from "../components/layout/Notification";
 import { PasswordLogin } from "../components/form/PasswordLogin";
 import { PasskeyLogin } from "../components/form/PasskeyLogin";
 
+// set by the unlock page the email sent on lockout links to
+const statusMessages: Record<string, string> = {
+  unlocked: "Your account is unlocked, you can sign in again.",
+  unlock_invalid: "This unlock link is invalid or has expired.",
+};
+
 export default function Login(): React.ReactElement {
+  const [searchParams] = useSearchParams();
+
   return (
     <Layout>
+      <Notification notification={statusMessages[searchParams.get("status") ?? ""] ?? ""} />
       <PasswordLogin />
       <Divider />
       <PasskeyLogin />
 
       <div className="mt-10">
-        <Link href="#" linkText="Trouble logging in?" />
+        <Link href="/forgot_password" linkText="Forgot your password?" />
+        <Link href="/magic_link" linkText="Lost your passkey? Email me a sign in link" />
+        <Link href="/login/recovery" linkText="Use a recovery code" />
         <Link href="/sign-up" linkText="Sign up for a new account" />
       </div>
     </Layout>
@@ -1,6 +1,7 @@
 export type AuthResponse = {
   status: "ok" | "error";
   errorMessage: string;
+  code?: string;
 };
 
 export type PasskeyProvider = {
@@ -13,6 +14,12 @@ export type PasskeyProvider = {
 export type Passkey = {
   passkey_provider: PasskeyProvider;
   credential_id: string;
+  name: string;
+  sign_count: number;
+  backup_eligible: boolean;
+  backup_state: boolean;
+  clone_warning: boolean;
+  last_used_at: string | null;
   created_at: string;
   updated_at: string;
 };
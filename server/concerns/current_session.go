@@ -0,0 +1,14 @@
+package concerns
+
+import (
+	"github.com/baala3/passkeys/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+func CurrentSession(ctx echo.Context) *pkg.Session {
+	session, ok := ctx.Get("session").(*pkg.Session)
+	if !ok {
+		return nil
+	}
+	return session
+}
@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/baala3/passkeys/pkg"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+type AuthenticatorController struct {
+	ProviderCatalog *pkg.PasskeyProviderCatalog
+}
+
+type authenticatorResponse struct {
+	AAGUID uuid.UUID `json:"aaguid"`
+	pkg.PasskeyProvider
+}
+
+// GetAuthenticator serves the name and icons of a passkey provider, public so
+// the client can show them before anyone signed in
+func (ac *AuthenticatorController) GetAuthenticator() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		aaguid, err := uuid.Parse(ctx.Param("aaguid"))
+		if err != nil {
+			return pkg.SendError(ctx, errors.New("Invalid AAGUID."), http.StatusBadRequest)
+		}
+
+		provider, ok := ac.ProviderCatalog.Lookup(aaguid)
+		if !ok {
+			return pkg.SendError(ctx, errors.New("Unknown authenticator."), http.StatusNotFound)
+		}
+
+		// the list changes rarely and the icons are large
+		ctx.Response().Header().Set(echo.HeaderCacheControl, "public, max-age=3600")
+		return ctx.JSON(http.StatusOK, authenticatorResponse{AAGUID: aaguid, PasskeyProvider: provider})
+	}
+}
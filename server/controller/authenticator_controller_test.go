@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/baala3/passkeys/pkg"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticatorController_GetAuthenticator(t *testing.T) {
+	aaguid := uuid.New()
+	path := filepath.Join(t.TempDir(), "aaguid.json")
+	if err := os.WriteFile(path, []byte(`{"`+aaguid.String()+`": {"name": "Custom Key", "icon_dark": "data:dark", "icon_light": "data:light"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AAGUID_FILE", path)
+	catalog, err := pkg.NewPasskeyProviderCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticatorController := &AuthenticatorController{ProviderCatalog: catalog}
+
+	get := func(param string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ctx := e.NewContext(httptest.NewRequest(echo.GET, "/authenticators/"+param, nil), rec)
+		ctx.SetParamNames("aaguid")
+		ctx.SetParamValues(param)
+		if err := authenticatorController.GetAuthenticator()(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := get(aaguid.String())
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"aaguid":"`+aaguid.String()+`","name":"Custom Key","icon_dark":"data:dark","icon_light":"data:light"}`, rec.Body.String())
+	assert.Contains(t, rec.Header().Get(echo.HeaderCacheControl), "max-age")
+
+	assert.Equal(t, http.StatusNotFound, get(uuid.NewString()).Code)
+	assert.Equal(t, http.StatusBadRequest, get("not-an-aaguid").Code)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/baala3/passkeys/concerns"
+	"github.com/baala3/passkeys/model"
 	"github.com/baala3/passkeys/pkg"
 	"github.com/baala3/passkeys/repository"
 	"github.com/labstack/echo/v4"
@@ -12,9 +13,13 @@ import (
 
 type EmailController struct {
 	UserRepository repository.UserRepository
+	TokenRepository repository.TokenRepository
 	UserSession pkg.UserSession
+	EmailVerifier EmailVerifier
 }
 
+// ChangeEmail sends a confirmation link to the new address. The current
+// address stays in use until the link is opened.
 func (ec *EmailController) ChangeEmail() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		var p struct {
@@ -39,8 +44,7 @@ func (ec *EmailController) ChangeEmail() echo.HandlerFunc {
 			return pkg.SendError(ctx, errors.New("New email is already in use"), http.StatusBadRequest)
 		}
 
-		user.Email = p.Email
-		if err := ec.UserRepository.UpdateUser(ctx.Request().Context(), user); err != nil {
+		if err := ec.EmailVerifier.SendEmailChange(ctx.Request().Context(), user, p.Email); err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
@@ -48,3 +52,70 @@ func (ec *EmailController) ChangeEmail() echo.HandlerFunc {
 	}
 }
 
+// VerifyEmail redeems the token of a link sent by EmailVerifier. The link
+// opens a page that posts the token once the user confirms, so mail scanners
+// following the link do not use it up.
+func (ec *EmailController) VerifyEmail() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p struct {
+			Token string
+		}
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		userToken, err := ec.TokenRepository.ConsumeToken(ctx.Request().Context(), model.TokenPurposeEmailVerification, p.Token)
+		if err == nil {
+			err = ec.UserRepository.MarkEmailVerified(ctx.Request().Context(), userToken.UserID, userToken.Email)
+			return ec.sendVerified(ctx, err)
+		}
+		if !errors.Is(err, repository.ErrTokenInvalid) {
+			return ec.sendVerified(ctx, err)
+		}
+
+		userToken, err = ec.TokenRepository.ConsumeToken(ctx.Request().Context(), model.TokenPurposeEmailChange, p.Token)
+		if err != nil {
+			return ec.sendVerified(ctx, err)
+		}
+		if err := ec.UserRepository.ChangeEmail(ctx.Request().Context(), userToken.UserID, userToken.Email); err != nil {
+			return ec.sendVerified(ctx, err)
+		}
+
+		// like a password change, a new address signs out the other devices
+		keep := ""
+		if cookie, err := ctx.Cookie("auth"); err == nil {
+			if session, err := ec.UserSession.Get(ctx.Request().Context(), cookie.Value); err == nil && session.UserID == userToken.UserID {
+				keep = session.Token()
+			}
+		}
+		err = ec.UserSession.RevokeOthers(ctx.Request().Context(), userToken.UserID, keep)
+		return ec.sendVerified(ctx, err)
+	}
+}
+
+// ResendVerification sends a new verification link to the current address
+func (ec *EmailController) ResendVerification() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user := concerns.CurrentUser(ctx, ec.UserRepository)
+		if user == nil {
+			return pkg.SendError(ctx, errors.New("Cannot get current user"), http.StatusInternalServerError)
+		}
+
+		if user.EmailVerifiedAt != nil {
+			return pkg.SendError(ctx, errors.New("Email is already verified"), http.StatusBadRequest)
+		}
+
+		if err := ec.EmailVerifier.SendVerification(ctx.Request().Context(), user); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return pkg.SendOK(ctx)
+	}
+}
+
+func (ec *EmailController) sendVerified(ctx echo.Context, err error) error {
+	if err != nil {
+		ctx.Logger().Errorf("failed to verify email: %v", err)
+		return pkg.SendError(ctx, errors.New("This link is invalid or has expired."), http.StatusBadRequest)
+	}
+	return pkg.SendOK(ctx)
+}
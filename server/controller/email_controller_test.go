@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailController_ChangeEmail(t *testing.T) {
+	emailController := &EmailController{
+		UserRepository: userRepository,
+		TokenRepository: repository.TokenRepository{DB: database},
+		UserSession: userSession,
+		EmailVerifier: emailVerifier,
+	}
+	user, err := userRepository.CreateUser(context.Background(), "old@email.com", "hash", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := userSession.Create(e.NewContext(httptest.NewRequest(echo.POST, "/login", nil), rec), user.ID, pkg.AuthMethodPassword); err != nil {
+		t.Fatal(err)
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	verify := func(t *testing.T, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/verify_email", strings.NewReader(`{"token":"`+token+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, emailController.VerifyEmail()(e.NewContext(req, rec)))
+		return rec
+	}
+
+	t.Run("keeps the old address until confirmed", func(t *testing.T) {
+		req := httptest.NewRequest(echo.POST, "/change_email", strings.NewReader(`{"email":"changed@email.com"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, req, rec, cookie)
+
+		assert.NoError(t, emailController.ChangeEmail()(ctx))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		_, err := userRepository.FindUserByEmail(context.Background(), "old@email.com")
+		assert.NoError(t, err)
+
+		// the old address is told about the change, the new one gets the link
+		notification := mailer.last()
+		confirmation := mailer.messages[len(mailer.messages)-2]
+		assert.Equal(t, "old@email.com", notification.To)
+		assert.Contains(t, notification.Body, "changed@email.com")
+		assert.Equal(t, "changed@email.com", confirmation.To)
+	})
+
+	t.Run("invalid link", func(t *testing.T) {
+		rec := verify(t, "invalid")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"This link is invalid or has expired."}`, rec.Body.String())
+	})
+
+	t.Run("confirmed", func(t *testing.T) {
+		token := linkToken(t, mailer.messages[len(mailer.messages)-2])
+		rec := verify(t, token)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		changed, err := userRepository.FindUserByEmail(context.Background(), "changed@email.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, user.ID, changed.ID)
+		assert.NotNil(t, changed.EmailVerifiedAt)
+
+		// the link only works once
+		rec = verify(t, token)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestEmailController_VerifyEmail(t *testing.T) {
+	emailController := &EmailController{
+		UserRepository: userRepository,
+		TokenRepository: repository.TokenRepository{DB: database},
+		UserSession: userSession,
+		EmailVerifier: emailVerifier,
+	}
+	user, err := userRepository.CreateUser(context.Background(), "unverified@email.com", "hash", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := emailVerifier.SendVerification(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(echo.POST, "/verify_email", strings.NewReader(`{"token":"`+linkToken(t, mailer.last())+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, emailController.VerifyEmail()(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	verified, err := userRepository.FindUserByEmail(context.Background(), user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, verified.EmailVerifiedAt)
+}
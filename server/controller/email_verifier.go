@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/google/uuid"
+)
+
+const emailVerificationTTL = 24 * time.Hour
+
+// EmailVerifier sends the links that prove a user owns an email address
+type EmailVerifier struct {
+	TokenRepository repository.TokenRepository
+	Mailer          pkg.Mailer
+}
+
+// SendVerification asks a new user to confirm the address they signed up with
+func (ev EmailVerifier) SendVerification(ctx context.Context, user *model.User) error {
+	link, err := ev.verificationLink(ctx, user.ID, model.TokenPurposeEmailVerification, user.Email)
+	if err != nil {
+		return err
+	}
+
+	return ev.Mailer.Send(ctx, pkg.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Please confirm that this is your email address by opening the link below within %s:\n%s",
+			emailVerificationTTL, link),
+	})
+}
+
+// SendEmailChange sends a confirmation link to the new address and lets the
+// current one know, in case the change was not made by its owner
+func (ev EmailVerifier) SendEmailChange(ctx context.Context, user *model.User, newEmail string) error {
+	// only the latest requested address can be confirmed
+	if err := ev.TokenRepository.DeleteTokens(ctx, user.ID, model.TokenPurposeEmailChange); err != nil {
+		return err
+	}
+
+	link, err := ev.verificationLink(ctx, user.ID, model.TokenPurposeEmailChange, newEmail)
+	if err != nil {
+		return err
+	}
+
+	err = ev.Mailer.Send(ctx, pkg.Message{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Open the link below within %s to use this address for your account:\n%s",
+			emailVerificationTTL, link),
+	})
+	if err != nil {
+		return err
+	}
+
+	return ev.Mailer.Send(ctx, pkg.Message{
+		To:      user.Email,
+		Subject: "Your email address is about to change",
+		Body: fmt.Sprintf("Someone asked to change the email address of your account to %s. "+
+			"This address stays active until the change is confirmed.\n\n"+
+			"If this was not you, sign in and change your password.", newEmail),
+	})
+}
+
+// SendAccountExists answers a signup for an address that already has an
+// account, when the signup response must not tell (see pkg.AntiEnumeration)
+func (ev EmailVerifier) SendAccountExists(ctx context.Context, user *model.User) error {
+	origin := os.Getenv("RP_ORIGIN")
+	return ev.Mailer.Send(ctx, pkg.Message{
+		To:      user.Email,
+		Subject: "You already have an account",
+		Body: fmt.Sprintf("Someone tried to sign up with this email address, but it already has an account.\n\n"+
+			"If this was you, sign in at %s or reset your password at %s/forgot_password. "+
+			"Otherwise you can ignore this email.", origin, origin),
+	})
+}
+
+func (ev EmailVerifier) verificationLink(ctx context.Context, userID uuid.UUID, purpose string, email string) (string, error) {
+	token, err := ev.TokenRepository.CreateEmailToken(ctx, userID, purpose, email, emailVerificationTTL)
+	if err != nil {
+		return "", err
+	}
+	return os.Getenv("RP_ORIGIN") + "/verify_email?token=" + url.QueryEscape(token), nil
+}
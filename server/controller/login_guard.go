@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+)
+
+// LoginGuard throttles the login endpoints by IP and account. Accounts are
+// identified by email, so guessing against addresses without an account is
+// slowed down just the same. When an account gets locked its owner receives
+// a link to unlock it right away.
+type LoginGuard struct {
+	RateLimiter     pkg.RateLimiter
+	UserRepository  repository.UserRepository
+	TokenRepository repository.TokenRepository
+	Mailer          pkg.Mailer
+	Signer          pkg.Signer
+	Background      pkg.Background
+}
+
+// Allow returns a pkg.RateLimitedError when the request has to wait, see pkg.SendRateLimited
+func (lg LoginGuard) Allow(ctx echo.Context, policy pkg.RateLimitPolicy, email string) error {
+	return lg.RateLimiter.Allow(ctx.Request().Context(), policy, ctx.RealIP(), email)
+}
+
+// Fail records a failed attempt. Errors are only logged, they must not change
+// the answer of the login. The unlock link is sent in the background, so the
+// failure that locks an account takes as long whether or not the account exists.
+func (lg LoginGuard) Fail(ctx echo.Context, policy pkg.RateLimitPolicy, email string) {
+	locked, err := lg.RateLimiter.Fail(ctx.Request().Context(), policy, email)
+	if err != nil {
+		ctx.Logger().Errorf("failed to record login failure: %v", err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	lg.Background.Go(ctx, "send unlock link", func(ctx context.Context) error {
+		user, err := lg.UserRepository.FindUserByEmail(ctx, email)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return lg.sendUnlockLink(ctx, user, policy)
+	})
+}
+
+// Throttle counts a request that is costly however it ends, e.g. one that
+// sends an email, against the IP and the account
+func (lg LoginGuard) Throttle(ctx echo.Context, policy pkg.RateLimitPolicy, email string) error {
+	if err := lg.Allow(ctx, policy, email); err != nil {
+		return err
+	}
+	if _, err := lg.RateLimiter.Fail(ctx.Request().Context(), policy, email); err != nil {
+		ctx.Logger().Errorf("failed to record request: %v", err)
+	}
+	return nil
+}
+
+// Succeed forgets earlier failures of the account
+func (lg LoginGuard) Succeed(ctx echo.Context, policy pkg.RateLimitPolicy, email string) {
+	if err := lg.RateLimiter.Reset(ctx.Request().Context(), policy, email); err != nil {
+		ctx.Logger().Errorf("failed to reset login failures: %v", err)
+	}
+}
+
+// Unlock redeems the token of the link sent on lockout and lifts the lockout of
+// all login endpoints. The link only opens a page that posts the token, so a
+// mail scanner following it does not use it up.
+func (lg LoginGuard) Unlock() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p struct {
+			Token string
+		}
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		token, ok := lg.Signer.Verify(p.Token)
+		if !ok {
+			return lg.sendInvalid(ctx, errors.New("bad signature"))
+		}
+
+		userToken, err := lg.TokenRepository.ConsumeToken(ctx.Request().Context(), model.TokenPurposeAccountUnlock, token)
+		if err != nil {
+			return lg.sendInvalid(ctx, err)
+		}
+
+		lg.UnlockAccount(ctx, userToken.Email)
+		return pkg.SendOK(ctx)
+	}
+}
+
+// UnlockAccount lifts the lockout of all login endpoints, e.g. after the
+// password was reset
+func (lg LoginGuard) UnlockAccount(ctx echo.Context, email string) {
+	config := lg.RateLimiter.Config
+	for _, policy := range []pkg.RateLimitPolicy{config.PasswordLogin, config.PasskeyLogin, config.TOTPLogin, config.RecoveryLogin} {
+		lg.Succeed(ctx, policy, email)
+	}
+}
+
+func (lg LoginGuard) sendInvalid(ctx echo.Context, err error) error {
+	ctx.Logger().Errorf("failed to redeem unlock link: %v", err)
+	return pkg.SendError(ctx, errors.New("This unlock link is invalid or has expired."), http.StatusBadRequest)
+}
+
+func (lg LoginGuard) sendUnlockLink(ctx context.Context, user *model.User, policy pkg.RateLimitPolicy) error {
+	token, err := lg.TokenRepository.CreateEmailToken(ctx, user.ID, model.TokenPurposeAccountUnlock, user.Email, policy.LockoutDuration)
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("RP_ORIGIN") + "/login/unlock?token=" + url.QueryEscape(lg.Signer.Sign(token))
+	return lg.Mailer.Send(ctx, pkg.Message{
+		To:      user.Email,
+		Subject: "Sign in to your account was locked",
+		Body: fmt.Sprintf("There were too many failed attempts to sign in to your account, so sign in is locked for %s.\n"+
+			"If these attempts were yours, open the link below to unlock it now:\n%s\n\n"+
+			"If they were not, nobody got in, but consider changing your password.", policy.LockoutDuration, link),
+	})
+}
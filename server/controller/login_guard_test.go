@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginGuard(t *testing.T) {
+	guard := loginGuard
+	guard.RateLimiter = pkg.RateLimiter{
+		Store: memoryStore(t),
+		Config: pkg.RateLimitConfig{
+			PasswordLogin: pkg.RateLimitPolicy{
+				Name:             "password_login",
+				IPLimit:          1000,
+				IPWindow:         time.Minute,
+				FreeFailures:     5,
+				LockoutThreshold: 3,
+				LockoutDuration:  time.Minute,
+			},
+		},
+	}
+	controller := *passwordController
+	controller.LoginGuard = guard
+
+	passwordHash, err := argon2id.CreateHash("password123", argon2id.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userRepository.CreateUser(context.Background(), "locked@email.com", passwordHash, true); err != nil {
+		t.Fatal(err)
+	}
+
+	passwordLogin := func(t *testing.T, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/login/password", strings.NewReader(`{"email":"locked@email.com", "password":"`+password+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, controller.Login()(e.NewContext(req, rec)))
+		return rec
+	}
+
+	t.Run("locks the account and tells its owner", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusUnauthorized, passwordLogin(t, "wrong").Code)
+		}
+		guard.Background.Wait()
+		assert.Equal(t, "locked@email.com", mailer.last().To)
+		assert.Contains(t, mailer.last().Subject, "locked")
+
+		// the right password does not help while locked
+		rec := passwordLogin(t, "password123")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+		assert.Contains(t, rec.Body.String(), pkg.ErrorCodeRateLimited)
+	})
+
+	t.Run("unlock link", func(t *testing.T) {
+		token := linkToken(t, mailer.last())
+		unlock := func(t *testing.T) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(echo.POST, "/login/unlock", strings.NewReader(`{"token":"`+token+`"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			assert.NoError(t, guard.Unlock()(e.NewContext(req, rec)))
+			return rec
+		}
+
+		assert.Equal(t, http.StatusOK, unlock(t).Code)
+		assert.Equal(t, http.StatusOK, passwordLogin(t, "password123").Code)
+
+		// the token is used up
+		rec := unlock(t)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"This unlock link is invalid or has expired."}`, rec.Body.String())
+	})
+
+	t.Run("per IP limit", func(t *testing.T) {
+		limited := controller
+		limited.LoginGuard.RateLimiter.Store = memoryStore(t)
+		limited.LoginGuard.RateLimiter.Config.PasswordLogin.IPLimit = 2
+
+		var codes []int
+		for _, email := range []string{"a@email.com", "b@email.com", "c@email.com"} {
+			req := httptest.NewRequest(echo.POST, "/login/password", strings.NewReader(`{"email":"`+email+`", "password":"password123"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			assert.NoError(t, limited.Login()(e.NewContext(req, rec)))
+			codes = append(codes, rec.Code)
+		}
+		assert.Equal(t, []int{http.StatusNotFound, http.StatusNotFound, http.StatusTooManyRequests}, codes)
+	})
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+)
+
+const magicLinkTTL = 15 * time.Minute
+
+// MagicLinkController signs users in with a link sent to their email address.
+// It is the way back in for passkey only accounts that lost their passkey.
+type MagicLinkController struct {
+	UserRepository  repository.UserRepository
+	TokenRepository repository.TokenRepository
+	TOTPRepository  repository.TOTPRepository
+	UserSession     pkg.UserSession
+	Mailer          pkg.Mailer
+	Signer          pkg.Signer
+	LoginGuard      LoginGuard
+	Background      pkg.Background
+}
+
+// SendLink emails a sign in link. Like ForgotPassword it answers the same, and
+// just as fast, whether or not an account exists.
+func (mc MagicLinkController) SendLink() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p pkg.Params
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		if !pkg.IsValidEmail(p.Email) {
+			return pkg.SendError(ctx, errors.New("Invalid email"), http.StatusBadRequest)
+		}
+
+		if err := mc.LoginGuard.Throttle(ctx, mc.LoginGuard.RateLimiter.Config.MagicLink, p.Email); err != nil {
+			return pkg.SendRateLimited(ctx, err)
+		}
+
+		user, err := mc.UserRepository.FindUserByEmail(ctx.Request().Context(), p.Email)
+		if err != nil {
+			return pkg.SendOK(ctx)
+		}
+
+		mc.Background.Go(ctx, "send magic link", func(ctx context.Context) error {
+			return mc.sendLink(ctx, user)
+		})
+		return pkg.SendOK(ctx)
+	}
+}
+
+// Login redeems a link sent by SendLink. The link only opens a page on which
+// the user confirms, so that mail scanners following it don't use it up. The
+// client then asks the user to register a new passkey, after the TOTP code if
+// the account has one: the link replaces the passkey or password, not the
+// second factor.
+func (mc MagicLinkController) Login() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p struct {
+			Token string
+		}
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		token, ok := mc.Signer.Verify(p.Token)
+		if !ok {
+			return mc.sendInvalid(ctx, errors.New("bad signature"))
+		}
+
+		userToken, err := mc.TokenRepository.ConsumeToken(ctx.Request().Context(), model.TokenPurposeMagicLink, token)
+		if err != nil {
+			return mc.sendInvalid(ctx, err)
+		}
+
+		// the link proves that the user can read the inbox of the address
+		if err := mc.UserRepository.MarkEmailVerified(ctx.Request().Context(), userToken.UserID, userToken.Email); err != nil {
+			return mc.sendInvalid(ctx, err)
+		}
+
+		totp, err := mc.TOTPRepository.FindTOTPCredential(ctx.Request().Context(), userToken.UserID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		if totp.Confirmed() {
+			if err := mc.UserSession.CreateMFAPending(ctx, userToken.UserID, pkg.AuthMethodMagicLink); err != nil {
+				return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			}
+			return pkg.SendOKCode(ctx, pkg.CodeTOTPRequired)
+		}
+
+		if err := mc.UserSession.Create(ctx, userToken.UserID, pkg.AuthMethodMagicLink); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return pkg.SendOK(ctx)
+	}
+}
+
+func (mc MagicLinkController) sendInvalid(ctx echo.Context, err error) error {
+	ctx.Logger().Errorf("failed to redeem magic link: %v", err)
+	return pkg.SendError(ctx, errors.New("This sign in link is invalid or has expired."), http.StatusBadRequest)
+}
+
+func (mc MagicLinkController) sendLink(ctx context.Context, user *model.User) error {
+	token, err := mc.TokenRepository.CreateEmailToken(ctx, user.ID, model.TokenPurposeMagicLink, user.Email, magicLinkTTL)
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("RP_ORIGIN") + "/login/magic_link?token=" + url.QueryEscape(mc.Signer.Sign(token))
+	return mc.Mailer.Send(ctx, pkg.Message{
+		To:      user.Email,
+		Subject: "Your sign in link",
+		Body: fmt.Sprintf("Open the link below within %s to sign in:\n%s\n\n"+
+			"After signing in, add a new passkey so you can sign in without email next time. "+
+			"If you did not ask for this link, you can ignore this email.", magicLinkTTL, link),
+	})
+}
@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+		"strings"
+	"testing"
+	"time"
+
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMagicLinkController(t *testing.T) {
+	magicLinkController := &MagicLinkController{
+		UserRepository: userRepository,
+		TokenRepository: repository.TokenRepository{DB: database},
+		TOTPRepository: repository.TOTPRepository{DB: database},
+		UserSession: userSession,
+		Mailer: mailer,
+		Signer: pkg.Signer{Secret: []byte("secret")},
+		LoginGuard: loginGuard,
+		Background: pkg.NewBackground(),
+	}
+	user, err := userRepository.CreateUser(context.Background(), "lost-passkey@email.com", "hash", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(t *testing.T, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/login/magic_link/confirm", strings.NewReader(`{"token":"`+token+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, magicLinkController.Login()(e.NewContext(req, rec)))
+		return rec
+	}
+
+	send := func(t *testing.T, email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/login/magic_link", strings.NewReader(`{"email":"`+email+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, magicLinkController.SendLink()(e.NewContext(req, rec)))
+		magicLinkController.Background.Wait()
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, send(t, user.Email).Code)
+	assert.Equal(t, user.Email, mailer.last().To)
+	token := linkToken(t, mailer.last())
+
+	t.Run("tampered link", func(t *testing.T) {
+		rec := login(t, token+"x")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"This sign in link is invalid or has expired."}`, rec.Body.String())
+	})
+
+	t.Run("successful login", func(t *testing.T) {
+		rec := login(t, token)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		session, err := userSession.Get(context.Background(), rec.Result().Cookies()[0].Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, user.ID, session.UserID)
+		assert.Equal(t, pkg.AuthMethodMagicLink, session.AuthMethod)
+		assert.True(t, session.LowAssurance)
+		// sensitive actions still need a passkey or password
+		assert.False(t, session.RecentlyVerified(userSession.Config.ReauthMaxAge))
+	})
+
+	t.Run("the link only works once", func(t *testing.T) {
+		rec := login(t, token)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"This sign in link is invalid or has expired."}`, rec.Body.String())
+	})
+
+	t.Run("addresses are throttled whether or not they have an account", func(t *testing.T) {
+		// the account got its first link above
+		for email, sent := range map[string]int{"no-magic@email.com": 0, user.Email: 1} {
+			for range 3 - sent {
+				assert.Equal(t, http.StatusOK, send(t, email).Code)
+			}
+			assert.Equal(t, http.StatusTooManyRequests, send(t, email).Code)
+		}
+	})
+
+	t.Run("account with two-factor authentication waits for the code", func(t *testing.T) {
+		secretBox, err := pkg.NewSecretBoxWithKey("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		totpController := &TOTPController{
+			UserRepository: userRepository,
+			TOTPRepository: magicLinkController.TOTPRepository,
+			UserSession: userSession,
+			SecretBox: secretBox,
+			LoginGuard: loginGuard,
+		}
+		user, err := userRepository.CreateUser(context.Background(), "two-factor-link@email.com", "hash", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, err := pkg.NewTOTPSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := secretBox.Seal(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, totpController.TOTPRepository.StartEnrollment(context.Background(), user.ID, sealed))
+		assert.NoError(t, totpController.TOTPRepository.Confirm(context.Background(), user.ID, 0))
+
+		assert.Equal(t, http.StatusOK, send(t, user.Email).Code)
+		rec := login(t, linkToken(t, mailer.last()))
+		assert.JSONEq(t, `{"status":"ok","errorMessage":"","code":"totp_required"}`, rec.Body.String())
+
+		pending := rec.Result().Cookies()[0]
+		session, err := userSession.Get(context.Background(), pending.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, session.MFAPending)
+
+		code, err := pkg.TOTPCode(secret, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(echo.POST, "/login/totp", strings.NewReader(`{"code":"`+code+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.AddCookie(pending)
+		rec = httptest.NewRecorder()
+		assert.NoError(t, totpController.Login()(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		session, err = userSession.Get(context.Background(), rec.Result().Cookies()[0].Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, session.MFAPending)
+		assert.Equal(t, pkg.AuthMethodMagicLink, session.AuthMethod)
+		// the code does not replace the passkey or password for sensitive actions
+		assert.True(t, session.LowAssurance)
+		assert.False(t, session.RecentlyVerified(userSession.Config.ReauthMaxAge))
+	})
+}
@@ -4,8 +4,8 @@ import (
 	"errors"
 	"net/http"
 
-	"github.com/alexedwards/argon2id"
 	"github.com/baala3/passkeys/concerns"
+	"github.com/baala3/passkeys/model"
 	"github.com/baala3/passkeys/pkg"
 	"github.com/baala3/passkeys/repository"
 	"github.com/labstack/echo/v4"
@@ -14,8 +14,18 @@ import (
 type PasswordController struct {
 	UserRepository repository.UserRepository
 	UserSession pkg.UserSession
+	EmailVerifier EmailVerifier
+	TOTPRepository repository.TOTPRepository
+	LoginGuard LoginGuard
+	AntiEnumeration pkg.AntiEnumeration
+	PasswordHasher pkg.PasswordHasher
+	PasswordSetter PasswordSetter
+	WebAuthnSession pkg.WebAuthnSession
 }
 
+// errInvalidLogin does not tell which of the two was wrong, see pkg.AntiEnumeration
+var errInvalidLogin = errors.New("Invalid email or password.")
+
 func (pc PasswordController) SignUp() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		var p pkg.Params
@@ -30,27 +40,51 @@ func (pc PasswordController) SignUp() echo.HandlerFunc {
 			return pkg.SendError(ctx, errors.New("Invalid email"), http.StatusBadRequest)
 		}
 
-		if len(password) < 8 {
-			return pkg.SendError(ctx, errors.New("Password must be at least 8 characters"), http.StatusBadRequest)
+		if err := pc.PasswordSetter.Check(ctx.Request().Context(), email, password, nil); err != nil {
+			return pkg.SendError(ctx, err, pkg.PasswordErrorStatus(err))
 		}
 
-		_, err := pc.UserRepository.FindUserByEmail(ctx.Request().Context(), email)
-
-		if err == nil {
-			return pkg.SendError(ctx, errors.New("An account with that email already exists."), http.StatusConflict)
-		}
-
-		passwordHash, err := argon2id.CreateHash(password, argon2id.DefaultParams)
+		// hashed before the lookup so that both outcomes take the same time
+		passwordHash, err := pc.PasswordHasher.Hash(password)
 		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		user, err := pc.UserRepository.CreateUser(ctx.Request().Context(), email, passwordHash)
+		existing, err := pc.UserRepository.FindUserByEmail(ctx.Request().Context(), email)
+
+		var user *model.User
 		if err != nil {
-			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			user, err = pc.UserRepository.CreateUser(ctx.Request().Context(), email, passwordHash, true)
+			// a concurrent signup with the same address won the race
+			if errors.Is(err, repository.ErrEmailTaken) {
+				existing, err = pc.UserRepository.FindUserByEmail(ctx.Request().Context(), email)
+			}
+			if err != nil {
+				return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			}
 		}
 
-		if err = pc.UserSession.Create(ctx, user.ID); err != nil {
+		if existing != nil {
+			if !pc.AntiEnumeration.Enabled {
+				return pkg.SendError(ctx, errors.New("An account with that email already exists."), http.StatusConflict)
+			}
+			if err := pc.EmailVerifier.SendAccountExists(ctx.Request().Context(), existing); err != nil {
+				ctx.Logger().Errorf("failed to send account exists email: %v", err)
+			}
+			return pkg.SendOKCode(ctx, pkg.CodeCheckEmail)
+		}
+
+		// the account is usable right away, the address is confirmed later
+		if err := pc.EmailVerifier.SendVerification(ctx.Request().Context(), user); err != nil {
+			ctx.Logger().Errorf("failed to send email verification: %v", err)
+		}
+
+		// signing in right away would tell this answer apart from the one above
+		if pc.AntiEnumeration.Enabled {
+			return pkg.SendOKCode(ctx, pkg.CodeCheckEmail)
+		}
+
+		if err = pc.UserSession.Create(ctx, user.ID, pkg.AuthMethodPassword); err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 		return pkg.SendOK(ctx)
@@ -71,90 +105,267 @@ func (pc PasswordController) Login() echo.HandlerFunc {
 			return pkg.SendError(ctx, errors.New("Invalid email"), http.StatusBadRequest)
 		}
 
+		policy := pc.LoginGuard.RateLimiter.Config.PasswordLogin
+		if err := pc.LoginGuard.Allow(ctx, policy, email); err != nil {
+			return pkg.SendRateLimited(ctx, err)
+		}
+
 		user, err := pc.UserRepository.FindUserByEmail(ctx.Request().Context(), email)
 		if err != nil {
+			pc.LoginGuard.Fail(ctx, policy, email)
+			if pc.AntiEnumeration.Enabled {
+				pc.AntiEnumeration.DummyCompare(p.Password)
+				return pkg.SendError(ctx, errInvalidLogin, http.StatusUnauthorized)
+			}
 			return pkg.SendError(ctx, errors.New("An account with that email does not exist."), http.StatusNotFound)
 		}
 
-		match, err := argon2id.ComparePasswordAndHash(p.Password, user.PasswordHash)
+		match, err := pc.checkPassword(ctx, user, p.Password)
 		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
 		if !match {
+			pc.LoginGuard.Fail(ctx, policy, email)
+			if pc.AntiEnumeration.Enabled {
+				return pkg.SendError(ctx, errInvalidLogin, http.StatusUnauthorized)
+			}
 			return pkg.SendError(ctx, errors.New("Invalid password."), http.StatusUnauthorized)
 		}
 
-		if err = pc.UserSession.Create(ctx, user.ID); err != nil {
+		// the user chose the password form over the passkey autofill of the page
+		if err := pc.WebAuthnSession.Discard(ctx, pkg.CeremonyConditionalLogin); err != nil {
+			ctx.Logger().Errorf("failed to discard conditional login: %v", err)
+		}
+
+		totp, err := pc.TOTPRepository.FindTOTPCredential(ctx.Request().Context(), user.ID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		if totp.Confirmed() {
+			// the session only becomes usable after POST /login/totp, which
+			// also forgets the failures once the code checked out
+			if err := pc.UserSession.CreateMFAPending(ctx, user.ID, pkg.AuthMethodPassword); err != nil {
+				return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			}
+			return pkg.SendOKCode(ctx, pkg.CodeTOTPRequired)
+		}
+		pc.LoginGuard.Succeed(ctx, policy, email)
+
+		if err = pc.UserSession.Create(ctx, user.ID, pkg.AuthMethodPassword); err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 		return pkg.SendOK(ctx)
 	}
 }
 
-func (pc PasswordController) Logout() echo.HandlerFunc {
+// checkPassword verifies the password of the user. A hash made with weaker
+// parameters than the current ones, or imported from bcrypt, is replaced on
+// the way; failing to do so does not fail the sign in. A matching password
+// also proves the account has a usable one, which the has_password migration
+// could not tell for accounts with a passkey.
+func (pc PasswordController) checkPassword(ctx echo.Context, user *model.User, password string) (bool, error) {
+	match, needsRehash, err := pc.PasswordHasher.Verify(password, user.PasswordHash)
+	if err != nil || !match {
+		return false, err
+	}
+
+	if !user.HasPassword {
+		if err := pc.UserRepository.MarkHasPassword(ctx.Request().Context(), user.ID); err != nil {
+			ctx.Logger().Errorf("failed to mark password as usable: %v", err)
+		} else {
+			user.HasPassword = true
+		}
+	}
+
+	if needsRehash {
+		passwordHash, err := pc.PasswordHasher.Hash(password)
+		if err == nil {
+			err = pc.UserRepository.UpgradePasswordHash(ctx.Request().Context(), user.ID, user.PasswordHash, passwordHash)
+		}
+		if err != nil {
+			ctx.Logger().Errorf("failed to upgrade password hash: %v", err)
+		} else {
+			user.PasswordHash = passwordHash
+		}
+	}
+	return true, nil
+}
+
+// Reauthenticate confirms the password of the signed in user before a sensitive action
+func (pc PasswordController) Reauthenticate() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
-		cookie, err := ctx.Cookie("auth")
+		var p struct {
+			Password string
+		}
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		user := concerns.CurrentUser(ctx, pc.UserRepository)
+		session := concerns.CurrentSession(ctx)
+		if user == nil || session == nil {
+			return pkg.SendError(ctx, errors.New("User not found"), http.StatusNotFound)
+		}
+
+		// a stolen session must not be a way around the login throttling
+		policy := pc.LoginGuard.RateLimiter.Config.PasswordLogin
+		if err := pc.LoginGuard.Allow(ctx, policy, user.Email); err != nil {
+			return pkg.SendRateLimited(ctx, err)
+		}
+
+		match, err := pc.checkPassword(ctx, user, p.Password)
 		if err != nil {
-			return pkg.SendError(ctx, errors.New("Failed to get session data."), http.StatusInternalServerError)
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		sessionID := cookie.Value
-		pc.UserSession.Delete(ctx, sessionID)
+		if !match {
+			pc.LoginGuard.Fail(ctx, policy, user.Email)
+			return pkg.SendError(ctx, errors.New("Invalid password."), http.StatusUnauthorized)
+		}
+		pc.LoginGuard.Succeed(ctx, policy, user.Email)
 
+		if err := pc.UserSession.MarkVerified(ctx, session, pkg.AuthMethodPassword); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
 		return pkg.SendOK(ctx)
 	}
 }
 
-func (pc PasswordController) DeleteAccount() echo.HandlerFunc {
+func (pc PasswordController) Logout() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		cookie, err := ctx.Cookie("auth")
 		if err != nil {
-			return pkg.SendError(ctx, errors.New("Failed to get session data."), http.StatusInternalServerError)
+			return pkg.SendError(ctx, errors.New("Not logged in."), http.StatusUnauthorized)
 		}
+
 		sessionID := cookie.Value
 		pc.UserSession.Delete(ctx, sessionID)
 
+		return pkg.SendOK(ctx)
+	}
+}
+
+func (pc PasswordController) DeleteAccount() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
 		user := concerns.CurrentUser(ctx, pc.UserRepository)
 		if user == nil {
 			return pkg.SendError(ctx, errors.New("User not found"), http.StatusNotFound)
 		}
-		err = pc.UserRepository.DeleteUser(ctx.Request().Context(), user)
+		err := pc.UserRepository.DeleteUser(ctx.Request().Context(), user)
 		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
+
+		// sign out every browser of the deleted account, including this one
+		if err := pc.UserSession.RevokeAll(ctx.Request().Context(), user.ID); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		pc.UserSession.ClearCookie(ctx)
 		return pkg.SendOK(ctx)
 	}
 }
 
+// ChangePassword replaces the password of an account that has one. A session
+// alone is not enough, the user either enters the current password or has just
+// confirmed with a passkey.
 func (pc PasswordController) ChangePassword() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		var p struct {
-			Password string
+			CurrentPassword string `json:"currentPassword"`
+			Password        string `json:"password"`
 		}
 		if err := ctx.Bind(&p); err != nil {
 			return pkg.SendError(ctx, err, http.StatusBadRequest)
 		}
 
 		user := concerns.CurrentUser(ctx, pc.UserRepository)
-		if user == nil {
+		session := concerns.CurrentSession(ctx)
+		if user == nil || session == nil {
 			return pkg.SendError(ctx, errors.New("User not found"), http.StatusNotFound)
 		}
 
-		if len(p.Password) < 8 {
-			return pkg.SendError(ctx, errors.New("Password must be at least 8 characters"), http.StatusBadRequest)
+		if !user.HasPassword {
+			return pkg.SendErrorCode(ctx, errors.New("This account has no password yet, please set one instead."), http.StatusConflict, pkg.ErrorCodeNoPassword)
 		}
-		
-		passwordHash, err := argon2id.CreateHash(p.Password, argon2id.DefaultParams)
-		if err != nil {
-			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+
+		if p.CurrentPassword == "" {
+			if !pc.recentPasskey(session) {
+				return pkg.SendErrorCode(ctx, errors.New("Please enter your current password or confirm with a passkey."), http.StatusForbidden, pkg.ErrorCodeCurrentPasswordRequired)
+			}
+		} else {
+			// a stolen session must not be a way around the login throttling
+			policy := pc.LoginGuard.RateLimiter.Config.PasswordLogin
+			if err := pc.LoginGuard.Allow(ctx, policy, user.Email); err != nil {
+				return pkg.SendRateLimited(ctx, err)
+			}
+			match, err := pc.checkPassword(ctx, user, p.CurrentPassword)
+			if err != nil {
+				return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			}
+			if !match {
+				pc.LoginGuard.Fail(ctx, policy, user.Email)
+				return pkg.SendError(ctx, errors.New("Current password is incorrect."), http.StatusUnauthorized)
+			}
+			pc.LoginGuard.Succeed(ctx, policy, user.Email)
 		}
 
-		user.PasswordHash = passwordHash
-		err = pc.UserRepository.UpdateUser(ctx.Request().Context(), user)
-		if err != nil {
-			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		return pc.setPassword(ctx, user, session, p.Password)
+	}
+}
+
+// SetPassword gives an account without a usable password, e.g. one that signed
+// up with a passkey, its first password. Besides RequireRecentAuth it needs
+// the recent verification to be a passkey, as there is no current password
+// to confirm the change with.
+func (pc PasswordController) SetPassword() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p struct {
+			Password string `json:"password"`
 		}
-		return pkg.SendOK(ctx)
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		user := concerns.CurrentUser(ctx, pc.UserRepository)
+		session := concerns.CurrentSession(ctx)
+		if user == nil || session == nil {
+			return pkg.SendError(ctx, errors.New("User not found"), http.StatusNotFound)
+		}
+
+		if user.HasPassword {
+			return pkg.SendErrorCode(ctx, errors.New("This account already has a password, please change it instead."), http.StatusConflict, pkg.ErrorCodeHasPassword)
+		}
+
+		if !pc.recentPasskey(session) {
+			return pkg.SendErrorCode(ctx, errors.New("Please confirm with a passkey first."), http.StatusForbidden, pkg.ErrorCodePasskeyRequired)
+		}
+
+		return pc.setPassword(ctx, user, session, p.Password)
+	}
+}
+
+// recentPasskey reports whether the user confirmed with a passkey within the
+// re-authentication window, which stands in for the current password
+func (pc PasswordController) recentPasskey(session *pkg.Session) bool {
+	return session.VerifiedMethod == pkg.AuthMethodPasskey && session.RecentlyVerified(pc.UserSession.Config.ReauthMaxAge)
+}
+
+func (pc PasswordController) setPassword(ctx echo.Context, user *model.User, session *pkg.Session, password string) error {
+	if err := pc.PasswordSetter.Check(ctx.Request().Context(), user.Email, password, user); err != nil {
+		return pkg.SendError(ctx, err, pkg.PasswordErrorStatus(err))
+	}
+
+	if err := pc.PasswordSetter.Set(ctx.Request().Context(), user, password); err != nil {
+		return pkg.SendError(ctx, err, http.StatusInternalServerError)
+	}
+
+	// a changed password must lock out anyone still holding an old session
+	if err := pc.UserSession.RevokeOthers(ctx.Request().Context(), user.ID, session.Token()); err != nil {
+		return pkg.SendError(ctx, err, http.StatusInternalServerError)
+	}
+	if err := pc.UserSession.Rotate(ctx, session); err != nil {
+		return pkg.SendError(ctx, err, http.StatusInternalServerError)
 	}
+	return pkg.SendOK(ctx)
 }
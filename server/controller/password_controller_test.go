@@ -6,43 +6,75 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"net/http/httptest"
 
 	"github.com/alexedwards/argon2id"
-	"github.com/alicebob/miniredis/v2"
 	"github.com/baala3/passkeys/db"
 	"github.com/baala3/passkeys/model"
 	"github.com/baala3/passkeys/pkg"
 	"github.com/baala3/passkeys/repository"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/uptrace/bun"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	database *bun.DB
 	e *echo.Echo
-	miniRedis *miniredis.Miniredis
 	userRepository repository.UserRepository
 	userSession pkg.UserSession
+	mailer = &recordingMailer{}
+	emailVerifier EmailVerifier
+	loginGuard LoginGuard
+	passwordSetter PasswordSetter
 	passwordController *PasswordController
+	webAuthnSession pkg.WebAuthnSession
 )
 
 func setup() {
 	database = db.GetTestDB()
 	e = echo.New()
-	miniRedis = miniredis.NewMiniRedis()
-	err := miniRedis.StartAddr(":16379")
-	if err != nil {
-		panic(err)
-	}
 	userRepository = repository.UserRepository{DB: database}
-	userSession = pkg.UserSession{RedisClient: pkg.GetRedisClient()}
+	userSession = pkg.UserSession{Store: pkg.NewMemoryStore(), Config: pkg.NewSessionConfig()}
+	webAuthnSession = pkg.WebAuthnSession{Store: pkg.NewMemoryStore(), Config: pkg.NewSessionConfig()}
+	emailVerifier = EmailVerifier{
+		TokenRepository: repository.TokenRepository{DB: database},
+		Mailer: mailer,
+	}
+	// every test request comes from the same IP, the limit is only lowered where it is tested
+	rateLimitConfig := pkg.NewRateLimitConfig()
+	rateLimitConfig.PasswordLogin.IPLimit = 1000
+	rateLimitConfig.PasskeyLogin.IPLimit = 1000
+	rateLimitConfig.TOTPLogin.IPLimit = 1000
+	rateLimitConfig.RecoveryLogin.IPLimit = 1000
+	rateLimitConfig.PasswordReset.IPLimit = 1000
+	rateLimitConfig.MagicLink.IPLimit = 1000
+	loginGuard = LoginGuard{
+		RateLimiter: pkg.RateLimiter{Store: pkg.NewMemoryStore(), Config: rateLimitConfig},
+		UserRepository: userRepository,
+		TokenRepository: repository.TokenRepository{DB: database},
+		Mailer: mailer,
+		Signer: pkg.Signer{Secret: []byte("secret")},
+		Background: pkg.NewBackground(),
+	}
+	passwordSetter = PasswordSetter{
+		PasswordPolicy: pkg.NewPasswordPolicy(),
+		UserRepository: userRepository,
+		PasswordHistoryRepository: repository.PasswordHistoryRepository{DB: database},
+	}
 	passwordController = &PasswordController{
 		UserRepository: userRepository,
 		UserSession: userSession,
+		EmailVerifier: emailVerifier,
+		TOTPRepository: repository.TOTPRepository{DB: database},
+		LoginGuard: loginGuard,
+		PasswordSetter: passwordSetter,
+		WebAuthnSession: webAuthnSession,
 	}
 	loadFixtures()
 }
@@ -57,6 +89,7 @@ func loadFixtures() {
 		ID: uuid.New(),
 		Email: "existing@email.com",
 		PasswordHash: passwordHash,
+		HasPassword: true,
 	}).Exec(context.Background())
 	if err != nil {
 		panic(err)
@@ -64,10 +97,21 @@ func loadFixtures() {
 }
 
 func teardown() {
-	miniRedis.Close()
+	for _, store := range []pkg.SessionStore{userSession.Store, webAuthnSession.Store, loginGuard.RateLimiter.Store} {
+		_ = store.(*pkg.MemoryStore).Close()
+	}
 	_ =database.Close()
 }
 
+// memoryStore returns a MemoryStore that is closed when the test ends
+func memoryStore(t *testing.T) *pkg.MemoryStore {
+	store := pkg.NewMemoryStore()
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
+
 func TestMain(m *testing.M) {
 	setup()
 	code := m.Run()
@@ -109,6 +153,20 @@ func TestPasswordController_SignUp(t *testing.T) {
 		assert.JSONEq(t, `{"status": "error", "errorMessage":"An account with that email already exists."}`, rec.Body.String())
 	})
 
+	t.Run("account exists in another case", func(t *testing.T) {
+		req := httptest.NewRequest(echo.POST, "/signup", strings.NewReader(`{"email":"Existing@Email.com", "password":"password123"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		ctx := e.NewContext(req, rec)
+
+		assert.NoError(t, passwordController.SignUp()(ctx))
+		assert.Equal(t, http.StatusConflict, rec.Code)
+
+		// the unique index catches a signup that raced the check
+		_, err := userRepository.CreateUser(context.Background(), "EXISTING@email.com", "hash", true)
+		assert.ErrorIs(t, err, repository.ErrEmailTaken)
+	})
+
 	t.Run("successful sign up", func(t *testing.T) {
 		req := httptest.NewRequest(echo.POST, "/signup", strings.NewReader(`{"email":"new@email.com", "password":"password123"}`))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
@@ -129,11 +187,16 @@ func TestPasswordController_SignUp(t *testing.T) {
 		// Creates a session
 		cookie := rec.Result().Cookies()[0]
 		assert.Equal(t, "auth", cookie.Name)
-		value, err := miniRedis.Get(cookie.Value)
+		session, err := userSession.Get(ctx.Request().Context(), cookie.Value)
 		if err != nil {
 			t.Error(err)
 		}
-		assert.Equal(t, user.ID.String(), value)
+		assert.Equal(t, user.ID, session.UserID)
+		assert.Equal(t, pkg.AuthMethodPassword, session.AuthMethod)
+
+		// Asks to verify the email
+		assert.Nil(t, user.EmailVerifiedAt)
+		assert.Equal(t, "new@email.com", mailer.last().To)
 	})
 }
 
@@ -184,7 +247,10 @@ func TestPasswordController_Login(t *testing.T) {
 		// Creates a session
 		cookie := rec.Result().Cookies()[0]
 		assert.Equal(t, "auth", cookie.Name)
-		value, err := miniRedis.Get(cookie.Value)
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+		assert.False(t, cookie.Expires.IsZero())
+		session, err := userSession.Get(ctx.Request().Context(), cookie.Value)
 		if err != nil {
 			t.Error(err)
 		}
@@ -192,7 +258,138 @@ func TestPasswordController_Login(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
-		assert.Equal(t, user.ID.String(), value)
+		assert.Equal(t, user.ID, session.UserID)
+	})
+
+	t.Run("discards the passkey autofill", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		data := &webauthn.SessionData{Challenge: "challenge", Expires: time.Now().Add(time.Hour)}
+		if err := webAuthnSession.CreateReusable(e.NewContext(httptest.NewRequest(echo.POST, "/conditional_login/begin", nil), rec), pkg.CeremonyConditionalLogin, data, data); err != nil {
+			t.Fatal(err)
+		}
+		conditional := rec.Result().Cookies()[0]
+		passwordLogin := func(password string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(echo.POST, "/login", strings.NewReader(`{"email":"existing@email.com", "password":"`+password+`"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.AddCookie(conditional)
+			rec := httptest.NewRecorder()
+			assert.NoError(t, passwordController.Login()(e.NewContext(req, rec)))
+			return rec
+		}
+		autofillPending := func() bool {
+			req := httptest.NewRequest(echo.POST, "/conditional_login/begin", nil)
+			req.AddCookie(conditional)
+			_, err := webAuthnSession.GetOptions(e.NewContext(req, httptest.NewRecorder()), pkg.CeremonyConditionalLogin)
+			return err == nil
+		}
+
+		// a mistyped password leaves the autofill usable
+		assert.Equal(t, http.StatusUnauthorized, passwordLogin("wrongPassword").Code)
+		assert.True(t, autofillPending())
+
+		rec = passwordLogin("password123")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.False(t, autofillPending())
+		var cleared bool
+		for _, cookie := range rec.Result().Cookies() {
+			cleared = cleared || (cookie.Name == pkg.CeremonyConditionalLogin && cookie.MaxAge < 0)
+		}
+		assert.True(t, cleared)
+	})
+}
+
+func TestPasswordController_LoginUpgradesHash(t *testing.T) {
+	legacyHash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakHash, err := argon2id.CreateHash("password123", &argon2id.Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for email, hash := range map[string]string{"bcrypt@email.com": string(legacyHash), "weak@email.com": weakHash} {
+		t.Run(email, func(t *testing.T) {
+			if _, err := userRepository.CreateUser(context.Background(), email, hash, true); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(echo.POST, "/login", strings.NewReader(`{"email":"`+email+`", "password":"password123"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			assert.NoError(t, passwordController.Login()(e.NewContext(req, rec)))
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			user, err := userRepository.FindUserByEmail(context.Background(), email)
+			assert.NoError(t, err)
+			match, needsRehash, err := passwordController.PasswordHasher.Verify("password123", user.PasswordHash)
+			assert.NoError(t, err)
+			assert.True(t, match)
+			assert.False(t, needsRehash)
+		})
+	}
+}
+
+func TestPasswordController_LoginMarksPasswordUsable(t *testing.T) {
+	// a password account that added a passkey before the has_password migration
+	passwordHash, err := argon2id.CreateHash("password123", argon2id.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := userRepository.CreateUser(context.Background(), "migrated@email.com", passwordHash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(echo.POST, "/login", strings.NewReader(`{"email":"migrated@email.com", "password":"password123"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, passwordController.Login()(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	user, err = userRepository.FindUserByEmail(context.Background(), "migrated@email.com")
+	assert.NoError(t, err)
+	assert.True(t, user.HasPassword)
+}
+
+func TestPasswordController_AntiEnumeration(t *testing.T) {
+	controller := *passwordController
+	controller.AntiEnumeration = pkg.AntiEnumeration{Enabled: true}
+
+	post := func(t *testing.T, handler echo.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handler(e.NewContext(req, rec)))
+		return rec
+	}
+
+	t.Run("login", func(t *testing.T) {
+		unknown := post(t, controller.Login(), `{"email":"nobody@email.com", "password":"password123"}`)
+		wrong := post(t, controller.Login(), `{"email":"existing@email.com", "password":"wrongPassword"}`)
+
+		assert.Equal(t, http.StatusUnauthorized, unknown.Code)
+		assert.Equal(t, wrong.Code, unknown.Code)
+		assert.Equal(t, wrong.Body.String(), unknown.Body.String())
+	})
+
+	t.Run("signup", func(t *testing.T) {
+		taken := post(t, controller.SignUp(), `{"email":"existing@email.com", "password":"password123"}`)
+		assert.Equal(t, "existing@email.com", mailer.last().To)
+		assert.Contains(t, mailer.last().Body, "already has an account")
+
+		created := post(t, controller.SignUp(), `{"email":"anonymous@email.com", "password":"password123"}`)
+		assert.Equal(t, "anonymous@email.com", mailer.last().To)
+
+		assert.Equal(t, http.StatusOK, taken.Code)
+		assert.JSONEq(t, `{"status":"ok","errorMessage":"","code":"check_email"}`, taken.Body.String())
+		assert.Equal(t, taken.Body.String(), created.Body.String())
+		// neither signs in
+		assert.Empty(t, taken.Result().Cookies())
+		assert.Empty(t, created.Result().Cookies())
+
+		_, err := userRepository.FindUserByEmail(context.Background(), "anonymous@email.com")
+		assert.NoError(t, err)
 	})
 }
 
@@ -224,7 +421,233 @@ func TestPasswordController_Logout(t *testing.T) {
 		assert.JSONEq(t, `{"status": "ok", "errorMessage":""}`, rec.Body.String())
 
 		// It removes session information from the session store
-		_, err := miniRedis.Get(cookie.Value)
-		assert.Error(t, err)
+		_, err := userSession.Get(ctx.Request().Context(), cookie.Value)
+		assert.ErrorIs(t, err, pkg.ErrSessionNotFound)
+	})
+}
+
+func TestPasswordController_ChangePassword(t *testing.T) {
+	changePassword := func(t *testing.T, cookie *http.Cookie, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/change_password", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, passwordController.ChangePassword()(authenticatedContext(t, req, rec, cookie)))
+		return rec
+	}
+	// the other tests sign in with the fixture password
+	t.Cleanup(func() {
+		user, err := userRepository.FindUserByEmail(context.Background(), "existing@email.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.PasswordHash, err = argon2id.CreateHash("password123", argon2id.DefaultParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := userRepository.UpdateUser(context.Background(), user); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a session alone is not enough", func(t *testing.T) {
+		// signing in with the password just now does not count either
+		rec := changePassword(t, login(t, "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)"), `{"password":"changed-password"}`)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Please enter your current password or confirm with a passkey.", "code":"current_password_required"}`, rec.Body.String())
+	})
+
+	t.Run("incorrect current password", func(t *testing.T) {
+		rec := changePassword(t, login(t, "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)"), `{"currentPassword":"wrong-password","password":"changed-password"}`)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Current password is incorrect."}`, rec.Body.String())
+	})
+
+	t.Run("rejects the current password", func(t *testing.T) {
+		rec := changePassword(t, login(t, "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)"), `{"currentPassword":"password123","password":"password123"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Please choose a password you have not used recently"}`, rec.Body.String())
+	})
+
+	t.Run("rejects the email address", func(t *testing.T) {
+		rec := changePassword(t, login(t, "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)"), `{"currentPassword":"password123","password":"Existing@Email.com"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Password must not be your email address"}`, rec.Body.String())
+	})
+
+	t.Run("revokes other sessions", func(t *testing.T) {
+		current := login(t, "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)")
+		other := login(t, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)")
+
+		req := httptest.NewRequest(echo.POST, "/change_password", strings.NewReader(`{"currentPassword":"password123","password":"changed-password"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, req, rec, current)
+
+		assert.NoError(t, passwordController.ChangePassword()(ctx))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		_, err := userSession.Get(ctx.Request().Context(), other.Value)
+		assert.ErrorIs(t, err, pkg.ErrSessionNotFound)
+
+		// the current session survives under a rotated token
+		_, err = userSession.Get(ctx.Request().Context(), current.Value)
+		assert.ErrorIs(t, err, pkg.ErrSessionNotFound)
+		rotated := rec.Result().Cookies()[0]
+		assert.NotEqual(t, current.Value, rotated.Value)
+		_, err = userSession.Get(ctx.Request().Context(), rotated.Value)
+		assert.NoError(t, err)
+
+		// the replaced password is remembered
+		rec = changePassword(t, rotated, `{"currentPassword":"changed-password","password":"password123"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Please choose a password you have not used recently"}`, rec.Body.String())
+	})
+
+	t.Run("a fresh passkey confirmation replaces the current password", func(t *testing.T) {
+		req := httptest.NewRequest(echo.POST, "/change_password", strings.NewReader(`{"password":"passkey-confirmed"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		passwordHash, err := argon2id.CreateHash("password123", argon2id.DefaultParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := userRepository.CreateUser(context.Background(), "confirmed@email.com", passwordHash, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookie := passkeyConfirmed(t, user.Email)
+
+		assert.NoError(t, passwordController.ChangePassword()(authenticatedContext(t, req, rec, cookie)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("accounts without a password set one instead", func(t *testing.T) {
+		user, err := userRepository.CreateUser(context.Background(), "without-password@email.com", "random", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookie := passkeyConfirmed(t, user.Email)
+
+		rec := changePassword(t, cookie, `{"password":"first-password"}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"This account has no password yet, please set one instead.", "code":"no_password"}`, rec.Body.String())
+	})
+}
+
+func TestPasswordController_SetPassword(t *testing.T) {
+	setPassword := func(t *testing.T, cookie *http.Cookie, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/set_password", strings.NewReader(`{"password":"`+password+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, passwordController.SetPassword()(authenticatedContext(t, req, rec, cookie)))
+		return rec
+	}
+	user, err := userRepository.CreateUser(context.Background(), "no-password@email.com", "random", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := passkeyConfirmed(t, user.Email)
+
+	t.Run("needs a passkey confirmation", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		if err := userSession.Create(e.NewContext(httptest.NewRequest(echo.POST, "/login/totp", nil), rec), user.ID, pkg.AuthMethodTOTP); err != nil {
+			t.Fatal(err)
+		}
+
+		rec = setPassword(t, rec.Result().Cookies()[0], "first-password")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Please confirm with a passkey first.", "code":"passkey_required"}`, rec.Body.String())
+	})
+
+	t.Run("applies the password policy", func(t *testing.T) {
+		rec := setPassword(t, cookie, "short")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("sets the first password", func(t *testing.T) {
+		rec := setPassword(t, cookie, "first-password")
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		updated, err := userRepository.FindUserByEmail(context.Background(), user.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, updated.HasPassword)
+		match, _ := argon2id.ComparePasswordAndHash("first-password", updated.PasswordHash)
+		assert.True(t, match)
+
+		// from now on it has to be changed with the current one
+		rec = setPassword(t, rec.Result().Cookies()[0], "second-password")
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"This account already has a password, please change it instead.", "code":"has_password"}`, rec.Body.String())
+	})
+}
+
+// passkeyConfirmed returns the auth cookie of a session that just signed in with a passkey
+func passkeyConfirmed(t *testing.T, email string) *http.Cookie {
+	user, err := userRepository.FindUserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := userSession.Create(e.NewContext(httptest.NewRequest(echo.POST, "/login/finish", nil), rec), user.ID, pkg.AuthMethodPasskey); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()[0]
+}
+
+func TestPasswordController_Reauthenticate(t *testing.T) {
+	cookie := login(t, "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)")
+	session, err := userSession.Get(context.Background(), cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pretend the sign in happened a while ago
+	session.VerifiedAt = time.Now().Add(-time.Hour)
+	assert.False(t, session.RecentlyVerified(userSession.Config.ReauthMaxAge))
+
+	reauthenticate := func(t *testing.T, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/reauth/password", strings.NewReader(`{"password":"`+password+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, req, rec, cookie)
+		ctx.Set("session", session)
+
+		assert.NoError(t, passwordController.Reauthenticate()(ctx))
+		return rec
+	}
+
+	t.Run("incorrect password", func(t *testing.T) {
+		rec := reauthenticate(t, "wrong-password")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Invalid password."}`, rec.Body.String())
+	})
+
+	t.Run("successful reauthentication", func(t *testing.T) {
+		rec := reauthenticate(t, "password123")
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rotated, err := userSession.Get(context.Background(), rec.Result().Cookies()[0].Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, rotated.RecentlyVerified(userSession.Config.ReauthMaxAge))
+		assert.Equal(t, pkg.AuthMethodPassword, rotated.VerifiedMethod)
+		cookie = rec.Result().Cookies()[0]
+		session = rotated
+	})
+
+	t.Run("wrong passwords are throttled like the login", func(t *testing.T) {
+		policy := loginGuard.RateLimiter.Config.PasswordLogin
+		defer func() {
+			assert.NoError(t, loginGuard.RateLimiter.Reset(context.Background(), policy, "existing@email.com"))
+		}()
+
+		for range policy.FreeFailures + 1 {
+			assert.Equal(t, http.StatusUnauthorized, reauthenticate(t, "wrong-password").Code)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, reauthenticate(t, "password123").Code)
 	})
 }
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+)
+
+const passwordResetTTL = time.Hour
+
+type PasswordResetController struct {
+	UserRepository  repository.UserRepository
+	TokenRepository repository.TokenRepository
+	UserSession     pkg.UserSession
+	Mailer          pkg.Mailer
+	LoginGuard      LoginGuard
+	PasswordSetter  PasswordSetter
+	Background      pkg.Background
+}
+
+// ForgotPassword emails a reset link. The response is the same whether or not
+// an account exists, so it cannot be used to find out who is registered: the
+// email is sent in the background and the address is throttled either way.
+func (pc PasswordResetController) ForgotPassword() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p pkg.Params
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		if !pkg.IsValidEmail(p.Email) {
+			return pkg.SendError(ctx, errors.New("Invalid email"), http.StatusBadRequest)
+		}
+
+		if err := pc.LoginGuard.Throttle(ctx, pc.LoginGuard.RateLimiter.Config.PasswordReset, p.Email); err != nil {
+			return pkg.SendRateLimited(ctx, err)
+		}
+
+		user, err := pc.UserRepository.FindUserByEmail(ctx.Request().Context(), p.Email)
+		if err != nil {
+			return pkg.SendOK(ctx)
+		}
+
+		pc.Background.Go(ctx, "send password reset", func(ctx context.Context) error {
+			return pc.sendResetLink(ctx, user)
+		})
+		return pkg.SendOK(ctx)
+	}
+}
+
+// ResetPassword sets a new password with a token from a reset link and signs
+// out every session of the account
+func (pc PasswordResetController) ResetPassword() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p struct {
+			Token    string
+			Password string
+		}
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		// the link stays valid until a password the policy accepts was chosen
+		token, err := pc.TokenRepository.FindToken(ctx.Request().Context(), model.TokenPurposePasswordReset, p.Token)
+		if errors.Is(err, repository.ErrTokenInvalid) {
+			return pkg.SendError(ctx, errors.New("This reset link is invalid or has expired."), http.StatusBadRequest)
+		}
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+
+		user, err := pc.UserRepository.FindUserById(ctx.Request().Context(), token.UserID[:])
+		if err != nil {
+			return pkg.SendError(ctx, errors.New("This reset link is invalid or has expired."), http.StatusBadRequest)
+		}
+
+		if err := pc.PasswordSetter.Check(ctx.Request().Context(), user.Email, p.Password, user); err != nil {
+			return pkg.SendError(ctx, err, pkg.PasswordErrorStatus(err))
+		}
+
+		_, err = pc.TokenRepository.ConsumeToken(ctx.Request().Context(), model.TokenPurposePasswordReset, p.Token)
+		if errors.Is(err, repository.ErrTokenInvalid) {
+			return pkg.SendError(ctx, errors.New("This reset link is invalid or has expired."), http.StatusBadRequest)
+		}
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+
+		if err := pc.PasswordSetter.Set(ctx.Request().Context(), user, p.Password); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+
+		// other links sent before are no longer needed
+		if err := pc.TokenRepository.DeleteTokens(ctx.Request().Context(), user.ID, model.TokenPurposePasswordReset); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		if err := pc.UserSession.RevokeAll(ctx.Request().Context(), user.ID); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		// the link proves ownership like the unlock link does
+		pc.LoginGuard.UnlockAccount(ctx, user.Email)
+		return pkg.SendOK(ctx)
+	}
+}
+
+func (pc PasswordResetController) sendResetLink(ctx context.Context, user *model.User) error {
+	token, err := pc.TokenRepository.CreateToken(ctx, user.ID, model.TokenPurposePasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("RP_ORIGIN") + "/reset_password?token=" + url.QueryEscape(token)
+	return pc.Mailer.Send(ctx, pkg.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your account.\n\n"+
+			"Open the link below within %s to choose a new password:\n%s\n\n"+
+			"If this was not you, you can ignore this email.", passwordResetTTL, link),
+	})
+}
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMailer keeps sent messages instead of delivering them
+type recordingMailer struct {
+	mu       sync.Mutex
+	messages []pkg.Message
+}
+
+func (m *recordingMailer) Send(ctx context.Context, message pkg.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func (m *recordingMailer) last() pkg.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.messages[len(m.messages)-1]
+}
+
+// linkToken extracts the token of the link in the message
+func linkToken(t *testing.T, message pkg.Message) string {
+	link := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(message.Body)
+	if link == nil {
+		t.Fatalf("no link in %q", message.Body)
+	}
+	token, err := url.QueryUnescape(link[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestPasswordResetController(t *testing.T) {
+	mailer := &recordingMailer{}
+	passwordResetController := &PasswordResetController{
+		UserRepository: userRepository,
+		TokenRepository: repository.TokenRepository{DB: database},
+		UserSession: userSession,
+		Mailer: mailer,
+		LoginGuard: loginGuard,
+		PasswordSetter: passwordSetter,
+		Background: pkg.NewBackground(),
+	}
+	user, err := userRepository.CreateUser(context.Background(), "forgetful@email.com", "hash", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgot := func(t *testing.T, email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/password/forgot", strings.NewReader(`{"email":"`+email+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, passwordResetController.ForgotPassword()(e.NewContext(req, rec)))
+		passwordResetController.Background.Wait()
+		return rec
+	}
+	reset := func(t *testing.T, token string, password string) *httptest.ResponseRecorder {
+		body := `{"token":"` + token + `","password":"` + password + `"}`
+		req := httptest.NewRequest(echo.POST, "/password/reset", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, passwordResetController.ResetPassword()(e.NewContext(req, rec)))
+		return rec
+	}
+
+	t.Run("unknown email gets the same response", func(t *testing.T) {
+		unknown := forgot(t, "unknown@email.com")
+		known := forgot(t, user.Email)
+
+		assert.Equal(t, http.StatusOK, unknown.Code)
+		assert.Equal(t, known.Code, unknown.Code)
+		assert.Equal(t, known.Body.String(), unknown.Body.String())
+		assert.Len(t, mailer.messages, 1)
+		assert.Equal(t, user.Email, mailer.messages[0].To)
+	})
+
+	t.Run("addresses are throttled whether or not they have an account", func(t *testing.T) {
+		// the account got its first email above
+		for email, sent := range map[string]int{"throttled@email.com": 0, user.Email: 1} {
+			for range 3 - sent {
+				assert.Equal(t, http.StatusOK, forgot(t, email).Code)
+			}
+			assert.Equal(t, http.StatusTooManyRequests, forgot(t, email).Code)
+		}
+		// the reset below uses the first link
+		mailer.messages = mailer.messages[:1]
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		rec := reset(t, "invalid", "new-password")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"This reset link is invalid or has expired."}`, rec.Body.String())
+	})
+
+	t.Run("password rejected by the policy keeps the link valid", func(t *testing.T) {
+		rec := reset(t, linkToken(t, mailer.messages[0]), "short")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Password must be at least 8 characters"}`, rec.Body.String())
+	})
+
+	t.Run("successful reset", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		if err := userSession.Create(e.NewContext(httptest.NewRequest(echo.POST, "/login", nil), recorder), user.ID, pkg.AuthMethodPassword); err != nil {
+			t.Fatal(err)
+		}
+		oldSession := recorder.Result().Cookies()[0]
+
+		token := linkToken(t, mailer.messages[0])
+
+		rec := reset(t, token, "new-password")
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		updated, err := userRepository.FindUserByEmail(context.Background(), user.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		match, _ := argon2id.ComparePasswordAndHash("new-password", updated.PasswordHash)
+		assert.True(t, match)
+
+		// signs out everywhere
+		_, err = userSession.Get(context.Background(), oldSession.Value)
+		assert.ErrorIs(t, err, pkg.ErrSessionNotFound)
+
+		// the link only works once
+		rec = reset(t, token, "another-password")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+)
+
+var errPasswordReused = &pkg.PasswordPolicyError{Message: "Please choose a password you have not used recently"}
+
+// PasswordSetter is the one place new passwords go through. It applies the
+// password policy and keeps the replaced hashes for its reuse rule.
+type PasswordSetter struct {
+	PasswordPolicy            pkg.PasswordPolicy
+	PasswordHasher            pkg.PasswordHasher
+	UserRepository            repository.UserRepository
+	PasswordHistoryRepository repository.PasswordHistoryRepository
+}
+
+// Check validates a new password. The user is nil for signups, which have no
+// history yet. Rejections are *pkg.PasswordPolicyError, see pkg.PasswordErrorStatus.
+func (ps PasswordSetter) Check(ctx context.Context, email string, password string, user *model.User) error {
+	if err := ps.PasswordPolicy.Check(password, email); err != nil {
+		return err
+	}
+	if user == nil || ps.PasswordPolicy.HistorySize <= 0 {
+		return nil
+	}
+
+	var previous []string
+	// passkey only accounts have a random hash that nobody knows the password of
+	if user.HasPassword {
+		previous = append(previous, user.PasswordHash)
+	}
+	if kept := ps.PasswordPolicy.HistorySize - 1; kept > 0 {
+		hashes, err := ps.PasswordHistoryRepository.Recent(ctx, user.ID, kept)
+		if err != nil {
+			return err
+		}
+		previous = append(previous, hashes...)
+	}
+	for _, hash := range previous {
+		// a hash that cannot be parsed cannot match either, and resetting is
+		// the way out of it
+		if match, _, err := ps.PasswordHasher.Verify(password, hash); err == nil && match {
+			return errPasswordReused
+		}
+	}
+	return nil
+}
+
+// Set saves a password that passed Check and keeps the replaced one in the history
+func (ps PasswordSetter) Set(ctx context.Context, user *model.User, password string) error {
+	passwordHash, err := ps.PasswordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	if kept := ps.PasswordPolicy.HistorySize - 1; user.HasPassword && kept > 0 {
+		if err := ps.PasswordHistoryRepository.Add(ctx, user.ID, user.PasswordHash, kept); err != nil {
+			return err
+		}
+	}
+
+	user.PasswordHash = passwordHash
+	user.HasPassword = true
+	return ps.UserRepository.UpdateUser(ctx, user)
+}
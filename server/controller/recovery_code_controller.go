@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/baala3/passkeys/concerns"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+)
+
+var errInvalidRecoveryLogin = errors.New("Invalid email or recovery code.")
+
+type RecoveryCodeController struct {
+	UserRepository         repository.UserRepository
+	RecoveryCodeRepository repository.RecoveryCodeRepository
+	UserSession            pkg.UserSession
+	LoginGuard             LoginGuard
+}
+
+// GetStatus tells how many codes are left. The codes themselves are only shown by Regenerate.
+func (rc RecoveryCodeController) GetStatus() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user := concerns.CurrentUser(ctx, rc.UserRepository)
+		if user == nil {
+			return pkg.SendError(ctx, errors.New("user not found"), http.StatusUnauthorized)
+		}
+
+		remaining, err := rc.RecoveryCodeRepository.CountUnused(ctx.Request().Context(), user.ID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return ctx.JSON(http.StatusOK, map[string]int{"remaining": remaining})
+	}
+}
+
+// Regenerate replaces all recovery codes and returns the new ones, once
+func (rc RecoveryCodeController) Regenerate() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user := concerns.CurrentUser(ctx, rc.UserRepository)
+		if user == nil {
+			return pkg.SendError(ctx, errors.New("user not found"), http.StatusUnauthorized)
+		}
+
+		codes, err := rc.RecoveryCodeRepository.Regenerate(ctx.Request().Context(), user.ID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return ctx.JSON(http.StatusOK, map[string][]string{"codes": codes})
+	}
+}
+
+// Login consumes a recovery code. The session it creates can only be used to
+// register a new passkey.
+func (rc RecoveryCodeController) Login() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p struct {
+			Email string
+			Code  string
+		}
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		policy := rc.LoginGuard.RateLimiter.Config.RecoveryLogin
+		if err := rc.LoginGuard.Allow(ctx, policy, p.Email); err != nil {
+			return pkg.SendRateLimited(ctx, err)
+		}
+
+		user, err := rc.UserRepository.FindUserByEmail(ctx.Request().Context(), p.Email)
+		if err != nil {
+			rc.LoginGuard.Fail(ctx, policy, p.Email)
+			return pkg.SendError(ctx, errInvalidRecoveryLogin, http.StatusUnauthorized)
+		}
+
+		err = rc.RecoveryCodeRepository.Use(ctx.Request().Context(), user.ID, p.Code)
+		if errors.Is(err, repository.ErrRecoveryCodeInvalid) {
+			rc.LoginGuard.Fail(ctx, policy, user.Email)
+			return pkg.SendError(ctx, errInvalidRecoveryLogin, http.StatusUnauthorized)
+		}
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		rc.LoginGuard.Succeed(ctx, policy, user.Email)
+
+		if err := rc.UserSession.Create(ctx, user.ID, pkg.AuthMethodRecoveryCode); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return pkg.SendOKCode(ctx, pkg.ErrorCodePasskeyRequired)
+	}
+}
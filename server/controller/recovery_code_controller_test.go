@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryCodeController(t *testing.T) {
+	hashParams := &argon2id.Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	recoveryCodeController := &RecoveryCodeController{
+		UserRepository:         userRepository,
+		RecoveryCodeRepository: repository.RecoveryCodeRepository{DB: database, PasswordHasher: pkg.PasswordHasher{Params: hashParams}},
+		UserSession:            userSession,
+		LoginGuard:             loginGuard,
+	}
+	passwordHash, err := argon2id.CreateHash("password123", argon2id.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userRepository.CreateUser(context.Background(), "recovery@email.com", passwordHash, true); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(echo.POST, "/login", strings.NewReader(`{"email":"recovery@email.com", "password":"password123"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, passwordController.Login()(e.NewContext(req, rec)))
+	cookie := rec.Result().Cookies()[0]
+
+	recoveryLogin := func(t *testing.T, email string, code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/login/recovery", strings.NewReader(`{"email":"`+email+`", "code":"`+code+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, recoveryCodeController.Login()(e.NewContext(req, rec)))
+		return rec
+	}
+
+	req = httptest.NewRequest(echo.POST, "/recovery_codes", nil)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, recoveryCodeController.Regenerate()(authenticatedContext(t, req, rec, cookie)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var generated map[string][]string
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &generated))
+	codes := generated["codes"]
+	assert.Len(t, codes, 10)
+
+	t.Run("codes are hashed like passwords", func(t *testing.T) {
+		var hashes []string
+		err := database.NewSelect().Model((*model.RecoveryCode)(nil)).Column("code_hash").Scan(context.Background(), &hashes)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, hashes)
+		for _, hash := range hashes {
+			assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=8192,t=1,p=1$"), hash)
+		}
+	})
+
+	t.Run("a code signs in once into a restricted session", func(t *testing.T) {
+		rec := recoveryLogin(t, "recovery@email.com", strings.ToUpper(codes[0]))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"status":"ok","errorMessage":"","code":"passkey_required"}`, rec.Body.String())
+
+		session, err := userSession.Get(context.Background(), rec.Result().Cookies()[0].Value)
+		assert.NoError(t, err)
+		assert.True(t, session.Restricted)
+		assert.True(t, session.LowAssurance)
+		assert.Equal(t, pkg.AuthMethodRecoveryCode, session.AuthMethod)
+
+		rec = recoveryLogin(t, "recovery@email.com", codes[0])
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("wrong code or email", func(t *testing.T) {
+		rec := recoveryLogin(t, "recovery@email.com", "aaaaa-aaaaa-aaaaa")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		unknown := recoveryLogin(t, "unknown@email.com", codes[1])
+		assert.Equal(t, http.StatusUnauthorized, unknown.Code)
+		assert.Equal(t, rec.Body.String(), unknown.Body.String())
+	})
+
+	t.Run("wrong codes are throttled", func(t *testing.T) {
+		throttled := *recoveryCodeController
+		throttled.LoginGuard.RateLimiter.Store = memoryStore(t)
+		throttled.LoginGuard.RateLimiter.Config.RecoveryLogin.FreeFailures = 0
+		login := func(code string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(echo.POST, "/login/recovery", strings.NewReader(`{"email":"recovery@email.com", "code":"`+code+`"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			assert.NoError(t, throttled.Login()(e.NewContext(req, rec)))
+			return rec
+		}
+
+		assert.Equal(t, http.StatusUnauthorized, login("aaaaa-aaaaa-aaaaa").Code)
+		// even the right code has to wait, without being used up
+		rec := login(codes[2])
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Contains(t, rec.Body.String(), pkg.ErrorCodeRateLimited)
+
+		rec = recoveryLogin(t, "recovery@email.com", codes[2])
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("remaining codes", func(t *testing.T) {
+		req := httptest.NewRequest(echo.GET, "/recovery_codes", nil)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, recoveryCodeController.GetStatus()(authenticatedContext(t, req, rec, cookie)))
+		assert.JSONEq(t, `{"remaining":8}`, rec.Body.String())
+	})
+
+	t.Run("regenerating invalidates the old codes", func(t *testing.T) {
+		req := httptest.NewRequest(echo.POST, "/recovery_codes", nil)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, recoveryCodeController.Regenerate()(authenticatedContext(t, req, rec, cookie)))
+
+		rec = recoveryLogin(t, "recovery@email.com", codes[1])
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/baala3/passkeys/concerns"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+type SessionController struct {
+	UserSession pkg.UserSession
+}
+
+type sessionResponse struct {
+	pkg.Session
+	Current bool `json:"current"`
+}
+
+func (sc *SessionController) GetSessions() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		current := concerns.CurrentSession(ctx)
+		if current == nil {
+			return pkg.SendError(ctx, errors.New("Not logged in."), http.StatusUnauthorized)
+		}
+
+		sessions, err := sc.UserSession.List(ctx.Request().Context(), current.UserID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+
+		response := make([]sessionResponse, len(sessions))
+		for i, session := range sessions {
+			response[i] = sessionResponse{
+				Session: session,
+				Current: session.ID == current.ID,
+			}
+		}
+		return ctx.JSON(http.StatusOK, response)
+	}
+}
+
+func (sc *SessionController) RevokeSession() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		current := concerns.CurrentSession(ctx)
+		if current == nil {
+			return pkg.SendError(ctx, errors.New("Not logged in."), http.StatusUnauthorized)
+		}
+
+		err := sc.UserSession.Revoke(ctx.Request().Context(), current.UserID, ctx.Param("id"))
+		if errors.Is(err, pkg.ErrSessionNotFound) {
+			return pkg.SendError(ctx, errors.New("Session not found."), http.StatusNotFound)
+		}
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return pkg.SendOK(ctx)
+	}
+}
+
+// RevokeOtherSessions signs the user out everywhere except the current browser
+func (sc *SessionController) RevokeOtherSessions() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		current := concerns.CurrentSession(ctx)
+		if current == nil {
+			return pkg.SendError(ctx, errors.New("Not logged in."), http.StatusUnauthorized)
+		}
+
+		if err := sc.UserSession.RevokeOthers(ctx.Request().Context(), current.UserID, current.Token()); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return pkg.SendOK(ctx)
+	}
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/baala3/passkeys/pkg"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func login(t *testing.T, userAgent string) *http.Cookie {
+	req := httptest.NewRequest(echo.POST, "/login", strings.NewReader(`{"email":"existing@email.com", "password":"password123"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", userAgent)
+	rec := httptest.NewRecorder()
+	ctx := e.NewContext(req, rec)
+
+	assert.NoError(t, passwordController.Login()(ctx))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	return rec.Result().Cookies()[0]
+}
+
+// authenticatedContext mimics middleware.Auth for the given auth cookie
+func authenticatedContext(t *testing.T, req *http.Request, rec *httptest.ResponseRecorder, cookie *http.Cookie) echo.Context {
+	req.AddCookie(cookie)
+	ctx := e.NewContext(req, rec)
+	session, err := userSession.Get(req.Context(), cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Set("userID", session.UserID.String())
+	ctx.Set("session", session)
+	return ctx
+}
+
+func TestSessionController_GetSessions(t *testing.T) {
+	sessionController := &SessionController{UserSession: userSession}
+	laptop := login(t, "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)")
+	phone := login(t, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)")
+
+	req := httptest.NewRequest(echo.GET, "/sessions", nil)
+	rec := httptest.NewRecorder()
+	ctx := authenticatedContext(t, req, rec, laptop)
+
+	assert.NoError(t, sessionController.GetSessions()(ctx))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var sessions []sessionResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sessions))
+
+	laptopSession, _ := userSession.Get(context.Background(), laptop.Value)
+	phoneSession, _ := userSession.Get(context.Background(), phone.Value)
+	current := map[string]bool{}
+	for _, session := range sessions {
+		current[session.ID] = session.Current
+		assert.Equal(t, pkg.AuthMethodPassword, session.AuthMethod)
+	}
+	assert.Equal(t, true, current[laptopSession.ID])
+	assert.Equal(t, false, current[phoneSession.ID])
+	assert.Equal(t, "Mac", laptopSession.Device)
+	assert.Equal(t, "iPhone", phoneSession.Device)
+	assert.NotContains(t, rec.Body.String(), laptop.Value)
+	assert.NotContains(t, rec.Body.String(), phone.Value)
+}
+
+func TestSessionController_RevokeSession(t *testing.T) {
+	sessionController := &SessionController{UserSession: userSession}
+	laptop := login(t, "Mozilla/5.0 (Windows NT 10.0; Win64; x64)")
+	phone := login(t, "Mozilla/5.0 (Linux; Android 14)")
+
+	t.Run("unknown session", func(t *testing.T) {
+		req := httptest.NewRequest(echo.DELETE, "/sessions/unknown", nil)
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, req, rec, laptop)
+		ctx.SetParamNames("id")
+		ctx.SetParamValues("unknown")
+
+		assert.NoError(t, sessionController.RevokeSession()(ctx))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Session not found."}`, rec.Body.String())
+	})
+
+	t.Run("successful revoke", func(t *testing.T) {
+		phoneSession, err := userSession.Get(context.Background(), phone.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(echo.DELETE, "/sessions/"+phoneSession.ID, nil)
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, req, rec, laptop)
+		ctx.SetParamNames("id")
+		ctx.SetParamValues(phoneSession.ID)
+
+		assert.NoError(t, sessionController.RevokeSession()(ctx))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		_, err = userSession.Get(ctx.Request().Context(), phone.Value)
+		assert.ErrorIs(t, err, pkg.ErrSessionNotFound)
+		_, err = userSession.Get(ctx.Request().Context(), laptop.Value)
+		assert.NoError(t, err)
+	})
+
+	t.Run("a request still in flight does not bring the session back", func(t *testing.T) {
+		tablet := login(t, "Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X)")
+		// read by the auth middleware before the session got revoked
+		inFlight, err := userSession.Get(context.Background(), tablet.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, userSession.Revoke(context.Background(), inFlight.UserID, inFlight.ID))
+
+		assert.ErrorIs(t, userSession.Touch(context.Background(), inFlight), pkg.ErrSessionNotFound)
+		_, err = userSession.Get(context.Background(), tablet.Value)
+		assert.ErrorIs(t, err, pkg.ErrSessionNotFound)
+	})
+}
+
+func TestSessionController_RevokeOtherSessions(t *testing.T) {
+	sessionController := &SessionController{UserSession: userSession}
+	laptop := login(t, "Mozilla/5.0 (X11; Linux x86_64)")
+	phone := login(t, "Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X)")
+
+	req := httptest.NewRequest(echo.POST, "/sessions/revoke_others", nil)
+	rec := httptest.NewRecorder()
+	ctx := authenticatedContext(t, req, rec, laptop)
+
+	assert.NoError(t, sessionController.RevokeOtherSessions()(ctx))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	_, err := userSession.Get(ctx.Request().Context(), phone.Value)
+	assert.ErrorIs(t, err, pkg.ErrSessionNotFound)
+	_, err = userSession.Get(ctx.Request().Context(), laptop.Value)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/baala3/passkeys/concerns"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+)
+
+// a pending password login is dropped after this many wrong codes
+const maxTOTPAttempts = 5
+
+// TOTPController manages authenticator apps as a second factor for password logins
+type TOTPController struct {
+	UserRepository repository.UserRepository
+	TOTPRepository repository.TOTPRepository
+	UserSession    pkg.UserSession
+	SecretBox      pkg.SecretBox
+	LoginGuard     LoginGuard
+}
+
+func (tc TOTPController) GetStatus() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user := concerns.CurrentUser(ctx, tc.UserRepository)
+		if user == nil {
+			return pkg.SendError(ctx, errors.New("user not found"), http.StatusUnauthorized)
+		}
+
+		credential, err := tc.TOTPRepository.FindTOTPCredential(ctx.Request().Context(), user.ID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return ctx.JSON(http.StatusOK, map[string]bool{"enabled": credential.Confirmed()})
+	}
+}
+
+// Enroll creates a new secret. It is not used for logins until Confirm.
+func (tc TOTPController) Enroll() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user := concerns.CurrentUser(ctx, tc.UserRepository)
+		if user == nil {
+			return pkg.SendError(ctx, errors.New("user not found"), http.StatusUnauthorized)
+		}
+
+		credential, err := tc.TOTPRepository.FindTOTPCredential(ctx.Request().Context(), user.ID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		if credential.Confirmed() {
+			return pkg.SendError(ctx, errors.New("An authenticator app is already set up"), http.StatusConflict)
+		}
+
+		secret, err := pkg.NewTOTPSecret()
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		sealed, err := tc.SecretBox.Seal(secret)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		if err := tc.TOTPRepository.StartEnrollment(ctx.Request().Context(), user.ID, sealed); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+
+		return ctx.JSON(http.StatusOK, map[string]string{
+			"secret": secret,
+			"uri":    pkg.TOTPURI(os.Getenv("RP_DISPLAY_NAME"), user.Email, secret),
+		})
+	}
+}
+
+// Confirm enables the authenticator app once the user entered a valid code
+func (tc TOTPController) Confirm() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p struct {
+			Code string
+		}
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		user := concerns.CurrentUser(ctx, tc.UserRepository)
+		if user == nil {
+			return pkg.SendError(ctx, errors.New("user not found"), http.StatusUnauthorized)
+		}
+
+		credential, err := tc.TOTPRepository.FindTOTPCredential(ctx.Request().Context(), user.ID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		if credential == nil || credential.Confirmed() {
+			return pkg.SendError(ctx, errors.New("No authenticator app setup in progress"), http.StatusBadRequest)
+		}
+
+		secret, err := tc.SecretBox.Open(credential.Secret)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		step, ok := pkg.ValidateTOTP(secret, p.Code, time.Now())
+		if !ok {
+			return pkg.SendError(ctx, errors.New("Invalid code."), http.StatusBadRequest)
+		}
+
+		if err := tc.TOTPRepository.Confirm(ctx.Request().Context(), user.ID, step); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return pkg.SendOK(ctx)
+	}
+}
+
+func (tc TOTPController) Disable() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user := concerns.CurrentUser(ctx, tc.UserRepository)
+		if user == nil {
+			return pkg.SendError(ctx, errors.New("user not found"), http.StatusUnauthorized)
+		}
+
+		if err := tc.TOTPRepository.Delete(ctx.Request().Context(), user.ID); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return pkg.SendOK(ctx)
+	}
+}
+
+// Login completes a password login that is waiting for its second factor
+func (tc TOTPController) Login() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p struct {
+			Code string
+		}
+		if err := ctx.Bind(&p); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		cookie, err := ctx.Cookie("auth")
+		if err != nil {
+			return pkg.SendError(ctx, errors.New("Please sign in with your password first."), http.StatusUnauthorized)
+		}
+		session, err := tc.UserSession.Get(ctx.Request().Context(), cookie.Value)
+		if err != nil || !session.MFAPending {
+			return pkg.SendError(ctx, errors.New("Please sign in with your password first."), http.StatusUnauthorized)
+		}
+
+		user, err := tc.UserRepository.FindUserById(ctx.Request().Context(), session.UserID[:])
+		if err != nil {
+			return pkg.SendError(ctx, errors.New("Please sign in with your password first."), http.StatusUnauthorized)
+		}
+		policy := tc.LoginGuard.RateLimiter.Config.TOTPLogin
+		if err := tc.LoginGuard.Allow(ctx, policy, user.Email); err != nil {
+			return pkg.SendRateLimited(ctx, err)
+		}
+
+		credential, err := tc.TOTPRepository.FindTOTPCredential(ctx.Request().Context(), session.UserID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		if !credential.Confirmed() {
+			return pkg.SendError(ctx, errors.New("Please sign in with your password first."), http.StatusUnauthorized)
+		}
+
+		secret, err := tc.SecretBox.Open(credential.Secret)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+
+		step, ok := pkg.ValidateTOTP(secret, p.Code, time.Now())
+		if ok {
+			err = tc.TOTPRepository.UseStep(ctx.Request().Context(), session.UserID, step)
+			if errors.Is(err, repository.ErrTOTPCodeUsed) {
+				ok = false
+			} else if err != nil {
+				return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			}
+		}
+
+		if !ok {
+			tc.LoginGuard.Fail(ctx, policy, user.Email)
+			attempts, err := tc.UserSession.RecordMFAFailure(ctx.Request().Context(), session)
+			if errors.Is(err, pkg.ErrSessionNotFound) {
+				return pkg.SendError(ctx, errors.New("Please sign in with your password first."), http.StatusUnauthorized)
+			}
+			if err != nil {
+				return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			}
+			if attempts >= maxTOTPAttempts {
+				tc.UserSession.Delete(ctx, session.Token())
+				return pkg.SendError(ctx, errors.New("Too many invalid codes, please sign in again."), http.StatusUnauthorized)
+			}
+			return pkg.SendError(ctx, errors.New("Invalid code."), http.StatusUnauthorized)
+		}
+
+		if err := tc.UserSession.CompleteMFA(ctx, session, pkg.AuthMethodTOTP); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		// only now the password login counts as successful
+		tc.LoginGuard.Succeed(ctx, policy, user.Email)
+		if session.AuthMethod == pkg.AuthMethodPassword {
+			tc.LoginGuard.Succeed(ctx, tc.LoginGuard.RateLimiter.Config.PasswordLogin, user.Email)
+		}
+		return pkg.SendOK(ctx)
+	}
+}
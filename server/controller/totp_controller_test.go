@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPController(t *testing.T) {
+	secretBox, err := pkg.NewSecretBoxWithKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	totpController := &TOTPController{
+		UserRepository: userRepository,
+		TOTPRepository: repository.TOTPRepository{DB: database},
+		UserSession: userSession,
+		SecretBox: secretBox,
+		LoginGuard: loginGuard,
+	}
+
+	passwordHash, err := argon2id.CreateHash("password123", argon2id.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := userRepository.CreateUser(context.Background(), "totp@email.com", passwordHash, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passwordLogin := func(t *testing.T) (*httptest.ResponseRecorder, *http.Cookie) {
+		req := httptest.NewRequest(echo.POST, "/login", strings.NewReader(`{"email":"totp@email.com", "password":"password123"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, passwordController.Login()(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		return rec, rec.Result().Cookies()[0]
+	}
+	totpLogin := func(t *testing.T, cookie *http.Cookie, code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/login/totp", strings.NewReader(`{"code":"`+code+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, totpController.Login()(e.NewContext(req, rec)))
+		return rec
+	}
+
+	_, cookie := passwordLogin(t)
+	var secret string
+
+	t.Run("enroll and confirm", func(t *testing.T) {
+		req := httptest.NewRequest(echo.POST, "/totp/enroll", nil)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, totpController.Enroll()(authenticatedContext(t, req, rec, cookie)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var enrollment map[string]string
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &enrollment))
+		secret = enrollment["secret"]
+		assert.Contains(t, enrollment["uri"], "otpauth://totp/")
+
+		code, err := pkg.TOTPCode(secret, time.Now())
+		assert.NoError(t, err)
+		req = httptest.NewRequest(echo.POST, "/totp/confirm", strings.NewReader(`{"code":"`+code+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec = httptest.NewRecorder()
+		assert.NoError(t, totpController.Confirm()(authenticatedContext(t, req, rec, cookie)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		// the secret is not stored in plain text
+		credential, err := totpController.TOTPRepository.FindTOTPCredential(context.Background(), user.ID)
+		assert.NoError(t, err)
+		assert.NotEqual(t, secret, credential.Secret)
+	})
+
+	t.Run("password login waits for the code", func(t *testing.T) {
+		rec, pending := passwordLogin(t)
+		assert.JSONEq(t, `{"status":"ok","errorMessage":"","code":"totp_required"}`, rec.Body.String())
+
+		session, err := userSession.Get(context.Background(), pending.Value)
+		assert.NoError(t, err)
+		assert.True(t, session.MFAPending)
+
+		rec = totpLogin(t, pending, "000000")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		// the code of the confirmation step cannot be used again, the next one can
+		code, _ := pkg.TOTPCode(secret, time.Now().Add(30*time.Second))
+		rec = totpLogin(t, pending, code)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		session, err = userSession.Get(context.Background(), rec.Result().Cookies()[0].Value)
+		assert.NoError(t, err)
+		assert.False(t, session.MFAPending)
+		assert.Equal(t, pkg.AuthMethodTOTP, session.VerifiedMethod)
+
+		// a code only works once
+		_, pending = passwordLogin(t)
+		rec = totpLogin(t, pending, code)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	// the policies count across subtests, each starts without failures
+	resetFailures := func(t *testing.T) {
+		config := loginGuard.RateLimiter.Config
+		for _, policy := range []pkg.RateLimitPolicy{config.PasswordLogin, config.TOTPLogin} {
+			assert.NoError(t, loginGuard.RateLimiter.Reset(context.Background(), policy, user.Email))
+		}
+	}
+
+	t.Run("too many invalid codes", func(t *testing.T) {
+		resetFailures(t)
+		// the account is throttled only after the session was dropped
+		policy := &totpController.LoginGuard.RateLimiter.Config.TOTPLogin
+		defer func(freeFailures int) { policy.FreeFailures = freeFailures }(policy.FreeFailures)
+		policy.FreeFailures = maxTOTPAttempts
+		_, pending := passwordLogin(t)
+		for i := 0; i < maxTOTPAttempts; i++ {
+			totpLogin(t, pending, "000000")
+		}
+		_, err := userSession.Get(context.Background(), pending.Value)
+		assert.ErrorIs(t, err, pkg.ErrSessionNotFound)
+	})
+
+	t.Run("wrong codes are throttled across pending sessions", func(t *testing.T) {
+		resetFailures(t)
+		for range loginGuard.RateLimiter.Config.TOTPLogin.FreeFailures + 1 {
+			_, pending := passwordLogin(t)
+			assert.Equal(t, http.StatusUnauthorized, totpLogin(t, pending, "000000").Code)
+		}
+		_, pending := passwordLogin(t)
+		assert.Equal(t, http.StatusTooManyRequests, totpLogin(t, pending, "000000").Code)
+	})
+
+	t.Run("the password alone does not forget failed logins", func(t *testing.T) {
+		resetFailures(t)
+		wrongPassword := func(t *testing.T) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(echo.POST, "/login", strings.NewReader(`{"email":"totp@email.com", "password":"wrong-password"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+
+			assert.NoError(t, passwordController.Login()(e.NewContext(req, rec)))
+			return rec
+		}
+
+		for range loginGuard.RateLimiter.Config.PasswordLogin.FreeFailures {
+			assert.Equal(t, http.StatusUnauthorized, wrongPassword(t).Code)
+		}
+		// the right password without the code
+		passwordLogin(t)
+		assert.Equal(t, http.StatusUnauthorized, wrongPassword(t).Code)
+		assert.Equal(t, http.StatusTooManyRequests, wrongPassword(t).Code)
+	})
+}
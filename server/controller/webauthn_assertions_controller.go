@@ -3,6 +3,7 @@ package controller
 import (
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/baala3/passkeys/concerns"
 	"github.com/baala3/passkeys/model"
@@ -10,6 +11,7 @@ import (
 	"github.com/baala3/passkeys/repository"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
 
@@ -18,16 +20,27 @@ type WebAuthnAssertionsController struct {
 	UserRepository repository.UserRepository
 	WebAuthnSession pkg.WebAuthnSession
 	UserSession pkg.UserSession
+	LoginGuard LoginGuard
+	AntiEnumeration pkg.AntiEnumeration
 }
 
 func (pc *WebAuthnAssertionsController) BeginLogin() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
-		options, sessionData, err := pc.getCredentialAssertion(ctx)
+		user, err, _ := pc.getContextBasedUser(ctx)
 		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		if err := pc.WebAuthnSession.Create(ctx, "login", sessionData); err != nil {
+		if err := pc.LoginGuard.Allow(ctx, pc.LoginGuard.RateLimiter.Config.PasskeyLogin, user.Email); err != nil {
+			return pkg.SendRateLimited(ctx, err)
+		}
+
+		options, sessionData, err := pc.getCredentialAssertion(user)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+
+		if err := pc.WebAuthnSession.Create(ctx, pkg.CeremonyLogin, sessionData); err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
@@ -37,31 +50,50 @@ func (pc *WebAuthnAssertionsController) BeginLogin() echo.HandlerFunc {
 
 func (pc *WebAuthnAssertionsController) FinishLogin() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
-		sessionId, sessionData, err := pc.WebAuthnSession.Get(ctx, "login")
+		sessionData, err := pc.WebAuthnSession.Get(ctx, pkg.CeremonyLogin)
 		if err != nil {
-			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			return pkg.SendError(ctx, err, pkg.CeremonyErrorStatus(err))
 		}
 
-		credential, err := pc.getCredential(ctx, sessionData)
+		user, err := pc.UserRepository.FindUserById(ctx.Request().Context(), sessionData.UserID)
 		if err != nil {
 			return pkg.SendError(ctx, errors.New("There is no password for this account"), http.StatusBadRequest)
 		}
+		policy := pc.LoginGuard.RateLimiter.Config.PasskeyLogin
+
+		credential, err := pc.WebAuthnAPI.FinishLogin(user, *sessionData, ctx.Request())
+		if err != nil {
+			pc.LoginGuard.Fail(ctx, policy, user.Email)
+			return pkg.SendError(ctx, errors.New("There is no password for this account"), http.StatusBadRequest)
+		}
+
+		// persist the new sign count and flags, also when the checks below fail,
+		// so a detected clone stays flagged on the credential
+		if err := pc.UserRepository.UpdateWebauthnCredential(ctx.Request().Context(), credential); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
 
 		if !credential.Flags.UserPresent || !credential.Flags.UserVerified {
+			pc.LoginGuard.Fail(ctx, policy, user.Email)
 			return pkg.SendError(ctx, errors.New("User not present or not verified"), http.StatusBadRequest)
 		}
 
 		if credential.Authenticator.CloneWarning {
+			pc.LoginGuard.Fail(ctx, policy, user.Email)
 			return pkg.SendError(ctx, errors.New("Authenticator is cloned"), http.StatusBadRequest)
 		}
-		pc.WebAuthnSession.Delete(ctx, sessionId)
+		pc.LoginGuard.Succeed(ctx, policy, user.Email)
+
+		if err := pc.UserRepository.MarkCredentialUsed(ctx.Request().Context(), credential.ID); err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
 
 		userID, err := pc.UserRepository.FindUserIDByCredentialID(ctx.Request().Context(), credential.ID)
 		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		if err := pc.UserSession.Create(ctx, *userID); err != nil {
+		if err := pc.startSession(ctx, *userID); err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
@@ -69,14 +101,19 @@ func (pc *WebAuthnAssertionsController) FinishLogin() echo.HandlerFunc {
 	}
 }
 
+// BeginDiscoverableLogin does not know the account yet, only the IP limit applies
 func (pc *WebAuthnAssertionsController) BeginDiscoverableLogin() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
+		if err := pc.LoginGuard.Allow(ctx, pc.LoginGuard.RateLimiter.Config.PasskeyLogin, ""); err != nil {
+			return pkg.SendRateLimited(ctx, err)
+		}
+
 		options, sessionData, err := pc.getDiscoverableCredentialAssertion()
 		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		if err := pc.WebAuthnSession.Create(ctx, "login", sessionData); err != nil {
+		if err := pc.WebAuthnSession.Create(ctx, pkg.CeremonyLogin, sessionData); err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
@@ -86,65 +123,132 @@ func (pc *WebAuthnAssertionsController) BeginDiscoverableLogin() echo.HandlerFun
 
 func (pc *WebAuthnAssertionsController) FinishDiscoverableLogin() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
-		sessionId, sessionData, err := pc.WebAuthnSession.Get(ctx, "login")
-		if err != nil {
-			return pkg.SendError(ctx, err, http.StatusInternalServerError)
-		}
-
-		credential, err := pc.getDiscoverableCredential(ctx, sessionData)
-		if err != nil {
-			return pkg.SendError(ctx, errors.New("There is no password for this account"), http.StatusBadRequest)
-		}
+		return pc.finishDiscoverableLogin(ctx, pkg.CeremonyLogin)
+	}
+}
 
-		if !credential.Flags.UserPresent || !credential.Flags.UserVerified {
-			return pkg.SendError(ctx, errors.New("User not present or not verified"), http.StatusBadRequest)
+// BeginConditionalLogin starts the passkey autofill of the sign in page, which
+// calls it on load and passes the options to navigator.credentials.get with
+// mediation "conditional". The challenge stays valid while the page is open:
+// until it is used, calling again returns the same options, e.g. after the
+// browser aborted the request. POST /conditional_login/finish completes it.
+func (pc *WebAuthnAssertionsController) BeginConditionalLogin() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if err := pc.LoginGuard.Allow(ctx, pc.LoginGuard.RateLimiter.Config.PasskeyLogin, ""); err != nil {
+			return pkg.SendRateLimited(ctx, err)
 		}
 
-		if credential.Authenticator.CloneWarning {
-			return pkg.SendError(ctx, errors.New("Authenticator is cloned"), http.StatusBadRequest)
+		if options, err := pc.WebAuthnSession.GetOptions(ctx, pkg.CeremonyConditionalLogin); err == nil {
+			return ctx.JSONBlob(http.StatusOK, options)
 		}
-		pc.WebAuthnSession.Delete(ctx, sessionId)
 
-		userID, err := pc.UserRepository.FindUserIDByCredentialID(ctx.Request().Context(), credential.ID)
+		options, sessionData, err := pc.getDiscoverableCredentialAssertion()
 		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
+		timeout := pc.WebAuthnSession.Config.ConditionalLoginTimeout
+		options.Response.Timeout = int(timeout.Milliseconds())
+		sessionData.Expires = time.Now().Add(timeout)
 
-		if err := pc.UserSession.Create(ctx, *userID); err != nil {
+		if err := pc.WebAuthnSession.CreateReusable(ctx, pkg.CeremonyConditionalLogin, sessionData, options); err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		return pkg.SendOK(ctx)
+		return ctx.JSON(http.StatusOK, options)
 	}
 }
 
-func (pc *WebAuthnAssertionsController) getCredentialAssertion(ctx echo.Context) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
-	user, err, _ := pc.getContextBasedUser(ctx)
+// FinishConditionalLogin takes the assertion the autofill returned, like
+// FinishDiscoverableLogin. The challenge is used up either way, after a
+// failure the page begins a new autofill.
+func (pc *WebAuthnAssertionsController) FinishConditionalLogin() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return pc.finishDiscoverableLogin(ctx, pkg.CeremonyConditionalLogin)
+	}
+}
+
+func (pc *WebAuthnAssertionsController) finishDiscoverableLogin(ctx echo.Context, ceremonyType string) error {
+	sessionData, err := pc.WebAuthnSession.Get(ctx, ceremonyType)
 	if err != nil {
-		return nil, nil, err
+		return pkg.SendError(ctx, err, pkg.CeremonyErrorStatus(err))
 	}
 
-	return pc.WebAuthnAPI.BeginLogin(user, webauthn.WithUserVerification(protocol.VerificationRequired))
+	// the account is only known once the authenticator named it, failures
+	// before that only count against the IP
+	user, credential, err := pc.getDiscoverableCredential(ctx, sessionData)
+	policy := pc.LoginGuard.RateLimiter.Config.PasskeyLogin
+	if err != nil {
+		if user != nil {
+			pc.LoginGuard.Fail(ctx, policy, user.Email)
+		}
+		return pkg.SendError(ctx, errors.New("There is no password for this account"), http.StatusBadRequest)
+	}
+
+	// persist the new sign count and flags, also when the checks below fail,
+	// so a detected clone stays flagged on the credential
+	if err := pc.UserRepository.UpdateWebauthnCredential(ctx.Request().Context(), credential); err != nil {
+		return pkg.SendError(ctx, err, http.StatusInternalServerError)
+	}
+
+	if !credential.Flags.UserPresent || !credential.Flags.UserVerified {
+		pc.LoginGuard.Fail(ctx, policy, user.Email)
+		return pkg.SendError(ctx, errors.New("User not present or not verified"), http.StatusBadRequest)
+	}
+
+	if credential.Authenticator.CloneWarning {
+		pc.LoginGuard.Fail(ctx, policy, user.Email)
+		return pkg.SendError(ctx, errors.New("Authenticator is cloned"), http.StatusBadRequest)
+	}
+	pc.LoginGuard.Succeed(ctx, policy, user.Email)
+
+	if err := pc.UserRepository.MarkCredentialUsed(ctx.Request().Context(), credential.ID); err != nil {
+		return pkg.SendError(ctx, err, http.StatusInternalServerError)
+	}
+
+	userID, err := pc.UserRepository.FindUserIDByCredentialID(ctx.Request().Context(), credential.ID)
+	if err != nil {
+		return pkg.SendError(ctx, err, http.StatusInternalServerError)
+	}
+
+	if err := pc.startSession(ctx, *userID); err != nil {
+		return pkg.SendError(ctx, err, http.StatusInternalServerError)
+	}
+
+	return pkg.SendOK(ctx)
 }
 
-func (pc *WebAuthnAssertionsController) getCredential(ctx echo.Context, sessionData *webauthn.SessionData) (*webauthn.Credential, error) {
-   user, err := pc.UserRepository.FindUserById(ctx.Request().Context(), sessionData.UserID)
-   if err != nil {
-	return nil, err
-   }
+// startSession signs the user in, or marks the existing session as recently
+// verified when an already signed in user re-authenticated for a sensitive action
+func (pc *WebAuthnAssertionsController) startSession(ctx echo.Context, userID uuid.UUID) error {
+	session := concerns.CurrentSession(ctx)
+	if session != nil && session.UserID == userID {
+		return pc.UserSession.MarkVerified(ctx, session, pkg.AuthMethodPasskey)
+	}
+	return pc.UserSession.Create(ctx, userID, pkg.AuthMethodPasskey)
+}
 
-   return pc.WebAuthnAPI.FinishLogin(user, *sessionData, ctx.Request())
+func (pc *WebAuthnAssertionsController) getCredentialAssertion(user *model.User) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	return pc.WebAuthnAPI.BeginLogin(user, webauthn.WithUserVerification(protocol.VerificationRequired))
 }
 
 func (pc *WebAuthnAssertionsController) getDiscoverableCredentialAssertion() (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
 	return pc.WebAuthnAPI.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
 }
 
-func (pc *WebAuthnAssertionsController) getDiscoverableCredential(ctx echo.Context, sessionData *webauthn.SessionData) (*webauthn.Credential, error) {
-	return pc.WebAuthnAPI.FinishDiscoverableLogin(
-		func(rawId []byte, userID []byte) (user webauthn.User, err error) {
-			return pc.UserRepository.FindUserById(ctx.Request().Context(), userID)
+// getDiscoverableCredential also returns the account the credential belongs
+// to, which is set whenever the lookup found it, even if the assertion failed
+func (pc *WebAuthnAssertionsController) getDiscoverableCredential(ctx echo.Context, sessionData *webauthn.SessionData) (*model.User, *webauthn.Credential, error) {
+	var user *model.User
+	credential, err := pc.WebAuthnAPI.FinishDiscoverableLogin(
+		func(rawId []byte, userID []byte) (webauthn.User, error) {
+			found, err := pc.UserRepository.FindUserById(ctx.Request().Context(), userID)
+			if err != nil {
+				return nil, err
+			}
+			user = found
+			return found, nil
 		}, *sessionData, ctx.Request())
+	return user, credential, err
 }
 
 
@@ -159,6 +263,12 @@ func (pc *WebAuthnAssertionsController) getContextBasedUser(ctx echo.Context) (u
 		}
 		user, err := pc.UserRepository.FindUserByEmail(ctx.Request().Context(), p.Email)
 
+		// unknown addresses and accounts without passkeys get options for a
+		// made up passkey, finishing the login then fails like a wrong passkey
+		if pc.AntiEnumeration.Enabled && (err != nil || len(user.WebauthnCredentials) == 0) {
+			return pc.fakeUser(p.Email), nil, http.StatusOK
+		}
+
 		if err != nil {
 			return nil, err, http.StatusBadRequest
 		}
@@ -167,7 +277,7 @@ func (pc *WebAuthnAssertionsController) getContextBasedUser(ctx echo.Context) (u
 			return nil, errors.New("User does not exist"), http.StatusBadRequest
 		}
 		return user, nil, http.StatusOK
-	case "delete_account", "email_change", "password_change":
+	case "delete_account", "email_change", "password_change", "reauth":
 		user = concerns.CurrentUser(ctx, pc.UserRepository)
 		if user == nil {
 			return nil, errors.New("user not found"), http.StatusUnauthorized
@@ -177,3 +287,15 @@ func (pc *WebAuthnAssertionsController) getContextBasedUser(ctx echo.Context) (u
 		return nil, errors.New("invalid context"), http.StatusBadRequest
 	}
 }
+
+// fakeUser stands in for an unknown address, see pkg.AntiEnumeration
+func (pc *WebAuthnAssertionsController) fakeUser(email string) *model.User {
+	return &model.User{
+		ID:    pc.AntiEnumeration.FakeUserID(email),
+		Email: email,
+		WebauthnCredentials: []model.WebauthnCredentials{{
+			CredentialID: pc.AntiEnumeration.FakeCredentialID(email),
+			Transport:    []protocol.AuthenticatorTransport{protocol.Internal, protocol.Hybrid},
+		}},
+	}
+}
@@ -0,0 +1,286 @@
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebAuthnAssertionsController_BeginLogin(t *testing.T) {
+	webAuthnAPI, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "PasskeyDemo",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:9044"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webauthnAssertionsController := &WebAuthnAssertionsController{
+		WebAuthnAPI:     webAuthnAPI,
+		UserRepository:  userRepository,
+		WebAuthnSession: pkg.WebAuthnSession{Store: memoryStore(t), Config: pkg.NewSessionConfig()},
+		UserSession:     userSession,
+		LoginGuard:      loginGuard,
+		AntiEnumeration: pkg.AntiEnumeration{Enabled: true, Signer: pkg.Signer{Secret: []byte("secret")}},
+	}
+
+	user, err := userRepository.CreateUser(context.Background(), "passkey@email.com", "hash", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential := &webauthn.Credential{
+		ID:        []byte("passkey-login-credential"),
+		PublicKey: []byte("public-key"),
+		Transport: []protocol.AuthenticatorTransport{protocol.Internal, protocol.Hybrid},
+	}
+	if err := userRepository.AddWebauthnCredential(context.Background(), user.ID, credential, "iCloud Keychain", pkg.AuthenticatorAttestation{}); err != nil {
+		t.Fatal(err)
+	}
+
+	beginLogin := func(t *testing.T, email string) protocol.PublicKeyCredentialRequestOptions {
+		req := httptest.NewRequest(echo.POST, "/login/begin?context=signin", strings.NewReader(`{"email":"`+email+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, webauthnAssertionsController.BeginLogin()(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, pkg.CeremonyLogin, rec.Result().Cookies()[0].Name)
+
+		var options protocol.CredentialAssertion
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+		return options.Response
+	}
+
+	t.Run("unknown addresses look like accounts with one passkey", func(t *testing.T) {
+		known := beginLogin(t, "passkey@email.com")
+		unknown := beginLogin(t, "unknown@email.com")
+
+		assert.Len(t, unknown.AllowedCredentials, len(known.AllowedCredentials))
+		assert.Equal(t, known.AllowedCredentials[0].Transport, unknown.AllowedCredentials[0].Transport)
+		assert.Equal(t, known.UserVerification, unknown.UserVerification)
+
+		// asking again gives the same made up passkey
+		again := beginLogin(t, "Unknown@email.com")
+		assert.Equal(t, unknown.AllowedCredentials[0].CredentialID, again.AllowedCredentials[0].CredentialID)
+	})
+
+	t.Run("accounts without passkeys", func(t *testing.T) {
+		options := beginLogin(t, "existing@email.com")
+		assert.Len(t, options.AllowedCredentials, 1)
+	})
+}
+
+func TestWebAuthnAssertionsController_BeginConditionalLogin(t *testing.T) {
+	webAuthnAPI, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "PasskeyDemo",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:9044"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionConfig := pkg.NewSessionConfig()
+	sessionConfig.ConditionalLoginTimeout = 30 * time.Minute
+	webauthnAssertionsController := &WebAuthnAssertionsController{
+		WebAuthnAPI:     webAuthnAPI,
+		UserRepository:  userRepository,
+		WebAuthnSession: pkg.WebAuthnSession{Store: memoryStore(t), Config: sessionConfig},
+		UserSession:     userSession,
+		LoginGuard:      loginGuard,
+	}
+
+	beginConditionalLogin := func(t *testing.T, cookie *http.Cookie) (protocol.PublicKeyCredentialRequestOptions, *http.Cookie) {
+		req := httptest.NewRequest(echo.POST, "/conditional_login/begin", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(t, webauthnAssertionsController.BeginConditionalLogin()(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var options protocol.CredentialAssertion
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+		if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+			cookie = cookies[0]
+		}
+		return options.Response, cookie
+	}
+
+	options, cookie := beginConditionalLogin(t, nil)
+	assert.Equal(t, pkg.CeremonyConditionalLogin, cookie.Name)
+	assert.Empty(t, options.AllowedCredentials)
+	assert.Equal(t, int((30 * time.Minute).Milliseconds()), options.Timeout)
+
+	t.Run("the page gets the same challenge until it is used", func(t *testing.T) {
+		again, _ := beginConditionalLogin(t, cookie)
+		assert.Equal(t, options.Challenge, again.Challenge)
+
+		req := httptest.NewRequest(echo.POST, "/conditional_login/finish", strings.NewReader(`{}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, webauthnAssertionsController.FinishConditionalLogin()(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		// a failed attempt used it up as well
+		fresh, _ := beginConditionalLogin(t, cookie)
+		assert.NotEqual(t, options.Challenge, fresh.Challenge)
+	})
+
+	t.Run("a button started login does not replace it", func(t *testing.T) {
+		options, cookie := beginConditionalLogin(t, nil)
+
+		rec := httptest.NewRecorder()
+		assert.NoError(t, webauthnAssertionsController.BeginDiscoverableLogin()(e.NewContext(httptest.NewRequest(echo.POST, "/discoverable_login/begin", nil), rec)))
+		assert.Equal(t, pkg.CeremonyLogin, rec.Result().Cookies()[0].Name)
+
+		again, _ := beginConditionalLogin(t, cookie)
+		assert.Equal(t, options.Challenge, again.Challenge)
+	})
+}
+
+// testPasskey signs assertions like an authenticator holding the credential
+type testPasskey struct {
+	id  []byte
+	key *ecdsa.PrivateKey
+}
+
+func newTestPasskey(t *testing.T) *testPasskey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &testPasskey{id: id, key: key}
+}
+
+// credential is what the registration stored for the passkey
+func (p *testPasskey) credential(t *testing.T) *webauthn.Credential {
+	publicKey, err := webauthncbor.Marshal(map[int]any{1: 2, 3: -7, -1: 1, -2: p.key.X.FillBytes(make([]byte, 32)), -3: p.key.Y.FillBytes(make([]byte, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &webauthn.Credential{ID: p.id, PublicKey: publicKey}
+}
+
+// assertion answers the challenge with the given flags and sign counter
+func (p *testPasskey) assertion(t *testing.T, challenge string, flags protocol.AuthenticatorFlags, signCount uint32, userHandle []byte) string {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	authData := binary.BigEndian.AppendUint32(append(rpIDHash[:], byte(flags)), signCount)
+	clientData, _ := json.Marshal(map[string]string{"type": "webauthn.get", "challenge": challenge, "origin": "http://localhost:9044"})
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, p.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	body, _ := json.Marshal(map[string]any{
+		"id":    encode(p.id),
+		"rawId": encode(p.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData),
+			"authenticatorData": encode(authData),
+			"signature":         encode(signature),
+			"userHandle":        encode(userHandle),
+		},
+	})
+	return string(body)
+}
+
+func TestWebAuthnAssertionsController_FinishLogin(t *testing.T) {
+	webAuthnAPI, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "PasskeyDemo",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:9044"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webauthnAssertionsController := &WebAuthnAssertionsController{
+		WebAuthnAPI:     webAuthnAPI,
+		UserRepository:  userRepository,
+		WebAuthnSession: pkg.WebAuthnSession{Store: memoryStore(t), Config: pkg.NewSessionConfig()},
+		UserSession:     userSession,
+		LoginGuard:      loginGuard,
+	}
+
+	// enroll gives a new account a passkey that already signed in ten times
+	enroll := func(t *testing.T, email string) (*model.User, *testPasskey) {
+		user, err := userRepository.CreateUser(context.Background(), email, "hash", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		passkey := newTestPasskey(t)
+		credential := passkey.credential(t)
+		credential.Authenticator.SignCount = 10
+		if err := userRepository.AddWebauthnCredential(context.Background(), user.ID, credential, "iCloud Keychain", pkg.AuthenticatorAttestation{}); err != nil {
+			t.Fatal(err)
+		}
+		return user, passkey
+	}
+	finishLogin := func(t *testing.T, user *model.User, passkey *testPasskey, signCount uint32) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/login/begin?context=signin", strings.NewReader(`{"email":"`+user.Email+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, webauthnAssertionsController.BeginLogin()(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var options protocol.CredentialAssertion
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+
+		req = httptest.NewRequest(echo.POST, "/login/finish", strings.NewReader(passkey.assertion(t, options.Response.Challenge.String(), protocol.FlagUserPresent|protocol.FlagUserVerified, signCount, user.ID[:])))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.AddCookie(rec.Result().Cookies()[0])
+		rec = httptest.NewRecorder()
+		assert.NoError(t, webauthnAssertionsController.FinishLogin()(e.NewContext(req, rec)))
+		return rec
+	}
+	lastUsedAt := func(t *testing.T, user *model.User, passkey *testPasskey) *time.Time {
+		user, err := userRepository.FindUserById(context.Background(), user.ID[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return findCredential(t, user, passkey.id).LastUsedAt
+	}
+
+	t.Run("a rejected login does not count as use", func(t *testing.T) {
+		user, passkey := enroll(t, "cloned-passkey@email.com")
+
+		// a counter that went backwards gives the clone away
+		rec := finishLogin(t, user, passkey, 5)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Authenticator is cloned"}`, rec.Body.String())
+		assert.Nil(t, lastUsedAt(t, user, passkey))
+	})
+
+	t.Run("successful login", func(t *testing.T) {
+		user, passkey := enroll(t, "finish-login@email.com")
+
+		rec := finishLogin(t, user, passkey, 11)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotNil(t, lastUsedAt(t, user, passkey))
+	})
+}
@@ -1,17 +1,22 @@
 package controller
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
 
-	"github.com/alexedwards/argon2id"
 	"github.com/baala3/passkeys/concerns"
 	"github.com/baala3/passkeys/model"
 	"github.com/baala3/passkeys/pkg"
 	"github.com/baala3/passkeys/repository"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/random"
 )
@@ -21,6 +26,13 @@ type WebAuthnCredentialController struct {
 	UserRepository repository.UserRepository
 	WebAuthnSession pkg.WebAuthnSession
 	UserSession pkg.UserSession
+	EmailVerifier EmailVerifier
+	AntiEnumeration pkg.AntiEnumeration
+	PasswordHasher pkg.PasswordHasher
+	// MetadataService is nil when no FIDO metadata is configured
+	MetadataService *pkg.MetadataService
+	AuthenticatorPolicy pkg.AuthenticatorPolicy
+	ProviderCatalog *pkg.PasskeyProviderCatalog
 }
 
 func (pc *WebAuthnCredentialController) BeginRegistration() echo.HandlerFunc {
@@ -30,11 +42,17 @@ func (pc *WebAuthnCredentialController) BeginRegistration() echo.HandlerFunc {
 			return pkg.SendError(ctx, err, status)
 		}
 
+		upgrade := ctx.QueryParam("context") == "upgrade"
+
 		authSelect := protocol.AuthenticatorSelection{
 			RequireResidentKey: protocol.ResidentKeyRequired(),
 			ResidentKey:        protocol.ResidentKeyRequirementRequired,
 			UserVerification:   protocol.VerificationRequired,
 		}
+		if upgrade {
+			// the browser creates the passkey without asking, it cannot require verification
+			authSelect.UserVerification = protocol.VerificationPreferred
+		}
 
 		// generate PublicKeyCredentialCreationOptions, session data
 		options, sessionData, err := pc.WebAuthnAPI.BeginRegistration(user,
@@ -42,70 +60,199 @@ func (pc *WebAuthnCredentialController) BeginRegistration() echo.HandlerFunc {
 			webauthn.WithExclusions(user.CredentialExcludeList()))
 
 		if err != nil{
-			_ = pc.UserRepository.DeleteUser(ctx.Request().Context(), user)
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		err = pc.WebAuthnSession.Create(ctx,"registration", sessionData)
+		if ctx.QueryParam("context") == "signup" {
+			// the user is only stored once the passkey has been created
+			err = pc.WebAuthnSession.CreateSignup(ctx, user.Email, sessionData)
+		} else if upgrade {
+			err = pc.WebAuthnSession.CreateUpgrade(ctx, sessionData)
+		} else {
+			err = pc.WebAuthnSession.Create(ctx, pkg.CeremonyRegistration, sessionData)
+		}
 		if err != nil {
-			_ = pc.UserRepository.DeleteUser(ctx.Request().Context(), user)
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
-		
+
+		if upgrade {
+			return ctx.JSON(http.StatusOK, pkg.ConditionalCredentialCreation{CredentialCreation: options, Mediation: pkg.MediationConditional})
+		}
 		return ctx.JSON(http.StatusOK, options)
 	}
 }
 
 func (pc *WebAuthnCredentialController) FinishRegistration() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
-		sessionId, sessionData, err := pc.WebAuthnSession.Get(ctx,"registration")
+		registration, err := pc.WebAuthnSession.GetRegistration(ctx)
 
 		if err != nil {
-			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			return pkg.SendError(ctx, err, pkg.CeremonyErrorStatus(err))
 		}
+		sessionData, signupEmail := registration.Data, registration.SignupEmail
 
-		user, err := pc.UserRepository.FindUserById(ctx.Request().Context(), sessionData.UserID)
+		var user *model.User
+		if signupEmail != "" {
+			user, err = newSignupUser(pc.PasswordHasher, sessionData.UserID, signupEmail)
+		} else {
+			user, err = pc.UserRepository.FindUserById(ctx.Request().Context(), sessionData.UserID)
+		}
 		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		credential, err := pc.WebAuthnAPI.FinishRegistration(user, *sessionData, ctx.Request())
+		var credential *webauthn.Credential
+		if registration.Upgrade {
+			credential, err = pkg.FinishConditionalRegistration(pc.WebAuthnAPI, user, *sessionData, ctx.Request())
+		} else {
+			credential, err = pc.WebAuthnAPI.FinishRegistration(user, *sessionData, ctx.Request())
+		}
+		if pkg.IsAttestationError(err) {
+			ctx.Logger().Errorf("rejected attestation: %v", err)
+			return pkg.SendError(ctx, pkg.ErrAttestationRejected, http.StatusBadRequest)
+		}
 		if err != nil {
-			_ = pc.UserRepository.DeleteUser(ctx.Request().Context(), user)
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		if !credential.Flags.UserPresent || !credential.Flags.UserVerified {
-			_ = pc.UserRepository.DeleteUser(ctx.Request().Context(), user)
+		// an upgrade is created without a prompt, the password sign in verified the user
+		if !registration.Upgrade && (!credential.Flags.UserPresent || !credential.Flags.UserVerified) {
 			return pkg.SendError(ctx, errors.New("User not present or not verified"), http.StatusBadRequest)
 		}
 
-		if err := pc.UserRepository.AddWebauthnCredential(ctx.Request().Context(), user.ID, credential); err != nil {
-			_ = pc.UserRepository.DeleteUser(ctx.Request().Context(), user)
+		attestation := pc.MetadataService.Attest(credential)
+		if err := pc.AuthenticatorPolicy.Check(credential, attestation); err != nil {
+			var policyErr *pkg.AuthenticatorPolicyError
+			if errors.As(err, &policyErr) {
+				return pkg.SendErrorCode(ctx, err, http.StatusForbidden, policyErr.Code)
+			}
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+
+		name := user.DefaultCredentialName(pc.ProviderCatalog.Provider(credential.Authenticator.AAGUID))
+		if signupEmail != "" {
+			err = pc.UserRepository.CreateUserWithCredential(ctx.Request().Context(), user, credential, name, attestation)
+		} else if registration.Upgrade {
+			err = pc.UserRepository.AddUpgradeCredential(ctx.Request().Context(), user.ID, credential, name, attestation)
+		} else {
+			err = pc.UserRepository.AddWebauthnCredential(ctx.Request().Context(), user.ID, credential, name, attestation)
+		}
+		if errors.Is(err, repository.ErrEmailTaken) {
+			if !pc.AntiEnumeration.Enabled {
+				return pkg.SendError(ctx, errors.New("An account with that email already exists."), http.StatusConflict)
+			}
+			existing, err := pc.UserRepository.FindUserByEmail(ctx.Request().Context(), user.Email)
+			if err != nil {
+				return pkg.SendError(ctx, err, http.StatusInternalServerError)
+			}
+			if err := pc.EmailVerifier.SendAccountExists(ctx.Request().Context(), existing); err != nil {
+				ctx.Logger().Errorf("failed to send account exists email: %v", err)
+			}
+			return pkg.SendOKCode(ctx, pkg.CodeCheckEmail)
+		}
+		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 
-		_ = pc.WebAuthnSession.Delete(ctx, sessionId)
+		if signupEmail == "" {
+			// a recovery session has done what it was allowed to do
+			if session := concerns.CurrentSession(ctx); session != nil && session.Restricted {
+				if err := pc.UserSession.Unrestrict(ctx, session); err != nil {
+					return pkg.SendError(ctx, err, http.StatusInternalServerError)
+				}
+			}
+			return pkg.SendOK(ctx)
+		}
 
-		if err := pc.UserSession.Create(ctx, user.ID); err != nil {
-			_ = pc.UserRepository.DeleteUser(ctx.Request().Context(), user)
+		if err := pc.EmailVerifier.SendVerification(ctx.Request().Context(), user); err != nil {
+			ctx.Logger().Errorf("failed to send email verification: %v", err)
+		}
+
+		// answered like a signup for a taken address, the new passkey signs in from now on
+		if pc.AntiEnumeration.Enabled {
+			return pkg.SendOKCode(ctx, pkg.CodeCheckEmail)
+		}
+
+		if err := pc.UserSession.Create(ctx, user.ID, pkg.AuthMethodPasskey); err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
 		return pkg.SendOK(ctx)
 	}
 }
 
+// newSignupUser rebuilds the pending user of a signup ceremony. Passkey only
+// accounts get a random password hash that nobody can sign in with.
+func newSignupUser(passwordHasher pkg.PasswordHasher, webauthnID []byte, email string) (*model.User, error) {
+	id, err := uuid.FromBytes(webauthnID)
+	if err != nil {
+		return nil, err
+	}
+	passwordHash, err := passwordHasher.Hash(random.String(20))
+	if err != nil {
+		return nil, err
+	}
+	return &model.User{
+		ID: id,
+		Email: email,
+		PasswordHash: passwordHash,
+		HasPassword: false,
+	}, nil
+}
+
 func (pc *WebAuthnCredentialController) GetCredentials() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		user := concerns.CurrentUser(ctx, pc.UserRepository)
 		if user == nil {
 			return pkg.SendError(ctx, errors.New("user not found"), http.StatusUnauthorized)
 		}
-		credentials := user.GetWebAuthnCredentials()
+		credentials := user.GetWebAuthnCredentials(pc.ProviderCatalog)
 		return ctx.JSON(http.StatusOK, credentials)
 	}
 }
 
+const maxCredentialNameLength = 64
+
+func (pc *WebAuthnCredentialController) RenameCredential() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		type Request struct {
+			CredentialID string `json:"credentialId"`
+			Name string `json:"name"`
+		}
+		var request Request
+
+		if err := ctx.Bind(&request); err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		name := strings.TrimSpace(request.Name)
+		if name == "" {
+			return pkg.SendError(ctx, errors.New("Passkey name cannot be empty"), http.StatusBadRequest)
+		}
+		if utf8.RuneCountInString(name) > maxCredentialNameLength {
+			return pkg.SendError(ctx, fmt.Errorf("Passkey name must be at most %d characters", maxCredentialNameLength), http.StatusBadRequest)
+		}
+
+		credentialID, err := base64.StdEncoding.DecodeString(request.CredentialID)
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusBadRequest)
+		}
+
+		user := concerns.CurrentUser(ctx, pc.UserRepository)
+		if user == nil {
+			return pkg.SendError(ctx, errors.New("user not found"), http.StatusUnauthorized)
+		}
+
+		err = pc.UserRepository.RenameWebauthnCredential(ctx.Request().Context(), user.ID, credentialID, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return pkg.SendError(ctx, errors.New("Passkey not found"), http.StatusNotFound)
+		}
+		if err != nil {
+			return pkg.SendError(ctx, err, http.StatusInternalServerError)
+		}
+		return pkg.SendOK(ctx)
+	}
+}
+
 func (pc *WebAuthnCredentialController) DeleteCredential() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		type Request struct {
@@ -128,6 +275,9 @@ func (pc *WebAuthnCredentialController) DeleteCredential() echo.HandlerFunc {
 			return pkg.SendError(ctx, errors.New("user not found"), http.StatusUnauthorized)
 		}
 		err = pc.UserRepository.DeleteWebauthnCredential(ctx.Request().Context(),user.ID, credentialID)
+		if errors.Is(err, repository.ErrLastSignInMethod) {
+			return pkg.SendErrorCode(ctx, errors.New("This is your only way to sign in. Set a password or add another passkey before removing it."), http.StatusConflict, pkg.ErrorCodeLastSignInMethod)
+		}
 		if err != nil {
 			return pkg.SendError(ctx, err, http.StatusInternalServerError)
 		}
@@ -144,23 +294,32 @@ func (pc *WebAuthnCredentialController) getContextBasedUser(ctx echo.Context) (u
 			if err := ctx.Bind(&p); err != nil {
 				return nil, err, http.StatusBadRequest
 			}
-			user, err := pc.UserRepository.FindUserByEmail(ctx.Request().Context(), p.Email)
+			if !pkg.IsValidEmail(p.Email) {
+				return nil, errors.New("Invalid email"), http.StatusBadRequest
+			}
+			user, _ := pc.UserRepository.FindUserByEmail(ctx.Request().Context(), p.Email)
 
-			if user != nil {
+			// with anti enumeration a taken address is only noticed in FinishRegistration
+			if user != nil && !pc.AntiEnumeration.Enabled {
 				return nil, errors.New("user already exists"), http.StatusBadRequest
 			}
 
-			// Generate a random password hash to create a user
-			passwordHash, err := argon2id.CreateHash(random.String(20), argon2id.DefaultParams)
-			if err != nil {
-				return nil, err, http.StatusInternalServerError
-			}
-			user, err = pc.UserRepository.CreateUser(ctx.Request().Context(), p.Email, passwordHash)
-			if err != nil {
-				return nil, err, http.StatusInternalServerError
+			// the prospective user lives in the ceremony state until FinishRegistration
+			return &model.User{ID: uuid.New(), Email: p.Email}, nil, http.StatusOK
+		case "normal":
+			user = concerns.CurrentUser(ctx, pc.UserRepository)
+			if user == nil {
+				return nil, errors.New("user not found"), http.StatusUnauthorized
 			}
 			return user, nil, http.StatusOK
-		case "normal":
+		case "upgrade":
+			// only offered right after a password sign in, which stands in for
+			// the prompt the browser skips. A re-authentication later in the
+			// session does not count, it happened for some other action.
+			session := concerns.CurrentSession(ctx)
+			if session == nil || session.Restricted || session.AuthMethod != pkg.AuthMethodPassword || time.Since(session.CreatedAt) > pc.UserSession.Config.ReauthMaxAge {
+				return nil, errors.New("The passkey upgrade is only offered right after signing in with a password."), http.StatusForbidden
+			}
 			user = concerns.CurrentUser(ctx, pc.UserRepository)
 			if user == nil {
 				return nil, errors.New("user not found"), http.StatusUnauthorized
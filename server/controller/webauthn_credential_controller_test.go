@@ -0,0 +1,340 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebAuthnCredentialController_RenameCredential(t *testing.T) {
+	webauthnCredentialController := &WebAuthnCredentialController{UserRepository: userRepository, UserSession: userSession}
+	cookie := login(t, "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)")
+
+	user, err := userRepository.FindUserByEmail(context.Background(), "existing@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential := &webauthn.Credential{ID: []byte("rename-credential"), PublicKey: []byte("public-key")}
+	if err := userRepository.AddWebauthnCredential(context.Background(), user.ID, credential, "iCloud Keychain", pkg.AuthenticatorAttestation{}); err != nil {
+		t.Fatal(err)
+	}
+	credentialID := base64.StdEncoding.EncodeToString(credential.ID)
+
+	rename := func(t *testing.T, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.PATCH, "/credentials", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, req, rec, cookie)
+
+		assert.NoError(t, webauthnCredentialController.RenameCredential()(ctx))
+		return rec
+	}
+
+	t.Run("empty name", func(t *testing.T) {
+		rec := rename(t, `{"credentialId":"`+credentialID+`","name":"  "}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Passkey name cannot be empty"}`, rec.Body.String())
+	})
+
+	t.Run("unknown credential", func(t *testing.T) {
+		rec := rename(t, `{"credentialId":"`+base64.StdEncoding.EncodeToString([]byte("unknown"))+`","name":"Work phone"}`)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.JSONEq(t, `{"status": "error", "errorMessage":"Passkey not found"}`, rec.Body.String())
+	})
+
+	t.Run("successful rename", func(t *testing.T) {
+		rec := rename(t, `{"credentialId":"`+credentialID+`","name":" Work phone "}`)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		user, err := userRepository.FindUserByEmail(context.Background(), "existing@email.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Work phone", findCredential(t, user, credential.ID).Name)
+	})
+}
+
+// findCredential returns the credential of the user with the given ID, the
+// fixture users collect credentials from several tests
+func findCredential(t *testing.T, user *model.User, id []byte) model.WebauthnCredentials {
+	for _, credential := range user.WebauthnCredentials {
+		if bytes.Equal(credential.CredentialID, id) {
+			return credential
+		}
+	}
+	t.Fatalf("credential %q not found", id)
+	return model.WebauthnCredentials{}
+}
+
+func TestWebAuthnCredentialController_DeleteCredential(t *testing.T) {
+	webauthnCredentialController := &WebAuthnCredentialController{UserRepository: userRepository, UserSession: userSession}
+
+	// a passkey only account, as created by the passkey signup
+	user, err := userRepository.CreateUser(context.Background(), "passkey-only@email.com", "random", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := userSession.Create(e.NewContext(httptest.NewRequest(echo.POST, "/login/finish", nil), rec), user.ID, pkg.AuthMethodPasskey); err != nil {
+		t.Fatal(err)
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	for _, id := range []string{"first-credential", "second-credential"} {
+		credential := &webauthn.Credential{ID: []byte(id), PublicKey: []byte("public-key")}
+		if err := userRepository.AddWebauthnCredential(context.Background(), user.ID, credential, "Passkey", pkg.AuthenticatorAttestation{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleteCredential := func(t *testing.T, id string) *httptest.ResponseRecorder {
+		body := `{"credentialId":"` + base64.StdEncoding.EncodeToString([]byte(id)) + `"}`
+		req := httptest.NewRequest(echo.DELETE, "/credentials", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, req, rec, cookie)
+
+		assert.NoError(t, webauthnCredentialController.DeleteCredential()(ctx))
+		return rec
+	}
+
+	t.Run("another passkey is left", func(t *testing.T) {
+		rec := deleteCredential(t, "first-credential")
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("last sign in method", func(t *testing.T) {
+		rec := deleteCredential(t, "second-credential")
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"last_sign_in_method"`)
+
+		user, err := userRepository.FindUserByEmail(context.Background(), "passkey-only@email.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, user.WebauthnCredentials, 1)
+	})
+}
+
+func TestWebAuthnCredentialController_BeginRegistration(t *testing.T) {
+	webAuthnAPI, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "PasskeyDemo",
+		RPID: "localhost",
+		RPOrigins: []string{"http://localhost:9044"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webauthnCredentialController := &WebAuthnCredentialController{
+		WebAuthnAPI: webAuthnAPI,
+		UserRepository: userRepository,
+		WebAuthnSession: pkg.WebAuthnSession{Store: memoryStore(t), Config: pkg.NewSessionConfig()},
+		UserSession: userSession,
+	}
+
+	t.Run("signup does not create the user", func(t *testing.T) {
+		req := httptest.NewRequest(echo.POST, "/register/begin?context=signup", strings.NewReader(`{"email":"pending@email.com"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		ctx := e.NewContext(req, rec)
+
+		assert.NoError(t, webauthnCredentialController.BeginRegistration()(ctx))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, pkg.CeremonyRegistration, rec.Result().Cookies()[0].Name)
+
+		_, err := userRepository.FindUserByEmail(context.Background(), "pending@email.com")
+		assert.Error(t, err)
+	})
+
+	t.Run("existing account", func(t *testing.T) {
+		req := httptest.NewRequest(echo.POST, "/register/begin?context=signup", strings.NewReader(`{"email":"existing@email.com"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		ctx := e.NewContext(req, rec)
+
+		assert.NoError(t, webauthnCredentialController.BeginRegistration()(ctx))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+// conditionalCreateResponse is what the browser sends after a conditional
+// create: "none" attestation, and the user present flag only when asked for
+func conditionalCreateResponse(t *testing.T, challenge string, userPresent bool) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := webauthncbor.Marshal(map[int]any{1: 2, 3: -7, -1: 1, -2: key.X.FillBytes(make([]byte, 32)), -3: key.Y.FillBytes(make([]byte, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	flags := byte(0x40) // attested credential data
+	if userPresent {
+		flags |= 0x01
+	}
+	authData := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(credentialID)))
+	authData = append(append(authData, credentialID...), publicKey...)
+
+	attestationObject, err := webauthncbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": authData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientData, _ := json.Marshal(map[string]string{"type": "webauthn.create", "challenge": challenge, "origin": "http://localhost:9044"})
+
+	encode := base64.RawURLEncoding.EncodeToString
+	body, _ := json.Marshal(map[string]any{
+		"id":    encode(credentialID),
+		"rawId": encode(credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData),
+			"attestationObject": encode(attestationObject),
+		},
+	})
+	return string(body)
+}
+
+func TestWebAuthnCredentialController_Upgrade(t *testing.T) {
+	webAuthnAPI, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "PasskeyDemo",
+		RPID: "localhost",
+		RPOrigins: []string{"http://localhost:9044"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webauthnCredentialController := &WebAuthnCredentialController{
+		WebAuthnAPI: webAuthnAPI,
+		UserRepository: userRepository,
+		WebAuthnSession: pkg.WebAuthnSession{Store: memoryStore(t), Config: pkg.NewSessionConfig()},
+		UserSession: userSession,
+	}
+
+	user, err := userRepository.CreateUser(context.Background(), "upgrade@email.com", "hash", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signIn := func(method string) *http.Cookie {
+		rec := httptest.NewRecorder()
+		if err := userSession.Create(e.NewContext(httptest.NewRequest(echo.POST, "/login", nil), rec), user.ID, method); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Result().Cookies()[0]
+	}
+	// begin returns the challenge of the options and the ceremony cookie
+	begin := func(t *testing.T, auth *http.Cookie) (string, *http.Cookie) {
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, httptest.NewRequest(echo.POST, "/register/begin?context=upgrade", nil), rec, auth)
+		assert.NoError(t, webauthnCredentialController.BeginRegistration()(ctx))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var options struct {
+			PublicKey struct {
+				Challenge string `json:"challenge"`
+			} `json:"publicKey"`
+			Mediation string `json:"mediation"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+		assert.Equal(t, pkg.MediationConditional, options.Mediation)
+		return options.PublicKey.Challenge, rec.Result().Cookies()[0]
+	}
+	finish := func(t *testing.T, auth *http.Cookie, ceremony *http.Cookie, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/register/finish", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.AddCookie(ceremony)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, webauthnCredentialController.FinishRegistration()(authenticatedContext(t, req, rec, auth)))
+		return rec
+	}
+
+	t.Run("only right after a password sign in", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, httptest.NewRequest(echo.POST, "/register/begin?context=upgrade", nil), rec, signIn(pkg.AuthMethodPasskey))
+		assert.NoError(t, webauthnCredentialController.BeginRegistration()(ctx))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("not after re-authenticating later in the session", func(t *testing.T) {
+		auth := signIn(pkg.AuthMethodPassword)
+		session, err := userSession.Get(context.Background(), auth.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// signed in an hour ago, just confirmed the password for another action
+		session.CreatedAt = time.Now().Add(-time.Hour)
+		session.VerifiedAt = time.Now()
+		data, err := json.Marshal(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, userSession.Store.Set(context.Background(), "session:"+auth.Value, data, time.Hour))
+
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, httptest.NewRequest(echo.POST, "/register/begin?context=upgrade", nil), rec, auth)
+		assert.NoError(t, webauthnCredentialController.BeginRegistration()(ctx))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("a normal registration still needs the user", func(t *testing.T) {
+		auth := signIn(pkg.AuthMethodPassword)
+		rec := httptest.NewRecorder()
+		ctx := authenticatedContext(t, httptest.NewRequest(echo.POST, "/register/begin?context=normal", nil), rec, auth)
+		assert.NoError(t, webauthnCredentialController.BeginRegistration()(ctx))
+		var options struct {
+			PublicKey struct {
+				Challenge string `json:"challenge"`
+			} `json:"publicKey"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+
+		rec = finish(t, auth, rec.Result().Cookies()[0], conditionalCreateResponse(t, options.PublicKey.Challenge, false))
+		assert.NotEqual(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("another challenge", func(t *testing.T) {
+		auth := signIn(pkg.AuthMethodPassword)
+		_, ceremony := begin(t, auth)
+		rec := finish(t, auth, ceremony, conditionalCreateResponse(t, base64.RawURLEncoding.EncodeToString([]byte("another challenge")), false))
+		assert.NotEqual(t, http.StatusOK, rec.Code)
+
+		upgraded, err := userRepository.FindUserByEmail(context.Background(), "upgrade@email.com")
+		assert.NoError(t, err)
+		assert.Nil(t, upgraded.PasskeyUpgradedAt)
+	})
+
+	t.Run("the passkey is created without a prompt", func(t *testing.T) {
+		auth := signIn(pkg.AuthMethodPassword)
+		challenge, ceremony := begin(t, auth)
+		rec := finish(t, auth, ceremony, conditionalCreateResponse(t, challenge, false))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		upgraded, err := userRepository.FindUserByEmail(context.Background(), "upgrade@email.com")
+		assert.NoError(t, err)
+		assert.Len(t, upgraded.WebauthnCredentials, 1)
+		assert.NotNil(t, upgraded.PasskeyUpgradedAt)
+	})
+}
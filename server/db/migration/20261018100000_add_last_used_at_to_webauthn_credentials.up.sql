@@ -0,0 +1 @@
+ALTER TABLE webauthn_credentials ADD COLUMN last_used_at TIMESTAMP;
@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN has_password BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Accounts created through passkey signup got a random password nobody knows.
+-- They cannot be told apart from password accounts that added a passkey later,
+-- so every account with a passkey is treated as passwordless until it sets one
+-- or signs in with its password, which sets the flag back.
+UPDATE users SET has_password = FALSE
+WHERE id IN (SELECT user_id FROM webauthn_credentials);
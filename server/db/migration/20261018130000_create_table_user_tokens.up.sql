@@ -0,0 +1,11 @@
+CREATE TABLE user_tokens (
+  id UUID NOT NULL PRIMARY KEY,
+  user_id UUID NOT NULL,
+  purpose VARCHAR(32) NOT NULL,
+  token_hash VARCHAR(64) NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  consumed_at TIMESTAMP,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX user_tokens_token_hash_idx ON user_tokens (token_hash);
@@ -0,0 +1,2 @@
+ALTER TABLE user_tokens DROP COLUMN email;
+ALTER TABLE users DROP COLUMN email_verified_at;
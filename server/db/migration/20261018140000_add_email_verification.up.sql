@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+-- email change tokens carry the new address until it is confirmed
+ALTER TABLE user_tokens ADD COLUMN email VARCHAR(255);
@@ -0,0 +1,9 @@
+CREATE TABLE totp_credentials (
+  user_id UUID NOT NULL PRIMARY KEY,
+  -- AES-GCM encrypted base32 secret
+  secret VARCHAR(255) NOT NULL,
+  confirmed_at TIMESTAMP,
+  -- the last accepted time step, codes of this or earlier steps are rejected
+  last_used_step BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
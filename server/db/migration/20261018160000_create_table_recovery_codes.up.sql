@@ -0,0 +1,12 @@
+CREATE TABLE recovery_codes (
+  id UUID NOT NULL PRIMARY KEY,
+  user_id UUID NOT NULL,
+  -- the first group of the code, stored in plain text to find the row to check
+  selector VARCHAR(16) NOT NULL,
+  -- argon2id hash of the rest of the code
+  code_hash VARCHAR(255) NOT NULL,
+  used_at TIMESTAMP,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX recovery_codes_user_id_selector_idx ON recovery_codes (user_id, selector);
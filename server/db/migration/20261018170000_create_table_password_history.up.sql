@@ -0,0 +1,9 @@
+CREATE TABLE password_history (
+  id UUID NOT NULL PRIMARY KEY,
+  user_id UUID NOT NULL,
+  -- hash of a password the user had before, to refuse its reuse
+  password_hash VARCHAR(255) NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX password_history_user_id_idx ON password_history (user_id, created_at);
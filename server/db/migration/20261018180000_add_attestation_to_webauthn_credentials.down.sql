@@ -0,0 +1,3 @@
+ALTER TABLE webauthn_credentials DROP COLUMN attestation;
+ALTER TABLE webauthn_credentials DROP COLUMN authenticator_status;
+ALTER TABLE webauthn_credentials DROP COLUMN attestation_verified;
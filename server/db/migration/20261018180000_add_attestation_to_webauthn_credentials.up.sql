@@ -0,0 +1,3 @@
+ALTER TABLE webauthn_credentials ADD COLUMN attestation_verified BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE webauthn_credentials ADD COLUMN authenticator_status VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE webauthn_credentials ADD COLUMN attestation JSONB NOT NULL DEFAULT '{}';
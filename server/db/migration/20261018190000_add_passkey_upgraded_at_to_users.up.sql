@@ -0,0 +1,2 @@
+-- set when the user got their first passkey through the automatic upgrade after a password sign in
+ALTER TABLE users ADD COLUMN passkey_upgraded_at TIMESTAMP;
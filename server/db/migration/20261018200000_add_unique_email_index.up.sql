@@ -0,0 +1,3 @@
+-- the existence checks before inserts race, the index has the final say.
+-- Addresses that only differ in case have to be merged by hand first.
+CREATE UNIQUE INDEX users_email_lower_key ON users (lower(email));
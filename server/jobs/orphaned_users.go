@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/baala3/passkeys/repository"
+)
+
+const (
+	orphanedUserCleanupInterval = time.Hour
+	// signups used to create the user before the ceremony, anything younger
+	// than this might still be a registration in progress
+	orphanedUserGracePeriod = 24 * time.Hour
+)
+
+// OrphanedUserCleanup deletes accounts left behind by abandoned passkey signups.
+// New signups no longer create users before the passkey exists, so it only
+// catches accounts created by older versions. Orphans from before users had a
+// has_password column cannot be told apart from password accounts and are
+// left alone.
+type OrphanedUserCleanup struct {
+	UserRepository repository.UserRepository
+}
+
+// Start runs the cleanup now and then periodically, it never returns
+func (j *OrphanedUserCleanup) Start() {
+	ticker := time.NewTicker(orphanedUserCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := j.Run(context.Background()); err != nil {
+			log.Printf("failed to delete orphaned users: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (j *OrphanedUserCleanup) Run(ctx context.Context) (int64, error) {
+	deleted, err := j.UserRepository.DeleteOrphanedUsers(ctx, time.Now().Add(-orphanedUserGracePeriod))
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		log.Printf("deleted %d orphaned users", deleted)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,64 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/baala3/passkeys/db"
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/baala3/passkeys/repository"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanedUserCleanup(t *testing.T) {
+	database := db.GetTestDB()
+	defer database.Close()
+	userRepository := repository.UserRepository{DB: database}
+	ctx := context.Background()
+
+	insert := func(email string, hasPassword bool, createdAt time.Time) *model.User {
+		user := &model.User{ID: uuid.New(), Email: email, PasswordHash: "hash", HasPassword: hasPassword, CreatedAt: createdAt, UpdatedAt: createdAt}
+		if _, err := database.NewInsert().Model(user).Exec(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	old := time.Now().Add(-48 * time.Hour).UTC()
+	longAgo := time.Now().Add(-365 * 24 * time.Hour).UTC()
+
+	orphan := insert("orphan@email.com", false, old)
+	recent := insert("recent@email.com", false, time.Now().UTC())
+	password := insert("password@email.com", true, old)
+	passkey := insert("passkey@email.com", false, old)
+	// might be a legacy orphan, but just as well a password account nobody used in a while
+	unused := insert("unused@email.com", true, longAgo)
+	token := &model.UserToken{ID: uuid.New(), UserID: orphan.ID, Purpose: model.TokenPurposeEmailVerification, TokenHash: "hash", ExpiresAt: old, CreatedAt: old}
+	if _, err := database.NewInsert().Model(token).Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	credential := &webauthn.Credential{ID: []byte("credential"), PublicKey: []byte("public-key")}
+	if err := userRepository.AddWebauthnCredential(ctx, passkey.ID, credential, "Passkey", pkg.AuthenticatorAttestation{}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := OrphanedUserCleanup{UserRepository: userRepository}
+	deleted, err := job.Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	_, err = userRepository.FindUserByEmail(ctx, orphan.Email)
+	assert.Error(t, err)
+	// rows of the orphan go with it, there are no foreign keys to cascade
+	count, err := database.NewSelect().Model((*model.UserToken)(nil)).Where("user_id = ?", orphan.ID).Count(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	for _, user := range []*model.User{recent, password, passkey, unused} {
+		_, err := userRepository.FindUserByEmail(ctx, user.Email)
+		assert.NoError(t, err, user.Email)
+	}
+}
@@ -1,69 +1,92 @@
 package middleware
 
 import (
-	"context"
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/baala3/passkeys/pkg"
 	"github.com/labstack/echo/v4"
-	"github.com/redis/go-redis/v9"
 )
 
-// ConditionalAuth allows passkey-signup without authentication, otherwise applies Auth middleware
-func ConditionalAuth(next echo.HandlerFunc) echo.HandlerFunc {
+// AuthMiddleware guards routes based on the auth cookie. It shares the
+// UserSession (and therefore the session store) with the controllers.
+type AuthMiddleware struct {
+	UserSession pkg.UserSession
+}
+
+// ConditionalAuth allows passkey-signup without authentication, otherwise applies Auth middleware.
+// Restricted sessions are let through, they need the passkey ceremonies to enroll a new passkey.
+func (am *AuthMiddleware) ConditionalAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		context := c.QueryParam("context")
 		switch context {
 		case "signup", "signin":
 			return next(c)
 		default:
-			return Auth(next)(c)
+			return am.AllowRestricted(next)(c)
 		}
 	}
 }
 
 // Auth middleware ensures user is authenticated
-func Auth(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		redisClient := pkg.GetRedisClient()
-		if redisClient == nil {
-			return ctx.Redirect(http.StatusFound, "/")
-		}
+func (am *AuthMiddleware) Auth(next echo.HandlerFunc) echo.HandlerFunc {
+	return am.auth(next, false)
+}
+
+// AllowRestricted is Auth for the few routes a restricted recovery session may use
+func (am *AuthMiddleware) AllowRestricted(next echo.HandlerFunc) echo.HandlerFunc {
+	return am.auth(next, true)
+}
 
+func (am *AuthMiddleware) auth(next echo.HandlerFunc, allowRestricted bool) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
 		cookie, err := ctx.Cookie("auth")
 		if err != nil {
 			return ctx.Redirect(http.StatusFound, "/")
 		}
 
-		sessionID := cookie.Value
-		userID, err := redisClient.Get(context.Background(), sessionID).Result()
-		if err == redis.Nil {
+		session, err := am.UserSession.Get(ctx.Request().Context(), cookie.Value)
+		if err != nil || session.MFAPending {
 			return ctx.Redirect(http.StatusFound, "/")
 		}
+		if session.Restricted && !allowRestricted {
+			// pages send the user to enroll a passkey, API calls get told why they failed
+			if strings.Contains(ctx.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+				return ctx.Redirect(http.StatusFound, "/passkeys?prompt=recovery")
+			}
+			return pkg.SendErrorCode(ctx, errors.New("Please add a new passkey first."), http.StatusForbidden, pkg.ErrorCodePasskeyRequired)
+		}
+		_ = am.UserSession.Touch(ctx.Request().Context(), session)
 
-		if err != nil {
-			return ctx.Redirect(http.StatusFound, "/")
+		// Store userID and session in context for later use
+		ctx.Set("userID", session.UserID.String())
+		ctx.Set("session", session)
+		return next(ctx)
+	}
+}
+
+// RequireRecentAuth guards sensitive actions behind a fresh passkey or password
+// confirmation. It has to run after Auth.
+func (am *AuthMiddleware) RequireRecentAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		session, ok := ctx.Get("session").(*pkg.Session)
+		if !ok || !session.RecentlyVerified(am.UserSession.Config.ReauthMaxAge) {
+			return pkg.SendErrorCode(ctx, errors.New("Please confirm it's you to continue."), http.StatusForbidden, pkg.ErrorCodeReauthRequired)
 		}
-		// // Store userID in context for later use
-		ctx.Set("userID", userID)
 		return next(ctx)
 	}
 }
 
 // NoAuth ensures the user is NOT authenticated
-func NoAuth(next echo.HandlerFunc) echo.HandlerFunc {
+func (am *AuthMiddleware) NoAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
-		redisClient := pkg.GetRedisClient()
-		if redisClient == nil {
-			return next(ctx)
-		}
 		cookie, err := ctx.Cookie("auth")
 		if err != nil {
 			return next(ctx)
 		}
-		sessionID := cookie.Value
-		userID, err := redisClient.Get(context.Background(), sessionID).Result()
-		if err == redis.Nil || err != nil || userID == "" {
+		session, err := am.UserSession.Get(ctx.Request().Context(), cookie.Value)
+		if err != nil || session.MFAPending {
 			return next(ctx)
 		}
 		return ctx.Redirect(http.StatusFound, "/home")
@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// PasswordHistory is the hash of a password the user replaced
+type PasswordHistory struct {
+	bun.BaseModel `bun:"table:password_history"`
+
+	ID           uuid.UUID `json:"id" bun:"id,pk"`
+	UserID       uuid.UUID `json:"user_id" bun:"user_id"`
+	PasswordHash string    `json:"-" bun:"password_hash"`
+	CreatedAt    time.Time `json:"created_at" bun:"created_at"`
+}
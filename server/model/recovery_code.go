@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RecoveryCode is a one time code to get back into an account without a passkey
+type RecoveryCode struct {
+	ID        uuid.UUID  `json:"id" bun:"id,pk"`
+	UserID    uuid.UUID  `json:"user_id" bun:"user_id"`
+	Selector  string     `json:"-" bun:"selector"`
+	CodeHash  string     `json:"-" bun:"code_hash"`
+	UsedAt    *time.Time `json:"used_at" bun:"used_at"`
+	CreatedAt time.Time  `json:"created_at" bun:"created_at"`
+}
@@ -0,0 +1,21 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TOTPCredential is the authenticator app of a user. It only counts as a second
+// factor once ConfirmedAt is set, i.e. the user entered a first valid code.
+type TOTPCredential struct {
+	UserID       uuid.UUID  `json:"-" bun:"user_id,pk"`
+	Secret       string     `json:"-" bun:"secret"`
+	ConfirmedAt  *time.Time `json:"confirmed_at" bun:"confirmed_at"`
+	LastUsedStep int64      `json:"-" bun:"last_used_step"`
+	CreatedAt    time.Time  `json:"created_at" bun:"created_at"`
+}
+
+func (c *TOTPCredential) Confirmed() bool {
+	return c != nil && c.ConfirmedAt != nil
+}
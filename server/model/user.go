@@ -1,6 +1,7 @@
 package model
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
@@ -14,6 +15,11 @@ type User struct {
 	ID uuid.UUID `json:"id" bun:"id,pk"`
 	Email string `json:"email" bun:"email"`
 	PasswordHash string `json:"-" bun:"password_hash,notnull"`
+	// HasPassword is false for passkey only accounts whose password hash is random
+	HasPassword bool `json:"has_password" bun:"has_password,notnull"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at" bun:"email_verified_at"`
+	// PasskeyUpgradedAt is when a passkey was added by the automatic upgrade after a password sign in
+	PasskeyUpgradedAt *time.Time `json:"passkey_upgraded_at" bun:"passkey_upgraded_at"`
 	WebauthnCredentials []WebauthnCredentials `json:"webauthn_credentials" bun:"rel:has-many,join:id=user_id"`
 	CreatedAt time.Time `json:"created_at" bun:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" bun:"updated_at"`
@@ -53,27 +59,60 @@ func (u *User) WebAuthnCredentials() []webauthn.Credential {
 			AttestationType: cred.AttestationType,
 			Transport: cred.Transport,
 			Flags: cred.Flags,
+			Authenticator: cred.Authenticator,
 		}
 	}
 	return credentials
 }
 
-func (u *User) GetWebAuthnCredentials() []pkg.WebAuthnCredentials {
+func (u *User) GetWebAuthnCredentials(providers *pkg.PasskeyProviderCatalog) []pkg.WebAuthnCredentials {
 	credentials := make([]pkg.WebAuthnCredentials, len(u.WebauthnCredentials))
-	if err := pkg.LoadAAGUIDs(); err != nil {
-		return nil
-	}
 	for i, cred := range u.WebauthnCredentials {
+		provider := providers.Provider(cred.Authenticator.AAGUID)
+		name := cred.Name
+		if name == "" {
+			// passkeys registered before nicknames existed
+			name = provider.Name
+		}
 		credentials[i] = pkg.WebAuthnCredentials{
-			PasskeyProvider: pkg.GetPasskeyProviderByAAGUID(cred.Authenticator.AAGUID),
+			PasskeyProvider: provider,
 			CredentialId: cred.CredentialID,
+			Name: name,
+			SignCount: cred.Authenticator.SignCount,
+			BackupEligible: cred.Flags.BackupEligible,
+			BackupState: cred.Flags.BackupState,
+			CloneWarning: cred.Authenticator.CloneWarning,
+			LastUsedAt: cred.LastUsedAt,
 			CreatedAt: cred.CreatedAt,
-			UpdatedAt: cred.UpdatedAt, // TODO: Add last used at
+			UpdatedAt: cred.UpdatedAt,
 		}
 	}
 	return credentials
 }
 
+// DefaultCredentialName names a new passkey after its provider, numbering it
+// when the user already has a passkey of that provider (e.g. "iCloud Keychain 2")
+func (u *User) DefaultCredentialName(provider pkg.PasskeyProvider) string {
+	name := provider.Name
+	if name == "" {
+		name = "Passkey"
+	}
+
+	taken := make(map[string]bool, len(u.WebauthnCredentials))
+	for _, cred := range u.WebauthnCredentials {
+		taken[cred.Name] = true
+	}
+	if !taken[name] {
+		return name
+	}
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s %d", name, i)
+		if !taken[candidate] {
+			return candidate
+		}
+	}
+}
+
 // Returns authenticators already registered to the user
 // to prevent multiple registrations of the same authenticator
 func (u *User) CredentialExcludeList() []protocol.CredentialDescriptor {
@@ -0,0 +1,29 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposeEmailChange       = "email_change"
+	TokenPurposeMagicLink         = "magic_link"
+	TokenPurposeAccountUnlock     = "account_unlock"
+)
+
+// UserToken is a single use token sent to the user, e.g. in a password reset
+// link. Only the SHA-256 hash of the token is stored.
+type UserToken struct {
+	ID      uuid.UUID `json:"id" bun:"id,pk"`
+	UserID  uuid.UUID `json:"user_id" bun:"user_id"`
+	Purpose string    `json:"purpose" bun:"purpose"`
+	// Email is the address the token was sent to, for email verification
+	Email      string     `json:"email" bun:"email,nullzero"`
+	TokenHash  string     `json:"-" bun:"token_hash"`
+	ExpiresAt  time.Time  `json:"expires_at" bun:"expires_at"`
+	ConsumedAt *time.Time `json:"consumed_at" bun:"consumed_at"`
+	CreatedAt  time.Time  `json:"created_at" bun:"created_at"`
+}
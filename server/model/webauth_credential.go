@@ -13,11 +13,20 @@ type WebauthnCredentials struct {
 	ID uuid.UUID `json:"id" bun:"id,pk"`
 	UserID uuid.UUID `json:"user_id" bun:"user_id"`
 	CredentialID []byte `json:"credential_id" bun:"credential_id"`
+	Name string `json:"name" bun:"name"`
 	PublicKey []byte `json:"public_key" bun:"public_key"`
 	AttestationType string `json:"attestation_type" bun:"attestation_type"`
 	Transport []protocol.AuthenticatorTransport `json:"transport" bun:"transport,array"`
 	Flags webauthn.CredentialFlags `json:"flags" bun:"flags"`
 	Authenticator webauthn.Authenticator `json:"authenticator" bun:"authenticator"`
+	// AttestationVerified is true when the attestation statement chained to a
+	// root of the FIDO Metadata Service, AuthenticatorStatus is the latest
+	// status it reported for the model at registration
+	AttestationVerified bool `json:"attestation_verified" bun:"attestation_verified"`
+	AuthenticatorStatus string `json:"authenticator_status" bun:"authenticator_status"`
+	// Attestation keeps the statement to check the credential against newer metadata
+	Attestation webauthn.CredentialAttestation `json:"-" bun:"attestation"`
+	LastUsedAt *time.Time `json:"last_used_at" bun:"last_used_at"`
 	CreatedAt time.Time `json:"created_at" bun:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" bun:"updated_at"`
 }
@@ -0,0 +1,68 @@
+// Command aaguidgen builds the AAGUID list embedded into the server from the
+// passkey-authenticator-aaguids submodule. It runs through go generate in
+// pkg and writes a file that is not checked in; without the submodule it
+// leaves the build to the small fallback list.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+type provider struct {
+	Name      string `json:"name"`
+	IconDark  string `json:"icon_dark"`
+	IconLight string `json:"icon_light"`
+}
+
+func main() {
+	in := flag.String("in", "", "aaguid.json of the community list")
+	out := flag.String("out", "", "file to write")
+	flag.Parse()
+
+	data, err := os.ReadFile(*in)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("%s is missing, run `git submodule update --init`; the fallback list is built in", *in)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	list, err := parse(data)
+	if err != nil {
+		log.Fatalf("invalid AAGUID list %s: %v", *in, err)
+	}
+	// map keys are written sorted, so the output only changes with the list
+	generated, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, append(generated, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d authenticators to %s", len(list), *out)
+}
+
+func parse(data []byte) (map[string]provider, error) {
+	var list map[string]provider
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for key, entry := range list {
+		if _, err := uuid.Parse(key); err != nil {
+			return nil, fmt.Errorf("invalid AAGUID %q: %w", key, err)
+		}
+		if entry.Name == "" {
+			return nil, fmt.Errorf("AAGUID %s has no name", key)
+		}
+	}
+	return list, nil
+}
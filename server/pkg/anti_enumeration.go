@@ -0,0 +1,42 @@
+package pkg
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// AntiEnumeration hides whether an email address has an account. When enabled
+// (ANTI_ENUMERATION=true) the login and signup endpoints answer the same for
+// known and unknown addresses, and only an email to the address tells its
+// owner that an account exists.
+type AntiEnumeration struct {
+	Enabled bool
+	Signer  Signer
+	Hasher  PasswordHasher
+}
+
+func NewAntiEnumeration(signer Signer, hasher PasswordHasher) AntiEnumeration {
+	return AntiEnumeration{
+		Enabled: getEnvBool("ANTI_ENUMERATION", false),
+		Signer:  signer,
+		Hasher:  hasher,
+	}
+}
+
+// DummyCompare takes as long as checking the password of an existing account
+func (a AntiEnumeration) DummyCompare(password string) {
+	a.Hasher.DummyVerify(password)
+}
+
+// FakeUserID and FakeCredentialID stand in for the account of an unknown
+// address. They are derived from the address, so asking twice gives the same
+// answer just like it does for a real account.
+func (a AntiEnumeration) FakeUserID(email string) uuid.UUID {
+	id, _ := uuid.FromBytes(a.Signer.MAC("fake_user:" + strings.ToLower(email))[:16])
+	return id
+}
+
+func (a AntiEnumeration) FakeCredentialID(email string) []byte {
+	return a.Signer.MAC("fake_credential:" + strings.ToLower(email))
+}
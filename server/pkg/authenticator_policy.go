@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// AuthenticatorPolicyError is a new passkey the policy does not accept. Code
+// tells the client which rule it broke, the message is meant for the user.
+type AuthenticatorPolicyError struct {
+	Code    string
+	Message string
+}
+
+func (e *AuthenticatorPolicyError) Error() string {
+	return e.Message
+}
+
+// BackupEligibility values of AuthenticatorPolicy: synced passkeys are backup eligible
+const (
+	BackupEligibilityAny       = "any"
+	BackupEligibilityRequired  = "required"
+	BackupEligibilityForbidden = "forbidden"
+)
+
+// AuthenticatorPolicy decides which authenticators may register a passkey.
+// Empty fields allow everything. The AAGUID and attestation type are reported
+// by the authenticator itself, so only together with RequireAttestation a
+// policy holds against a client that lies about them.
+type AuthenticatorPolicy struct {
+	AllowedAAGUIDs []uuid.UUID
+	DeniedAAGUIDs  []uuid.UUID
+	// AttestationTypes are the allowed attestation statement formats, e.g.
+	// "packed", "tpm", "apple" or "none"
+	AttestationTypes []string
+	// RequireAttestation accepts only statements verified against the FIDO
+	// metadata, see MetadataService
+	RequireAttestation bool
+	BackupEligibility  string
+	// MinCertification is the lowest accepted FIDO certification, e.g. FIDO_CERTIFIED_L1
+	MinCertification metadata.AuthenticatorStatus
+}
+
+// NewAuthenticatorPolicy reads the AUTHENTICATOR_* variables, lists are comma
+// separated. The rules about attestation fail to load unless attestation is
+// requested (WEBAUTHN_ATTESTATION) and verified (metadataConfig), otherwise
+// they would reject every authenticator or trust whatever it claims.
+func NewAuthenticatorPolicy(metadataConfig MetadataConfig) (AuthenticatorPolicy, error) {
+	allowed, err := parseAAGUIDs(os.Getenv("AUTHENTICATOR_ALLOWED_AAGUIDS"))
+	if err != nil {
+		return AuthenticatorPolicy{}, err
+	}
+	denied, err := parseAAGUIDs(os.Getenv("AUTHENTICATOR_DENIED_AAGUIDS"))
+	if err != nil {
+		return AuthenticatorPolicy{}, err
+	}
+
+	policy := AuthenticatorPolicy{
+		AllowedAAGUIDs:     allowed,
+		DeniedAAGUIDs:      denied,
+		AttestationTypes:   splitList(os.Getenv("AUTHENTICATOR_ATTESTATION_TYPES")),
+		RequireAttestation: getEnvBool("AUTHENTICATOR_REQUIRE_ATTESTATION", false),
+		BackupEligibility:  getEnvString("AUTHENTICATOR_BACKUP_ELIGIBILITY", BackupEligibilityAny),
+		MinCertification:   metadata.AuthenticatorStatus(os.Getenv("AUTHENTICATOR_MIN_CERTIFICATION")),
+	}
+
+	switch policy.BackupEligibility {
+	case BackupEligibilityAny, BackupEligibilityRequired, BackupEligibilityForbidden:
+	default:
+		return AuthenticatorPolicy{}, fmt.Errorf("invalid AUTHENTICATOR_BACKUP_ELIGIBILITY %q", policy.BackupEligibility)
+	}
+	if policy.MinCertification != "" && certificationLevels[policy.MinCertification] == 0 {
+		return AuthenticatorPolicy{}, fmt.Errorf("invalid AUTHENTICATOR_MIN_CERTIFICATION %q", policy.MinCertification)
+	}
+
+	if settings := policy.attestationSettings(); len(settings) > 0 {
+		joined := strings.Join(settings, ", ")
+		if NewAttestationConveyance() == protocol.PreferNoAttestation {
+			return AuthenticatorPolicy{}, fmt.Errorf("%s need WEBAUTHN_ATTESTATION to be indirect, direct or enterprise", joined)
+		}
+		if metadataConfig.Path == "" {
+			return AuthenticatorPolicy{}, fmt.Errorf("%s need a metadata BLOB in FIDO_MDS_FILE", joined)
+		}
+	}
+	return policy, nil
+}
+
+// attestationSettings names the configured rules that depend on attestation
+func (p AuthenticatorPolicy) attestationSettings() []string {
+	var settings []string
+	if p.RequireAttestation {
+		settings = append(settings, "AUTHENTICATOR_REQUIRE_ATTESTATION")
+	}
+	if len(p.AttestationTypes) > 0 {
+		settings = append(settings, "AUTHENTICATOR_ATTESTATION_TYPES")
+	}
+	if p.MinCertification != "" {
+		settings = append(settings, "AUTHENTICATOR_MIN_CERTIFICATION")
+	}
+	return settings
+}
+
+// Check evaluates a credential that passed FinishRegistration and returns an
+// *AuthenticatorPolicyError for the first rule it breaks
+func (p AuthenticatorPolicy) Check(credential *webauthn.Credential, attestation AuthenticatorAttestation) error {
+	aaguid, _ := uuid.FromBytes(credential.Authenticator.AAGUID)
+
+	if slices.Contains(p.DeniedAAGUIDs, aaguid) || (len(p.AllowedAAGUIDs) > 0 && !slices.Contains(p.AllowedAAGUIDs, aaguid)) {
+		return &AuthenticatorPolicyError{ErrorCodeAuthenticatorNotAllowed, "This authenticator is not allowed, please use one approved by your organization."}
+	}
+
+	if len(p.AttestationTypes) > 0 && !slices.Contains(p.AttestationTypes, credential.AttestationType) {
+		return &AuthenticatorPolicyError{ErrorCodeAttestationTypeNotAllowed, "This authenticator does not provide the required attestation."}
+	}
+
+	if p.RequireAttestation && !attestation.Verified {
+		return &AuthenticatorPolicyError{ErrorCodeAttestationRequired, "This authenticator could not be verified, please use a certified security key."}
+	}
+
+	switch {
+	case p.BackupEligibility == BackupEligibilityRequired && !credential.Flags.BackupEligible:
+		return &AuthenticatorPolicyError{ErrorCodeBackupEligibilityRequired, "Please use a passkey that is synced across your devices."}
+	case p.BackupEligibility == BackupEligibilityForbidden && credential.Flags.BackupEligible:
+		return &AuthenticatorPolicyError{ErrorCodeBackupEligibilityDenied, "Synced passkeys are not allowed, please use a device-bound passkey or security key."}
+	}
+
+	if p.MinCertification != "" && certificationLevels[attestation.Certification] < certificationLevels[p.MinCertification] {
+		return &AuthenticatorPolicyError{ErrorCodeCertificationRequired, "This authenticator does not meet the required FIDO certification level."}
+	}
+	return nil
+}
+
+func parseAAGUIDs(value string) ([]uuid.UUID, error) {
+	var aaguids []uuid.UUID
+	for _, item := range splitList(value) {
+		aaguid, err := uuid.Parse(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AAGUID %q: %w", item, err)
+		}
+		aaguids = append(aaguids, aaguid)
+	}
+	return aaguids, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
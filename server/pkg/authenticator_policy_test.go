@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func policyCode(err error) string {
+	if policyErr, ok := err.(*AuthenticatorPolicyError); ok {
+		return policyErr.Code
+	}
+	return ""
+}
+
+func TestAuthenticatorPolicy(t *testing.T) {
+	yubiKey, iCloud := uuid.New(), uuid.New()
+	credential := func(aaguid uuid.UUID, format string, backupEligible bool) *webauthn.Credential {
+		return &webauthn.Credential{
+			AttestationType: format,
+			Authenticator:   webauthn.Authenticator{AAGUID: aaguid[:]},
+			Flags:           webauthn.CredentialFlags{BackupEligible: backupEligible},
+		}
+	}
+	key := credential(yubiKey, "packed", false)
+	synced := credential(iCloud, "none", true)
+	verified := AuthenticatorAttestation{Verified: true, Certification: metadata.FidoCertifiedL2}
+
+	t.Run("empty policy allows everything", func(t *testing.T) {
+		assert.NoError(t, AuthenticatorPolicy{}.Check(key, AuthenticatorAttestation{}))
+		assert.NoError(t, AuthenticatorPolicy{}.Check(synced, AuthenticatorAttestation{}))
+	})
+
+	t.Run("AAGUID", func(t *testing.T) {
+		allowed := AuthenticatorPolicy{AllowedAAGUIDs: []uuid.UUID{yubiKey}}
+		assert.NoError(t, allowed.Check(key, verified))
+		assert.Equal(t, ErrorCodeAuthenticatorNotAllowed, policyCode(allowed.Check(synced, verified)))
+
+		denied := AuthenticatorPolicy{DeniedAAGUIDs: []uuid.UUID{iCloud}}
+		assert.NoError(t, denied.Check(key, verified))
+		assert.Equal(t, ErrorCodeAuthenticatorNotAllowed, policyCode(denied.Check(synced, verified)))
+
+		// denying wins over allowing
+		both := AuthenticatorPolicy{AllowedAAGUIDs: []uuid.UUID{yubiKey}, DeniedAAGUIDs: []uuid.UUID{yubiKey}}
+		assert.Equal(t, ErrorCodeAuthenticatorNotAllowed, policyCode(both.Check(key, verified)))
+	})
+
+	t.Run("attestation", func(t *testing.T) {
+		types := AuthenticatorPolicy{AttestationTypes: []string{string(protocol.AttestationFormatPacked)}}
+		assert.NoError(t, types.Check(key, AuthenticatorAttestation{}))
+		assert.Equal(t, ErrorCodeAttestationTypeNotAllowed, policyCode(types.Check(synced, AuthenticatorAttestation{})))
+
+		required := AuthenticatorPolicy{RequireAttestation: true}
+		assert.NoError(t, required.Check(key, verified))
+		assert.Equal(t, ErrorCodeAttestationRequired, policyCode(required.Check(key, AuthenticatorAttestation{})))
+	})
+
+	t.Run("backup eligibility", func(t *testing.T) {
+		required := AuthenticatorPolicy{BackupEligibility: BackupEligibilityRequired}
+		assert.NoError(t, required.Check(synced, verified))
+		assert.Equal(t, ErrorCodeBackupEligibilityRequired, policyCode(required.Check(key, verified)))
+
+		forbidden := AuthenticatorPolicy{BackupEligibility: BackupEligibilityForbidden}
+		assert.NoError(t, forbidden.Check(key, verified))
+		assert.Equal(t, ErrorCodeBackupEligibilityDenied, policyCode(forbidden.Check(synced, verified)))
+	})
+
+	t.Run("certification", func(t *testing.T) {
+		policy := AuthenticatorPolicy{MinCertification: metadata.FidoCertifiedL1plus}
+		assert.NoError(t, policy.Check(key, verified))
+		assert.Equal(t, ErrorCodeCertificationRequired, policyCode(policy.Check(key, AuthenticatorAttestation{Certification: metadata.FidoCertifiedL1})))
+		// models the metadata does not list have no certification
+		assert.Equal(t, ErrorCodeCertificationRequired, policyCode(policy.Check(key, AuthenticatorAttestation{})))
+	})
+}
+
+func TestNewAuthenticatorPolicy(t *testing.T) {
+	yubiKey := uuid.New()
+	t.Setenv("AUTHENTICATOR_ALLOWED_AAGUIDS", " "+yubiKey.String()+", ")
+	t.Setenv("AUTHENTICATOR_ATTESTATION_TYPES", "packed,tpm")
+	t.Setenv("AUTHENTICATOR_BACKUP_ELIGIBILITY", "forbidden")
+	t.Setenv("AUTHENTICATOR_MIN_CERTIFICATION", "FIDO_CERTIFIED_L2")
+	t.Setenv("WEBAUTHN_ATTESTATION", "direct")
+	metadataConfig := MetadataConfig{Path: "mds3.jwt"}
+
+	policy, err := NewAuthenticatorPolicy(metadataConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{yubiKey}, policy.AllowedAAGUIDs)
+	assert.Equal(t, []string{"packed", "tpm"}, policy.AttestationTypes)
+	assert.Equal(t, BackupEligibilityForbidden, policy.BackupEligibility)
+	assert.Equal(t, metadata.FidoCertifiedL2, policy.MinCertification)
+
+	t.Setenv("AUTHENTICATOR_DENIED_AAGUIDS", "not-an-aaguid")
+	_, err = NewAuthenticatorPolicy(metadataConfig)
+	assert.Error(t, err)
+
+	t.Setenv("AUTHENTICATOR_DENIED_AAGUIDS", "")
+	t.Setenv("AUTHENTICATOR_MIN_CERTIFICATION", "REVOKED")
+	_, err = NewAuthenticatorPolicy(metadataConfig)
+	assert.Error(t, err)
+}
+
+func TestNewAuthenticatorPolicy_NeedsAttestation(t *testing.T) {
+	metadataConfig := MetadataConfig{Path: "mds3.jwt"}
+	for name, value := range map[string]string{
+		"AUTHENTICATOR_REQUIRE_ATTESTATION": "true",
+		"AUTHENTICATOR_ATTESTATION_TYPES":   "packed",
+		"AUTHENTICATOR_MIN_CERTIFICATION":   "FIDO_CERTIFIED_L1",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+
+			t.Setenv("WEBAUTHN_ATTESTATION", "none")
+			_, err := NewAuthenticatorPolicy(metadataConfig)
+			assert.ErrorContains(t, err, name+" need WEBAUTHN_ATTESTATION")
+
+			t.Setenv("WEBAUTHN_ATTESTATION", "direct")
+			_, err = NewAuthenticatorPolicy(MetadataConfig{})
+			assert.ErrorContains(t, err, name+" need a metadata BLOB")
+
+			_, err = NewAuthenticatorPolicy(metadataConfig)
+			assert.NoError(t, err)
+		})
+	}
+
+	// the rules that only look at the authenticator data work without attestation
+	t.Setenv("WEBAUTHN_ATTESTATION", "none")
+	t.Setenv("AUTHENTICATOR_BACKUP_ELIGIBILITY", "required")
+	_, err := NewAuthenticatorPolicy(MetadataConfig{})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const backgroundTimeout = time.Minute
+
+// Background runs work after the response was sent, e.g. emails about an
+// account, which must not make the response slower when the account exists.
+type Background struct {
+	wg *sync.WaitGroup
+}
+
+func NewBackground() Background {
+	return Background{wg: &sync.WaitGroup{}}
+}
+
+// Go runs fn detached from the request, what describes it in the error log
+func (b Background) Go(ctx echo.Context, what string, fn func(ctx context.Context) error) {
+	logger := ctx.Logger()
+	detached := context.WithoutCancel(ctx.Request().Context())
+
+	if b.wg != nil {
+		b.wg.Add(1)
+	}
+	go func() {
+		if b.wg != nil {
+			defer b.wg.Done()
+		}
+		ctx, cancel := context.WithTimeout(detached, backgroundTimeout)
+		defer cancel()
+
+		if err := fn(ctx); err != nil {
+			logger.Errorf("failed to %s: %v", what, err)
+		}
+	}()
+}
+
+// Wait blocks until all work started so far is done
+func (b Background) Wait() {
+	if b.wg != nil {
+		b.wg.Wait()
+	}
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// MediationConditional asks the browser to create the passkey without
+// prompting, e.g. the automatic passkey upgrade after a password sign in
+const MediationConditional = "conditional"
+
+// ConditionalCredentialCreation is the options of a conditional create, the
+// client passes mediation next to publicKey to navigator.credentials.create
+type ConditionalCredentialCreation struct {
+	*protocol.CredentialCreation
+	Mediation string `json:"mediation"`
+}
+
+// FinishConditionalRegistration is webauthn.FinishRegistration for a
+// conditional create. Browsers create the passkey without asking the user, so
+// the user present and verified flags may be unset: the password sign in just
+// before stands in for them. Everything else is verified like a registration.
+func FinishConditionalRegistration(api *webauthn.WebAuthn, user webauthn.User, session webauthn.SessionData, request *http.Request) (*webauthn.Credential, error) {
+	parsed, err := protocol.ParseCredentialCreationResponse(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(user.WebAuthnID(), session.UserID) {
+		return nil, protocol.ErrBadRequest.WithDetails("ID mismatch for User and Session")
+	}
+	if !session.Expires.IsZero() && session.Expires.Before(time.Now()) {
+		return nil, protocol.ErrBadRequest.WithDetails("Session has Expired")
+	}
+
+	config := api.Config
+	if err := parsed.Response.CollectedClientData.Verify(session.Challenge, protocol.CreateCeremony, config.RPOrigins, config.RPTopOrigins, config.RPTopOriginVerificationMode); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(parsed.Raw.AttestationResponse.ClientDataJSON)
+	clientDataHash := sum[:]
+
+	// AuthenticatorData.Verify without the user presence check
+	rpIDHash := sha256.Sum256([]byte(config.RPID))
+	if !bytes.Equal(parsed.Response.AttestationObject.AuthData.RPIDHash, rpIDHash[:]) {
+		return nil, protocol.ErrVerification.WithInfo("RP Hash mismatch")
+	}
+
+	if err := parsed.Response.AttestationObject.VerifyAttestation(clientDataHash, config.MDS); err != nil {
+		return nil, err
+	}
+	return webauthn.NewCredential(clientDataHash, parsed)
+}
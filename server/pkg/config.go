@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NewIPExtractor decides which client IP rate limits and sessions see. Forwarded
+// headers are only trusted when TRUST_PROXY says a proxy sets them ("xff" or
+// "x-real-ip"), otherwise any client could pick its own IP.
+func NewIPExtractor() echo.IPExtractor {
+	switch os.Getenv("TRUST_PROXY") {
+	case "xff":
+		return echo.ExtractIPFromXFFHeader()
+	case "x-real-ip":
+		return echo.ExtractIPFromRealIPHeader()
+	default:
+		return echo.ExtractIPDirect()
+	}
+}
+
+// getEnvDuration reads a duration such as "30m" or "720h" from the environment
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvString(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
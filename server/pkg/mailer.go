@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails to users
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// NewMailer picks the implementation from MAILER ("smtp" or "log", the default).
+// The log mailer writes to MAILER_FILE when set and to stdout otherwise.
+func NewMailer() Mailer {
+	from := getEnvString("MAILER_FROM", "no-reply@localhost")
+	if os.Getenv("MAILER") == "smtp" {
+		return &SMTPMailer{
+			Addr:     net.JoinHostPort(os.Getenv("SMTP_HOST"), getEnvString("SMTP_PORT", "587")),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	}
+
+	if path := os.Getenv("MAILER_FILE"); path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.Fatalf("failed to open mailer file: %v", err)
+		}
+		return &LogMailer{Writer: file, From: from}
+	}
+	return &LogMailer{Writer: os.Stdout, From: from}
+}
+
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	if err := smtp.SendMail(m.Addr, auth, m.From, []string{message.To}, formatMessage(m.From, message)); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
+
+// LogMailer writes emails to a writer instead of sending them, for local development
+type LogMailer struct {
+	mu     sync.Mutex
+	Writer io.Writer
+	From   string
+}
+
+func (m *LogMailer) Send(ctx context.Context, message Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := fmt.Fprintf(m.Writer, "%s\n", formatMessage(m.From, message)); err != nil {
+		return fmt.Errorf("failed to write email: %v", err)
+	}
+	return nil
+}
+
+func formatMessage(from string, message Message) []byte {
+	headers := []string{
+		"From: " + from,
+		"To: " + message.To,
+		"Subject: " + message.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + message.Body + "\r\n")
+}
@@ -0,0 +1,402 @@
+package pkg
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/metadata/providers/memory"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// MetadataConfig points to a FIDO Metadata Service (MDS3) BLOB on disk. The
+// BLOB is downloaded out of band, e.g. by a cron job fetching
+// https://mds3.fidoalliance.org/, so registrations never wait for the network.
+type MetadataConfig struct {
+	// Path of the BLOB, without it attestation statements are only checked
+	// for their own signature
+	Path string
+	// RootCertificate is a PEM file with the trust anchor of the BLOB
+	// signature, the FIDO production root when empty
+	RootCertificate string
+	// Grace is how long the BLOB is still used after its nextUpdate date
+	Grace time.Duration
+	// RequireEntry rejects authenticators the BLOB does not list
+	RequireEntry bool
+	// ReloadInterval is how often Watch checks the file for changes, zero
+	// leaves reloading to SIGHUP
+	ReloadInterval time.Duration
+}
+
+func NewMetadataConfig() MetadataConfig {
+	return MetadataConfig{
+		Path:            os.Getenv("FIDO_MDS_FILE"),
+		RootCertificate: os.Getenv("FIDO_MDS_ROOT_CERT"),
+		Grace:           getEnvDuration("FIDO_MDS_GRACE", 0),
+		RequireEntry:    getEnvBool("FIDO_MDS_REQUIRE_ENTRY", false),
+		ReloadInterval:  getEnvDuration("FIDO_MDS_RELOAD_INTERVAL", time.Minute),
+	}
+}
+
+// MetadataService validates attestation statements during registration, see
+// webauthn.Config.MDS, and tells the status of an authenticator model. Once
+// the BLOB is past its nextUpdate date and Grace it lists no authenticators,
+// as if none was configured, until Watch loaded a newer one.
+type MetadataService struct {
+	Config MetadataConfig
+
+	mu       sync.RWMutex
+	provider metadata.Provider
+	expires  time.Time
+	modTime  time.Time
+	size     int64
+}
+
+// NewMetadataService loads the configured BLOB. It returns nil without a Path
+// and fails on a BLOB that is not signed by the trust anchor. An out of date
+// BLOB only logs a warning, the server starts and waits for a newer one.
+func NewMetadataService(config MetadataConfig) (*MetadataService, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+	service := &MetadataService{Config: config}
+	if err := service.Reload(); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// Reload reads Path again. On an error the service keeps what it has.
+func (s *MetadataService) Reload() error {
+	info, err := os.Stat(s.Config.Path)
+	if err != nil {
+		return err
+	}
+	provider, nextUpdate, err := loadMetadataProvider(s.Config)
+	if err != nil {
+		return err
+	}
+
+	// nextUpdate is a date, the BLOB is current until that day ends
+	expires := nextUpdate.AddDate(0, 0, 1).Add(s.Config.Grace)
+	if time.Now().After(expires) {
+		log.Printf("metadata BLOB %s is out of date, its next update was due %s; attestation is not verified until it is replaced",
+			s.Config.Path, nextUpdate.Format(time.DateOnly))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.provider = provider
+	s.expires = expires
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return nil
+}
+
+func loadMetadataProvider(config MetadataConfig) (metadata.Provider, time.Time, error) {
+	var options []metadata.DecoderOption
+	if config.RootCertificate != "" {
+		root, err := readRootCertificate(config.RootCertificate)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		options = append(options, metadata.WithRootCertificate(root))
+	}
+	// entries the library cannot parse are left out instead of failing the whole BLOB
+	options = append(options, metadata.WithIgnoreEntryParsingErrors())
+
+	decoder, err := metadata.NewDecoder(options...)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	blob, err := os.ReadFile(config.Path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// verifies the signature and the certificate chain up to the root
+	payload, err := decoder.DecodeBytes(blob)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid metadata BLOB %s: %w", config.Path, err)
+	}
+	mds, err := decoder.Parse(payload)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid metadata BLOB %s: %w", config.Path, err)
+	}
+
+	provider, err := memory.New(
+		memory.WithMetadata(mds.ToMap()),
+		memory.WithValidateEntry(config.RequireEntry),
+		// authenticators without an AAGUID, e.g. U2F keys, cannot be looked up
+		memory.WithValidateEntryPermitZeroAAGUID(!config.RequireEntry),
+		memory.WithValidateTrustAnchor(true),
+		memory.WithValidateStatus(true),
+		memory.WithValidateAttestationTypes(true),
+	)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return provider, mds.Parsed.NextUpdate, nil
+}
+
+// changed tells whether the file on disk differs from the loaded one
+func (s *MetadataService) changed() bool {
+	info, err := os.Stat(s.Config.Path)
+	if err != nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// Watch reloads the BLOB on SIGHUP and when the file changes, like
+// PasskeyProviderCatalog.Watch. It never returns, except without a service.
+func (s *MetadataService) Watch() {
+	if s == nil {
+		return
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if s.Config.ReloadInterval > 0 {
+		ticker := time.NewTicker(s.Config.ReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hangup:
+		case <-tick:
+			if !s.changed() {
+				continue
+			}
+		}
+		if err := s.Reload(); err != nil {
+			log.Printf("failed to reload the metadata BLOB: %v", err)
+			continue
+		}
+		log.Printf("reloaded the metadata BLOB from %s", s.Config.Path)
+	}
+}
+
+// current returns the loaded BLOB, nil once it is out of date
+func (s *MetadataService) current() metadata.Provider {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if time.Now().After(s.expires) {
+		return nil
+	}
+	return s.provider
+}
+
+// GetEntry implements metadata.Provider, an out of date BLOB lists nothing
+func (s *MetadataService) GetEntry(ctx context.Context, aaguid uuid.UUID) (*metadata.Entry, error) {
+	provider := s.current()
+	if provider == nil {
+		return nil, nil
+	}
+	return provider.GetEntry(ctx, aaguid)
+}
+
+// GetValidateEntry implements metadata.Provider. With RequireEntry an out of
+// date BLOB rejects every authenticator.
+func (s *MetadataService) GetValidateEntry(ctx context.Context) bool {
+	return s.Config.RequireEntry
+}
+
+func (s *MetadataService) GetValidateEntryPermitZeroAAGUID(ctx context.Context) bool {
+	return !s.Config.RequireEntry
+}
+
+func (s *MetadataService) GetValidateTrustAnchor(ctx context.Context) bool {
+	return true
+}
+
+func (s *MetadataService) GetValidateStatus(ctx context.Context) bool {
+	return true
+}
+
+func (s *MetadataService) GetValidateAttestationTypes(ctx context.Context) bool {
+	return true
+}
+
+func (s *MetadataService) ValidateStatusReports(ctx context.Context, reports []metadata.StatusReport) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.provider.ValidateStatusReports(ctx, reports)
+}
+
+// readRootCertificate returns the certificate of a PEM file in the base64 DER
+// form the decoder expects
+func readRootCertificate(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("%s does not contain a PEM certificate", path)
+	}
+	return base64.StdEncoding.EncodeToString(block.Bytes), nil
+}
+
+// Entry returns the metadata of the authenticator model, nil when it is not listed
+func (s *MetadataService) Entry(aaguid []byte) *metadata.Entry {
+	if s == nil {
+		return nil
+	}
+	id, err := uuid.FromBytes(aaguid)
+	if err != nil {
+		return nil
+	}
+	entry, _ := s.GetEntry(context.Background(), id)
+	return entry
+}
+
+// AuthenticatorAttestation is what the attestation statement of a new
+// credential proved about its authenticator
+type AuthenticatorAttestation struct {
+	// Verified is true when the statement chains to an attestation root the
+	// metadata lists for the authenticator model
+	Verified bool
+	// Status is the latest status report of the model, empty when it is not listed
+	Status metadata.AuthenticatorStatus
+	// Certification is the highest FIDO certification level the model reached
+	Certification metadata.AuthenticatorStatus
+}
+
+// Attest looks up a credential that passed FinishRegistration. Without
+// metadata nothing can be verified.
+func (s *MetadataService) Attest(credential *webauthn.Credential) AuthenticatorAttestation {
+	entry := s.Entry(credential.Authenticator.AAGUID)
+	if entry == nil {
+		return AuthenticatorAttestation{}
+	}
+	return AuthenticatorAttestation{
+		Verified:      chainsToRoot(credential, entry),
+		Status:        latestStatus(entry.StatusReports),
+		Certification: highestCertification(entry.StatusReports),
+	}
+}
+
+// chainsToRoot verifies the x5c chain of the attestation statement. Self and
+// "none" attestation have no chain and are never verified.
+func chainsToRoot(credential *webauthn.Credential, entry *metadata.Entry) bool {
+	if protocol.AttestationFormat(credential.AttestationType) == protocol.AttestationFormatNone {
+		return false
+	}
+
+	var object protocol.AttestationObject
+	if err := webauthncbor.Unmarshal(credential.Attestation.Object, &object); err != nil {
+		return false
+	}
+	x5c, ok := object.AttStatement["x5c"].([]any)
+	if !ok || len(x5c) == 0 {
+		return false
+	}
+
+	var chain []*x509.Certificate
+	for _, raw := range x5c {
+		der, ok := raw.([]byte)
+		if !ok {
+			return false
+		}
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return false
+		}
+		chain = append(chain, certificate)
+	}
+
+	options := entry.MetadataStatement.Verifier()
+	options.Intermediates = x509.NewCertPool()
+	for _, certificate := range chain[1:] {
+		options.Intermediates.AddCert(certificate)
+	}
+	// attestation certificates are not issued for any particular usage
+	options.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	_, err := chain[0].Verify(options)
+	return err == nil
+}
+
+// latestStatus returns the status of the most recent report
+func latestStatus(reports []metadata.StatusReport) metadata.AuthenticatorStatus {
+	if len(reports) == 0 {
+		return ""
+	}
+	sorted := append([]metadata.StatusReport(nil), reports...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].EffectiveDate.Before(sorted[j].EffectiveDate)
+	})
+	return sorted[len(sorted)-1].Status
+}
+
+// certificationLevels orders the FIDO certification statuses, the phased out
+// FIDO_CERTIFIED counts as level 1
+var certificationLevels = map[metadata.AuthenticatorStatus]int{
+	metadata.FidoCertified:       1,
+	metadata.FidoCertifiedL1:     1,
+	metadata.FidoCertifiedL1plus: 2,
+	metadata.FidoCertifiedL2:     3,
+	metadata.FidoCertifiedL2plus: 4,
+	metadata.FidoCertifiedL3:     5,
+	metadata.FidoCertifiedL3plus: 6,
+}
+
+func highestCertification(reports []metadata.StatusReport) metadata.AuthenticatorStatus {
+	var highest metadata.AuthenticatorStatus
+	for _, report := range reports {
+		level := certificationLevels[report.Status]
+		// on a tie the later report, e.g. FIDO_CERTIFIED_L1 replacing FIDO_CERTIFIED
+		if level > 0 && level >= certificationLevels[highest] {
+			highest = report.Status
+		}
+	}
+	return highest
+}
+
+// ErrAttestationRejected is a registration whose attestation statement did not
+// check out, e.g. an authenticator model with a compromised status
+var ErrAttestationRejected = errors.New("This authenticator cannot be registered, please use a different one.")
+
+// IsAttestationError tells a rejected attestation statement apart from other
+// failures of FinishRegistration
+func IsAttestationError(err error) bool {
+	var protocolErr *protocol.Error
+	if !errors.As(err, &protocolErr) {
+		return false
+	}
+	switch protocolErr.Type {
+	case protocol.ErrAttestation.Type, protocol.ErrInvalidAttestation.Type, protocol.ErrAttestationCertificate.Type:
+		return true
+	}
+	return false
+}
+
+// NewAttestationConveyance reads WEBAUTHN_ATTESTATION: "none" (the default),
+// "indirect", "direct" or "enterprise"
+func NewAttestationConveyance() protocol.ConveyancePreference {
+	switch preference := protocol.ConveyancePreference(os.Getenv("WEBAUTHN_ATTESTATION")); preference {
+	case protocol.PreferIndirectAttestation, protocol.PreferDirectAttestation, protocol.PreferEnterpriseAttestation:
+		return preference
+	default:
+		return protocol.PreferNoAttestation
+	}
+}
@@ -0,0 +1,271 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// issue creates a certificate signed by the CA, or a self signed root without one
+func issue(t *testing.T, name string, parent *testCA, isCA bool) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{certificate: certificate, key: key}
+}
+
+func (ca *testCA) base64() string {
+	return base64.StdEncoding.EncodeToString(ca.certificate.Raw)
+}
+
+func (ca *testCA) writePEM(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "root.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.certificate.Raw})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeBLOB signs an MDS3 BLOB listing one authenticator model
+func writeBLOB(t *testing.T, root *testCA, nextUpdate time.Time, aaguid uuid.UUID, attestationRoot *testCA, status metadata.AuthenticatorStatus) string {
+	intermediate := issue(t, "MDS intermediate", root, true)
+	signer := issue(t, "MDS signer", intermediate, false)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"legalHeader": "test",
+		"no":          1,
+		"nextUpdate":  nextUpdate.Format(time.DateOnly),
+		"entries": []any{map[string]any{
+			"aaguid": aaguid.String(),
+			"metadataStatement": map[string]any{
+				"aaguid":                      aaguid.String(),
+				"description":                 "Test Key",
+				"attestationTypes":            []string{"basic_full"},
+				"attestationRootCertificates": []string{attestationRoot.base64()},
+			},
+			"statusReports": []any{
+				map[string]any{"status": "FIDO_CERTIFIED", "effectiveDate": "2020-01-01"},
+				map[string]any{"status": string(status), "effectiveDate": "2024-01-01"},
+			},
+			"timeOfLastStatusChange": "2024-01-01",
+		}},
+	})
+	token.Header["x5c"] = []any{signer.base64(), intermediate.base64()}
+	signed, err := token.SignedString(signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "blob.jwt")
+	if err := os.WriteFile(path, []byte(signed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// packedCredential is a credential whose attestation statement carries the given chain
+func packedCredential(t *testing.T, aaguid uuid.UUID, chain ...*testCA) *webauthn.Credential {
+	var x5c [][]byte
+	for _, certificate := range chain {
+		x5c = append(x5c, certificate.certificate.Raw)
+	}
+	object, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "packed",
+		"authData": []byte{},
+		"attStmt":  map[string]any{"x5c": x5c},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &webauthn.Credential{
+		AttestationType: "packed",
+		Authenticator:   webauthn.Authenticator{AAGUID: aaguid[:]},
+		Attestation:     webauthn.CredentialAttestation{Object: object},
+	}
+}
+
+func TestMetadataService(t *testing.T) {
+	root := issue(t, "MDS root", nil, true)
+	attestationRoot := issue(t, "Attestation root", nil, true)
+	aaguid := uuid.New()
+	now := time.Now()
+	blob := writeBLOB(t, root, now.AddDate(0, 0, 10), aaguid, attestationRoot, metadata.FidoCertifiedL1)
+	config := MetadataConfig{Path: blob, RootCertificate: root.writePEM(t)}
+
+	t.Run("no BLOB configured", func(t *testing.T) {
+		service, err := NewMetadataService(MetadataConfig{})
+		assert.NoError(t, err)
+		assert.Nil(t, service)
+		assert.Equal(t, AuthenticatorAttestation{}, service.Attest(packedCredential(t, aaguid)))
+	})
+
+	t.Run("signed BLOB", func(t *testing.T) {
+		service, err := NewMetadataService(config)
+		assert.NoError(t, err)
+		assert.NotNil(t, service.Entry(aaguid[:]))
+		unlisted := uuid.New()
+		assert.Nil(t, service.Entry(unlisted[:]))
+	})
+
+	t.Run("signed by another root", func(t *testing.T) {
+		other := issue(t, "Other root", nil, true)
+		_, err := NewMetadataService(MetadataConfig{Path: blob, RootCertificate: other.writePEM(t)})
+		assert.Error(t, err)
+
+		// the production root did not sign it either
+		_, err = NewMetadataService(MetadataConfig{Path: blob})
+		assert.Error(t, err)
+	})
+
+	t.Run("freshness", func(t *testing.T) {
+		stale := config
+		stale.Path = writeBLOB(t, root, now.AddDate(0, 0, -2), aaguid, attestationRoot, metadata.FidoCertifiedL1)
+
+		// an out of date BLOB does not stop the server, it lists nothing
+		service, err := NewMetadataService(stale)
+		assert.NoError(t, err)
+		assert.Nil(t, service.Entry(aaguid[:]))
+		intermediate := issue(t, "Attestation intermediate", attestationRoot, true)
+		leaf := issue(t, "Attestation leaf", intermediate, false)
+		assert.Equal(t, AuthenticatorAttestation{}, service.Attest(packedCredential(t, aaguid, leaf, intermediate)))
+		assert.NoError(t, protocol.ValidateMetadata(context.Background(), aaguid, service))
+
+		// strict deployments reject every authenticator until it is replaced
+		strict := stale
+		strict.RequireEntry = true
+		service, err = NewMetadataService(strict)
+		assert.NoError(t, err)
+		assert.Error(t, protocol.ValidateMetadata(context.Background(), aaguid, service))
+
+		graced := stale
+		graced.Grace = 7 * 24 * time.Hour
+		service, err = NewMetadataService(graced)
+		assert.NoError(t, err)
+		assert.NotNil(t, service.Entry(aaguid[:]))
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "blob.jwt")
+		copyFile := func(t *testing.T, from string) {
+			data, err := os.ReadFile(from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		copyFile(t, writeBLOB(t, root, now.AddDate(0, 0, -2), aaguid, attestationRoot, metadata.FidoCertifiedL1))
+		reloaded := config
+		reloaded.Path = path
+		service, err := NewMetadataService(reloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, service.changed())
+		assert.Nil(t, service.Entry(aaguid[:]))
+
+		copyFile(t, blob)
+		// the copy may land within the timestamp granularity of the first one
+		if err := os.Chtimes(path, now, now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, service.changed())
+		assert.NoError(t, service.Reload())
+		assert.NotNil(t, service.Entry(aaguid[:]))
+
+		// a broken file keeps the BLOB loaded before
+		if err := os.WriteFile(path, []byte("broken"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		assert.Error(t, service.Reload())
+		assert.NotNil(t, service.Entry(aaguid[:]))
+	})
+
+	t.Run("attestation", func(t *testing.T) {
+		service, err := NewMetadataService(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		intermediate := issue(t, "Attestation intermediate", attestationRoot, true)
+		leaf := issue(t, "Attestation leaf", intermediate, false)
+
+		attestation := service.Attest(packedCredential(t, aaguid, leaf, intermediate))
+		assert.True(t, attestation.Verified)
+		// the latest report counts
+		assert.Equal(t, metadata.FidoCertifiedL1, attestation.Status)
+		assert.Equal(t, metadata.FidoCertifiedL1, attestation.Certification)
+
+		// a chain to some other root is not verified, the status is still known
+		forged := issue(t, "Forged leaf", issue(t, "Forged root", nil, true), false)
+		attestation = service.Attest(packedCredential(t, aaguid, forged))
+		assert.False(t, attestation.Verified)
+		assert.Equal(t, metadata.FidoCertifiedL1, attestation.Status)
+
+		// self attestation has no chain
+		assert.False(t, service.Attest(packedCredential(t, aaguid)).Verified)
+
+		// models the BLOB does not list
+		assert.Equal(t, AuthenticatorAttestation{}, service.Attest(packedCredential(t, uuid.New(), leaf, intermediate)))
+	})
+}
+
+func TestIsAttestationError(t *testing.T) {
+	assert.True(t, IsAttestationError(protocol.ErrInvalidAttestation.WithDetails("status REVOKED")))
+	assert.False(t, IsAttestationError(protocol.ErrChallengeMismatch))
+	assert.False(t, IsAttestationError(nil))
+}
+
+func TestNewAttestationConveyance(t *testing.T) {
+	t.Setenv("WEBAUTHN_ATTESTATION", "direct")
+	assert.Equal(t, protocol.PreferDirectAttestation, NewAttestationConveyance())
+
+	t.Setenv("WEBAUTHN_ATTESTATION", "bogus")
+	assert.Equal(t, protocol.PreferNoAttestation, NewAttestationConveyance())
+}
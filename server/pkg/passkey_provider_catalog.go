@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// embeddedAAGUIDFiles hold the AAGUID list built into the binary:
+// aaguid_generated.json is the community list, written by go generate from the
+// passkey-authenticator-aaguids submodule and not checked in, and
+// aaguid_fallback.json names a few common providers for builds without it.
+//
+//go:generate go run ./aaguidgen -in ../passkey-authenticator-aaguids/aaguid.json -out aaguid_generated.json
+//go:embed aaguid_*.json
+var embeddedAAGUIDFiles embed.FS
+
+func embeddedAAGUIDs() []byte {
+	if data, err := embeddedAAGUIDFiles.ReadFile("aaguid_generated.json"); err == nil {
+		return data
+	}
+	data, _ := embeddedAAGUIDFiles.ReadFile("aaguid_fallback.json")
+	return data
+}
+
+// PasskeyProviderCatalog names the password managers and devices passkeys are
+// stored in by their AAGUID. It is read from Path once and kept in memory,
+// falling back to the list built into the binary while the file is missing or
+// broken. Watch reloads it when the file changes or on SIGHUP.
+type PasskeyProviderCatalog struct {
+	Path string
+	// ReloadInterval is how often Watch checks the file for changes, zero
+	// leaves reloading to SIGHUP
+	ReloadInterval time.Duration
+
+	mu        sync.RWMutex
+	providers map[uuid.UUID]PasskeyProvider
+	modTime   time.Time
+	size      int64
+}
+
+func NewPasskeyProviderCatalog() (*PasskeyProviderCatalog, error) {
+	catalog := &PasskeyProviderCatalog{
+		Path:           getEnvString("AAGUID_FILE", "passkey-authenticator-aaguids/aaguid.json"),
+		ReloadInterval: getEnvDuration("AAGUID_RELOAD_INTERVAL", time.Minute),
+	}
+	providers, err := parseAAGUIDList(embeddedAAGUIDs())
+	if err != nil {
+		return nil, fmt.Errorf("invalid embedded AAGUID list: %w", err)
+	}
+	catalog.providers = providers
+
+	if err := catalog.Reload(); err != nil {
+		log.Printf("using the built-in AAGUID list: %v", err)
+	}
+	return catalog, nil
+}
+
+// Reload reads Path again. On an error the catalogue keeps what it has.
+func (c *PasskeyProviderCatalog) Reload() error {
+	if c.Path == "" {
+		return nil
+	}
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+	providers, err := parseAAGUIDList(data)
+	if err != nil {
+		return fmt.Errorf("invalid AAGUID list %s: %w", c.Path, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.providers = providers
+	c.modTime = info.ModTime()
+	c.size = info.Size()
+	return nil
+}
+
+// changed tells whether the file on disk differs from the loaded one
+func (c *PasskeyProviderCatalog) changed() bool {
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !info.ModTime().Equal(c.modTime) || info.Size() != c.size
+}
+
+// Watch reloads the catalogue on SIGHUP and when the file changes, it never returns
+func (c *PasskeyProviderCatalog) Watch() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if c.ReloadInterval > 0 {
+		ticker := time.NewTicker(c.ReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hangup:
+		case <-tick:
+			if !c.changed() {
+				continue
+			}
+		}
+		if err := c.Reload(); err != nil {
+			log.Printf("failed to reload the AAGUID list: %v", err)
+			continue
+		}
+		log.Printf("reloaded the AAGUID list from %s", c.Path)
+	}
+}
+
+// Lookup returns the provider of an AAGUID, false when it is not listed
+func (c *PasskeyProviderCatalog) Lookup(aaguid uuid.UUID) (PasskeyProvider, bool) {
+	if c == nil {
+		return PasskeyProvider{}, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	provider, ok := c.providers[aaguid]
+	return provider, ok
+}
+
+// Provider returns the provider of an authenticator's raw AAGUID, a blank
+// one when it is not listed
+func (c *PasskeyProviderCatalog) Provider(aaguid []byte) PasskeyProvider {
+	id, err := uuid.FromBytes(aaguid)
+	if err != nil {
+		return PasskeyProvider{}
+	}
+	provider, _ := c.Lookup(id)
+	return provider
+}
+
+func parseAAGUIDList(data []byte) (map[uuid.UUID]PasskeyProvider, error) {
+	var list map[string]PasskeyProvider
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	providers := make(map[uuid.UUID]PasskeyProvider, len(list))
+	for key, provider := range list {
+		aaguid, err := uuid.Parse(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AAGUID %q: %w", key, err)
+		}
+		providers[aaguid] = provider
+	}
+	return providers, nil
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasskeyProviderCatalog(t *testing.T) {
+	iCloud := uuid.MustParse("fbfc3007-154e-4ecc-8c0b-6e020557d7bd")
+	custom := uuid.New()
+	path := filepath.Join(t.TempDir(), "aaguid.json")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("falls back to the built-in list", func(t *testing.T) {
+		t.Setenv("AAGUID_FILE", filepath.Join(t.TempDir(), "missing.json"))
+		catalog, err := NewPasskeyProviderCatalog()
+		assert.NoError(t, err)
+		assert.Equal(t, "iCloud Keychain", catalog.Provider(iCloud[:]).Name)
+		assert.Equal(t, PasskeyProvider{}, catalog.Provider(custom[:]))
+		assert.Equal(t, PasskeyProvider{}, catalog.Provider([]byte("short")))
+	})
+
+	t.Run("reads the file", func(t *testing.T) {
+		write(`{"` + custom.String() + `": {"name": "Custom Key", "icon_dark": "data:dark", "icon_light": "data:light"}}`)
+		t.Setenv("AAGUID_FILE", path)
+		catalog, err := NewPasskeyProviderCatalog()
+		assert.NoError(t, err)
+
+		provider, ok := catalog.Lookup(custom)
+		assert.True(t, ok)
+		assert.Equal(t, PasskeyProvider{Name: "Custom Key", IconDark: "data:dark", IconLight: "data:light"}, provider)
+		// the file replaces the built-in list
+		_, ok = catalog.Lookup(iCloud)
+		assert.False(t, ok)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		write(`{"` + custom.String() + `": {"name": "Custom Key"}}`)
+		catalog := &PasskeyProviderCatalog{Path: path}
+		assert.NoError(t, catalog.Reload())
+		assert.False(t, catalog.changed())
+
+		write(`{"` + custom.String() + `": {"name": "Custom Key v2"}}`)
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, catalog.changed())
+		assert.NoError(t, catalog.Reload())
+		assert.Equal(t, "Custom Key v2", catalog.Provider(custom[:]).Name)
+
+		// a broken file keeps the loaded list
+		write(`{"not-an-aaguid": {}}`)
+		assert.Error(t, catalog.Reload())
+		write(`{`)
+		assert.Error(t, catalog.Reload())
+		assert.Equal(t, "Custom Key v2", catalog.Provider(custom[:]).Name)
+	})
+
+	t.Run("concurrent readers", func(t *testing.T) {
+		write(`{"` + custom.String() + `": {"name": "Custom Key"}}`)
+		catalog := &PasskeyProviderCatalog{Path: path}
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 100 {
+					catalog.Provider(custom[:])
+				}
+			}()
+		}
+		for range 10 {
+			assert.NoError(t, catalog.Reload())
+		}
+		wg.Wait()
+		assert.Equal(t, "Custom Key", catalog.Provider(custom[:]).Name)
+	})
+}
@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"strings"
+
+	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultPasswordHashParams are argon2id.DefaultParams with a fixed parallelism,
+// which argon2id sets to the number of CPUs of whichever machine is running
+var defaultPasswordHashParams = &argon2id.Params{
+	Memory:      argon2id.DefaultParams.Memory,
+	Iterations:  argon2id.DefaultParams.Iterations,
+	Parallelism: 2,
+	SaltLength:  argon2id.DefaultParams.SaltLength,
+	KeyLength:   argon2id.DefaultParams.KeyLength,
+}
+
+// PasswordHasher hashes passwords with argon2id using the configured
+// parameters. It also verifies hashes made with older parameters and bcrypt
+// hashes imported from the previous system, and tells when such a hash should
+// be replaced. Passwords are normalized (see NormalizePassword) before hashing.
+type PasswordHasher struct {
+	// Params defaults to defaultPasswordHashParams when nil
+	Params *argon2id.Params
+}
+
+// NewPasswordHasher reads the parameters from PASSWORD_HASH_* variables. Raising
+// them upgrades existing hashes as their users sign in.
+func NewPasswordHasher() PasswordHasher {
+	defaults := defaultPasswordHashParams
+	return PasswordHasher{Params: &argon2id.Params{
+		Memory:      uint32(getEnvInt("PASSWORD_HASH_MEMORY", int(defaults.Memory))),
+		Iterations:  uint32(getEnvInt("PASSWORD_HASH_ITERATIONS", int(defaults.Iterations))),
+		Parallelism: uint8(getEnvInt("PASSWORD_HASH_PARALLELISM", int(defaults.Parallelism))),
+		SaltLength:  uint32(getEnvInt("PASSWORD_HASH_SALT_LENGTH", int(defaults.SaltLength))),
+		KeyLength:   uint32(getEnvInt("PASSWORD_HASH_KEY_LENGTH", int(defaults.KeyLength))),
+	}}
+}
+
+func (h PasswordHasher) params() *argon2id.Params {
+	if h.Params == nil {
+		return defaultPasswordHashParams
+	}
+	return h.Params
+}
+
+func (h PasswordHasher) Hash(password string) (string, error) {
+	return argon2id.CreateHash(NormalizePassword(password), h.params())
+}
+
+// Verify checks the password against the hash. needsRehash is only reported
+// for a matching password, as the new hash can only be made from it.
+func (h PasswordHasher) Verify(password string, hash string) (match bool, needsRehash bool, err error) {
+	normalized := NormalizePassword(password)
+	match, needsRehash, err = h.verify(normalized, hash)
+	if err != nil || match || normalized == password {
+		return match, needsRehash, err
+	}
+
+	// hashes from before normalization was introduced
+	match, _, err = h.verify(password, hash)
+	return match, match, err
+}
+
+func (h PasswordHasher) verify(password string, hash string) (match bool, needsRehash bool, err error) {
+	if isBcryptHash(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+
+	match, params, err := argon2id.CheckHash(password, hash)
+	if err != nil || !match {
+		return false, false, err
+	}
+	return true, h.weaker(params), nil
+}
+
+// DummyVerify takes about as long as Verify, for when there is no hash to check
+func (h PasswordHasher) DummyVerify(password string) {
+	_, _ = h.Hash(password)
+}
+
+// weaker reports whether any of the params is below the current policy.
+// Parallelism only splits the work into lanes, it does not make a hash weaker,
+// so hashes made on machines with other settings are left alone.
+func (h PasswordHasher) weaker(params *argon2id.Params) bool {
+	current := h.params()
+	return params.Memory < current.Memory ||
+		params.Iterations < current.Iterations ||
+		params.SaltLength < current.SaltLength ||
+		params.KeyLength < current.KeyLength
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	weak := &argon2id.Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	strong := &argon2id.Params{Memory: 16 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	hasher := PasswordHasher{Params: strong}
+
+	t.Run("current parameters", func(t *testing.T) {
+		hash, err := hasher.Hash("password123")
+		assert.NoError(t, err)
+
+		match, needsRehash, err := hasher.Verify("password123", hash)
+		assert.NoError(t, err)
+		assert.True(t, match)
+		assert.False(t, needsRehash)
+
+		match, _, err = hasher.Verify("wrong", hash)
+		assert.NoError(t, err)
+		assert.False(t, match)
+	})
+
+	t.Run("weaker parameters", func(t *testing.T) {
+		hash, err := PasswordHasher{Params: weak}.Hash("password123")
+		assert.NoError(t, err)
+
+		match, needsRehash, err := hasher.Verify("password123", hash)
+		assert.NoError(t, err)
+		assert.True(t, match)
+		assert.True(t, needsRehash)
+
+		// the new hash can only be made from the right password
+		_, needsRehash, _ = hasher.Verify("wrong", hash)
+		assert.False(t, needsRehash)
+	})
+
+	t.Run("other parallelism", func(t *testing.T) {
+		hash, err := hasher.Hash("password123")
+		assert.NoError(t, err)
+
+		// a replica configured with more lanes does not rewrite the hash
+		params := *strong
+		params.Parallelism = 4
+		match, needsRehash, err := PasswordHasher{Params: &params}.Verify("password123", hash)
+		assert.NoError(t, err)
+		assert.True(t, match)
+		assert.False(t, needsRehash)
+	})
+
+	t.Run("legacy bcrypt", func(t *testing.T) {
+		hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+		assert.NoError(t, err)
+
+		match, needsRehash, err := hasher.Verify("password123", string(hash))
+		assert.NoError(t, err)
+		assert.True(t, match)
+		assert.True(t, needsRehash)
+
+		match, _, err = hasher.Verify("wrong", string(hash))
+		assert.NoError(t, err)
+		assert.False(t, match)
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		hash, err := PasswordHasher{}.Hash("password123")
+		assert.NoError(t, err)
+		// the same on every machine, whatever its number of CPUs
+		assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=1,p=2$"), hash)
+	})
+}
@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// PasswordPolicyError is a password the policy does not accept, its message is
+// meant for the user
+type PasswordPolicyError struct {
+	Message string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Message
+}
+
+// PasswordPolicy decides which new passwords are accepted. Lengths are counted
+// in characters of the normalized password.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// HistorySize is how many of the latest passwords, the current one
+	// included, cannot be used again
+	HistorySize int
+	Breached    BreachedPasswords
+}
+
+func NewPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:   getEnvInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:   getEnvInt("PASSWORD_MAX_LENGTH", 128),
+		HistorySize: getEnvInt("PASSWORD_HISTORY_SIZE", 5),
+		Breached:    BreachedPasswords{Path: os.Getenv("BREACHED_PASSWORDS_FILE")},
+	}
+}
+
+// NormalizePassword maps the different ways of typing the same characters to
+// one (NFKC), so a password keeps working across keyboards and platforms
+func NormalizePassword(password string) string {
+	return norm.NFKC.String(password)
+}
+
+// Check applies the rules that do not need the user's password history
+func (p PasswordPolicy) Check(password string, email string) error {
+	password = NormalizePassword(password)
+	length := utf8.RuneCountInString(password)
+
+	if length < p.MinLength {
+		return &PasswordPolicyError{fmt.Sprintf("Password must be at least %d characters", p.MinLength)}
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return &PasswordPolicyError{fmt.Sprintf("Password must be at most %d characters", p.MaxLength)}
+	}
+
+	lower := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if email != "" && (lower == strings.ToLower(email) || lower == localPart) {
+		return &PasswordPolicyError{"Password must not be your email address"}
+	}
+
+	breached, err := p.Breached.Contains(password)
+	if err != nil {
+		return err
+	}
+	if breached {
+		return &PasswordPolicyError{"This password has appeared in a data breach, please choose a different one"}
+	}
+	return nil
+}
+
+// PasswordErrorStatus maps errors of the password policy to a response status
+func PasswordErrorStatus(err error) int {
+	var policyErr *PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// maxBreachedLineLength bounds a line of the breached passwords file, a
+// SHA-1 hash and a count are far shorter
+const maxBreachedLineLength = 128
+
+// BreachedPasswords looks passwords up in a local copy of the Have I Been
+// Pwned SHA-1 list, ordered by hash: one "HASH:COUNT" line per password. The
+// file is searched in place, so even the full list needs no memory. Without a
+// Path every password passes.
+type BreachedPasswords struct {
+	Path string
+}
+
+func (b BreachedPasswords) Contains(password string) (bool, error) {
+	if b.Path == "" {
+		return false, nil
+	}
+
+	file, err := os.Open(b.Path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha1.Sum([]byte(password))
+	target := []byte(strings.ToUpper(hex.EncodeToString(sum[:])))
+
+	// binary search over byte offsets, the hash we look for always starts a line in [lo, hi)
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, err := lineStart(file, mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		line, next, err := readLine(file, start)
+		if err != nil {
+			return false, err
+		}
+		hash, _, _ := bytes.Cut(line, []byte(":"))
+		switch bytes.Compare(bytes.ToUpper(hash), target) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// lineStart returns the offset of the first line starting at or after offset
+func lineStart(file *os.File, offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, maxBreachedLineLength+1)
+	n, err := file.ReadAt(buf, offset-1)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	i := bytes.IndexByte(buf[:n], '\n')
+	if i < 0 {
+		if err == io.EOF {
+			return offset - 1 + int64(n), nil
+		}
+		return 0, errors.New("breached passwords file has overlong lines")
+	}
+	return offset + int64(i), nil
+}
+
+// readLine returns the line starting at offset and the offset of the next one
+func readLine(file *os.File, offset int64) ([]byte, int64, error) {
+	buf := make([]byte, maxBreachedLineLength)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	i := bytes.IndexByte(buf[:n], '\n')
+	if i < 0 {
+		if err != io.EOF {
+			return nil, 0, errors.New("breached passwords file has overlong lines")
+		}
+		i = n
+	}
+	return bytes.TrimRight(buf[:i], "\r"), offset + int64(i) + 1, nil
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MaxLength: 32}
+
+	t.Run("length", func(t *testing.T) {
+		assert.EqualError(t, policy.Check("short", ""), "Password must be at least 8 characters")
+		assert.EqualError(t, policy.Check(strings.Repeat("a", 33), ""), "Password must be at most 32 characters")
+		assert.NoError(t, policy.Check("password123", ""))
+
+		// counted in characters, not bytes
+		assert.NoError(t, policy.Check(strings.Repeat("ü", 32), ""))
+		assert.Error(t, policy.Check(strings.Repeat("ü", 7), ""))
+	})
+
+	t.Run("email", func(t *testing.T) {
+		assert.EqualError(t, policy.Check("Jane.Doe@email.com", "jane.doe@email.com"), "Password must not be your email address")
+		assert.EqualError(t, policy.Check("jane.doe", "jane.doe@email.com"), "Password must not be your email address")
+		assert.NoError(t, policy.Check("jane.doe", "john@email.com"))
+	})
+
+	t.Run("normalization", func(t *testing.T) {
+		// fullwidth characters are the same password as their ASCII forms
+		assert.Equal(t, "password", NormalizePassword("ｐａｓｓｗｏｒｄ"))
+		// a precomposed and a decomposed é
+		assert.Equal(t, NormalizePassword("café"), NormalizePassword("café"))
+	})
+
+	t.Run("errors are for the user", func(t *testing.T) {
+		assert.Equal(t, 400, PasswordErrorStatus(policy.Check("short", "")))
+		assert.Equal(t, 500, PasswordErrorStatus(os.ErrNotExist))
+	})
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	breached := []string{"password123", "qwertyuiop", "letmein!", "correct horse"}
+	var lines []string
+	for i, password := range breached {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i+1))
+	}
+	// filler so the search has to narrow down the file
+	for i := range 200 {
+		sum := sha1.Sum([]byte(fmt.Sprintf("filler-%d", i)))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list := BreachedPasswords{Path: path}
+
+	for _, password := range append(breached, "filler-0", "filler-199") {
+		found, err := list.Contains(password)
+		assert.NoError(t, err)
+		assert.True(t, found, password)
+	}
+	for _, password := range []string{"not-breached", "filler-200", ""} {
+		found, err := list.Contains(password)
+		assert.NoError(t, err)
+		assert.False(t, found, password)
+	}
+
+	policy := PasswordPolicy{MinLength: 8, Breached: list}
+	assert.EqualError(t, policy.Check("password123", ""), "This password has appeared in a data breach, please choose a different one")
+
+	t.Run("without a file every password passes", func(t *testing.T) {
+		found, err := BreachedPasswords{}.Contains("password123")
+		assert.NoError(t, err)
+		assert.False(t, found)
+	})
+}
@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rateLimitKeyPrefix = "rate_limit:"
+
+// RateLimitedError tells the client how long to wait before trying again
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("Too many attempts, please try again in %d seconds.", int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// RateLimitPolicy throttles one endpoint. Every request counts against the
+// IP limit, failures additionally slow down and finally lock the account.
+type RateLimitPolicy struct {
+	Name string
+
+	// IPLimit is the number of requests one IP may make per IPWindow
+	IPLimit  int
+	IPWindow time.Duration
+
+	// FreeFailures are tolerated before BaseDelay kicks in, which doubles
+	// with each further failure up to MaxDelay
+	FreeFailures int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+
+	// LockoutThreshold failures lock the account for LockoutDuration. The
+	// failures are forgotten LockoutDuration after the first one.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+}
+
+// NewRateLimitPolicy overrides the defaults from RATE_LIMIT_<NAME>_* variables,
+// e.g. RATE_LIMIT_PASSWORD_LOGIN_IP_LIMIT=50
+func NewRateLimitPolicy(name string, defaults RateLimitPolicy) RateLimitPolicy {
+	prefix := "RATE_LIMIT_" + strings.ToUpper(name) + "_"
+	return RateLimitPolicy{
+		Name:             name,
+		IPLimit:          getEnvInt(prefix+"IP_LIMIT", defaults.IPLimit),
+		IPWindow:         getEnvDuration(prefix+"IP_WINDOW", defaults.IPWindow),
+		FreeFailures:     getEnvInt(prefix+"FREE_FAILURES", defaults.FreeFailures),
+		BaseDelay:        getEnvDuration(prefix+"BASE_DELAY", defaults.BaseDelay),
+		MaxDelay:         getEnvDuration(prefix+"MAX_DELAY", defaults.MaxDelay),
+		LockoutThreshold: getEnvInt(prefix+"LOCKOUT_THRESHOLD", defaults.LockoutThreshold),
+		LockoutDuration:  getEnvDuration(prefix+"LOCKOUT_DURATION", defaults.LockoutDuration),
+	}
+}
+
+// delay is how long the account has to wait after its nth failure
+func (p RateLimitPolicy) delay(failures int64) time.Duration {
+	if p.LockoutThreshold > 0 && failures >= int64(p.LockoutThreshold) {
+		return p.LockoutDuration
+	}
+	if failures <= int64(p.FreeFailures) {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := int64(p.FreeFailures) + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+type RateLimitConfig struct {
+	PasswordLogin RateLimitPolicy
+	PasskeyLogin  RateLimitPolicy
+	// TOTPLogin counts wrong codes per account, across the pending sessions
+	// an attacker who knows the password can start
+	TOTPLogin RateLimitPolicy
+	// RecoveryLogin allows few guesses, each one costs an argon2id comparison
+	RecoveryLogin RateLimitPolicy
+	// the email endpoints count every email as a failure, see LoginGuard.Throttle
+	PasswordReset RateLimitPolicy
+	MagicLink     RateLimitPolicy
+}
+
+// emailPolicy lets an address receive a few emails right away, then one
+// after a delay that doubles up to an hour
+var emailPolicy = RateLimitPolicy{
+	IPLimit:         10,
+	IPWindow:        15 * time.Minute,
+	FreeFailures:    2,
+	BaseDelay:       time.Minute,
+	MaxDelay:        time.Hour,
+	LockoutDuration: time.Hour,
+}
+
+func NewRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		PasswordLogin: NewRateLimitPolicy("password_login", RateLimitPolicy{
+			IPLimit:          30,
+			IPWindow:         5 * time.Minute,
+			FreeFailures:     3,
+			BaseDelay:        time.Second,
+			MaxDelay:         5 * time.Minute,
+			LockoutThreshold: 10,
+			LockoutDuration:  15 * time.Minute,
+		}),
+		PasskeyLogin: NewRateLimitPolicy("passkey_login", RateLimitPolicy{
+			IPLimit:          60,
+			IPWindow:         5 * time.Minute,
+			FreeFailures:     5,
+			BaseDelay:        time.Second,
+			MaxDelay:         time.Minute,
+			LockoutThreshold: 20,
+			LockoutDuration:  15 * time.Minute,
+		}),
+		TOTPLogin: NewRateLimitPolicy("totp_login", RateLimitPolicy{
+			IPLimit:          30,
+			IPWindow:         5 * time.Minute,
+			FreeFailures:     3,
+			BaseDelay:        time.Second,
+			MaxDelay:         5 * time.Minute,
+			LockoutThreshold: 10,
+			LockoutDuration:  15 * time.Minute,
+		}),
+		RecoveryLogin: NewRateLimitPolicy("recovery_login", RateLimitPolicy{
+			IPLimit:          10,
+			IPWindow:         15 * time.Minute,
+			FreeFailures:     3,
+			BaseDelay:        time.Second,
+			MaxDelay:         5 * time.Minute,
+			LockoutThreshold: 10,
+			LockoutDuration:  15 * time.Minute,
+		}),
+		PasswordReset: NewRateLimitPolicy("password_reset", emailPolicy),
+		MagicLink:     NewRateLimitPolicy("magic_link", emailPolicy),
+	}
+}
+
+// RateLimiter keeps its counters in the session store, so all instances
+// behind a load balancer share them when Redis is used
+type RateLimiter struct {
+	Store  SessionStore
+	Config RateLimitConfig
+}
+
+// Allow counts a request of the IP and returns a RateLimitedError when the IP
+// is over its limit or the account is still delayed or locked. The account
+// may be empty when it is not known yet.
+func (rl *RateLimiter) Allow(ctx context.Context, policy RateLimitPolicy, ip string, account string) error {
+	if policy.IPLimit > 0 {
+		count, remaining, err := rl.Store.Incr(ctx, rl.key(policy, "ip", ip), policy.IPWindow)
+		if err != nil {
+			return err
+		}
+		if count > int64(policy.IPLimit) {
+			return &RateLimitedError{RetryAfter: remaining}
+		}
+	}
+
+	if account == "" {
+		return nil
+	}
+	bytes, err := rl.Store.Get(ctx, rl.key(policy, "blocked", account))
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	blockedUntil, err := strconv.ParseInt(string(bytes), 10, 64)
+	if err != nil {
+		return err
+	}
+	if remaining := time.Until(time.Unix(0, blockedUntil)); remaining > 0 {
+		return &RateLimitedError{RetryAfter: remaining}
+	}
+	return nil
+}
+
+// Fail records a failed attempt of the account. It reports true only for the
+// failure that locked the account, so the owner is told once.
+func (rl *RateLimiter) Fail(ctx context.Context, policy RateLimitPolicy, account string) (bool, error) {
+	failures, _, err := rl.Store.Incr(ctx, rl.key(policy, "failures", account), policy.LockoutDuration)
+	if err != nil {
+		return false, err
+	}
+
+	delay := policy.delay(failures)
+	if delay <= 0 {
+		return false, nil
+	}
+	blockedUntil := strconv.FormatInt(time.Now().Add(delay).UnixNano(), 10)
+	if err := rl.Store.Set(ctx, rl.key(policy, "blocked", account), []byte(blockedUntil), delay); err != nil {
+		return false, err
+	}
+	return policy.LockoutThreshold > 0 && failures == int64(policy.LockoutThreshold), nil
+}
+
+// Reset forgets the failures of the account, after a successful sign in or
+// when the owner unlocked it
+func (rl *RateLimiter) Reset(ctx context.Context, policy RateLimitPolicy, account string) error {
+	return rl.Store.Delete(ctx, rl.key(policy, "failures", account), rl.key(policy, "blocked", account))
+}
+
+func (rl *RateLimiter) key(policy RateLimitPolicy, kind string, value string) string {
+	return rateLimitKeyPrefix + policy.Name + ":" + kind + ":" + strings.ToLower(value)
+}
@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitPolicy_delay(t *testing.T) {
+	policy := RateLimitPolicy{
+		FreeFailures:     2,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Second,
+		LockoutThreshold: 8,
+		LockoutDuration:  time.Hour,
+	}
+
+	var delays []time.Duration
+	for failures := int64(1); failures <= 8; failures++ {
+		delays = append(delays, policy.delay(failures))
+	}
+	assert.Equal(t, []time.Duration{
+		0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second, time.Hour,
+	}, delays)
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	policy := RateLimitPolicy{
+		Name:             "test",
+		IPLimit:          100,
+		IPWindow:         time.Minute,
+		FreeFailures:     1,
+		BaseDelay:        time.Minute,
+		MaxDelay:         time.Hour,
+		LockoutThreshold: 3,
+		LockoutDuration:  time.Hour,
+	}
+	limiter := RateLimiter{Store: memoryStore(t)}
+
+	locked, err := limiter.Fail(ctx, policy, "User@Email.com")
+	assert.NoError(t, err)
+	assert.False(t, locked)
+	assert.NoError(t, limiter.Allow(ctx, policy, "192.0.2.1", "user@email.com"))
+
+	// the second failure has to wait, other accounts are not affected
+	_, err = limiter.Fail(ctx, policy, "user@email.com")
+	assert.NoError(t, err)
+	var limited *RateLimitedError
+	assert.ErrorAs(t, limiter.Allow(ctx, policy, "192.0.2.1", "user@email.com"), &limited)
+	assert.InDelta(t, time.Minute, limited.RetryAfter, float64(time.Second))
+	assert.NoError(t, limiter.Allow(ctx, policy, "192.0.2.1", "other@email.com"))
+
+	locked, err = limiter.Fail(ctx, policy, "user@email.com")
+	assert.NoError(t, err)
+	assert.True(t, locked)
+	assert.ErrorAs(t, limiter.Allow(ctx, policy, "192.0.2.1", "user@email.com"), &limited)
+	assert.InDelta(t, time.Hour, limited.RetryAfter, float64(time.Second))
+
+	assert.NoError(t, limiter.Reset(ctx, policy, "user@email.com"))
+	assert.NoError(t, limiter.Allow(ctx, policy, "192.0.2.1", "user@email.com"))
+}
@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// SecretBox encrypts secrets at rest with AES-256-GCM
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox derives the key from ENCRYPTION_KEY, falling back to SESSION_SECRET.
+// Changing the key makes everything encrypted with the old one unreadable.
+func NewSecretBox() (SecretBox, error) {
+	return NewSecretBoxWithKey(getEnvString("ENCRYPTION_KEY", getEnvString("SESSION_SECRET", "")))
+}
+
+func NewSecretBoxWithKey(key string) (SecretBox, error) {
+	if key == "" {
+		return SecretBox{}, errors.New("ENCRYPTION_KEY or SESSION_SECRET has to be set")
+	}
+	hash := sha256.Sum256([]byte(key))
+
+	block, err := aes.NewCipher(hash[:])
+	if err != nil {
+		return SecretBox{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return SecretBox{}, err
+	}
+	return SecretBox{aead: aead}, nil
+}
+
+// Seal returns the nonce and ciphertext of plaintext, base64 encoded
+func (b SecretBox) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (b SecretBox) Open(sealed string) (string, error) {
+	bytes, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret: %v", err)
+	}
+	if len(bytes) < b.aead.NonceSize() {
+		return "", errors.New("failed to decrypt secret: too short")
+	}
+
+	nonce, ciphertext := bytes[:b.aead.NonceSize()], bytes[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %v", err)
+	}
+	return string(plaintext), nil
+}
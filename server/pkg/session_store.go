@@ -0,0 +1,345 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// SessionStore is the key value store behind user sessions and WebAuthn ceremonies.
+// Keys either hold a plain value or a set of fields (used for per-user indexes).
+type SessionStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Replace overwrites the value only if the key still exists and returns
+	// ErrKeyNotFound otherwise, so a deleted key is never brought back
+	Replace(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	// Take atomically returns and deletes the value, so only one caller can ever get it
+	Take(ctx context.Context, key string) ([]byte, error)
+	// Incr adds one to the counter of the key and returns it with the time left
+	// until it expires. A new counter expires after ttl, later calls keep that expiry.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, time.Duration, error)
+
+	// SetField stores a field of the key and resets the TTL of the whole key
+	SetField(ctx context.Context, key string, field string, value string, ttl time.Duration) error
+	GetField(ctx context.Context, key string, field string) (string, error)
+	GetFields(ctx context.Context, key string) (map[string]string, error)
+	DeleteField(ctx context.Context, key string, fields ...string) error
+}
+
+// NewSessionStore picks the backend from SESSION_STORE ("redis" or "memory")
+func NewSessionStore() SessionStore {
+	if os.Getenv("SESSION_STORE") == "memory" {
+		return NewMemoryStore()
+	}
+	return &RedisStore{Client: GetRedisClient()}
+}
+
+type RedisStore struct {
+	Client *redis.Client
+}
+
+func (rs *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	bytes, err := rs.Client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrKeyNotFound
+	}
+	return bytes, err
+}
+
+func (rs *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return rs.Client.Set(ctx, key, value, ttl).Err()
+}
+
+func (rs *RedisStore) Replace(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ok, err := rs.Client.SetXX(ctx, key, value, ttl).Result()
+	if err == redis.Nil || (err == nil && !ok) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+func (rs *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	return rs.Client.Del(ctx, keys...).Err()
+}
+
+func (rs *RedisStore) Take(ctx context.Context, key string) ([]byte, error) {
+	bytes, err := rs.Client.GetDel(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrKeyNotFound
+	}
+	return bytes, err
+}
+
+func (rs *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, time.Duration, error) {
+	var count *redis.IntCmd
+	var remaining *redis.DurationCmd
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, key, 0, ttl)
+		count = pipe.Incr(ctx, key)
+		remaining = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return count.Val(), remaining.Val(), nil
+}
+
+func (rs *RedisStore) SetField(ctx context.Context, key string, field string, value string, ttl time.Duration) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, field, value)
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) GetField(ctx context.Context, key string, field string) (string, error) {
+	value, err := rs.Client.HGet(ctx, key, field).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return value, err
+}
+
+func (rs *RedisStore) GetFields(ctx context.Context, key string) (map[string]string, error) {
+	return rs.Client.HGetAll(ctx, key).Result()
+}
+
+func (rs *RedisStore) DeleteField(ctx context.Context, key string, fields ...string) error {
+	return rs.Client.HDel(ctx, key, fields...).Err()
+}
+
+type memoryEntry struct {
+	value     []byte
+	fields    map[string]string
+	expiresAt time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// MemoryStore keeps everything in process. It is meant for single instance
+// deployments and tests; data is lost on restart. Close stops its sweeper.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+const memoryStoreSweepInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	store := &MemoryStore{
+		entries: make(map[string]*memoryEntry),
+		done:    make(chan struct{}),
+	}
+	go store.sweep()
+	return store
+}
+
+// Close stops sweeping expired entries. The store keeps working, expired
+// entries are still dropped when they are looked up.
+func (ms *MemoryStore) Close() error {
+	ms.closeOnce.Do(func() {
+		close(ms.done)
+	})
+	return nil
+}
+
+func (ms *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry := ms.lookup(key)
+	if entry == nil || entry.value == nil {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), entry.value...), nil
+}
+
+func (ms *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.entries[key] = &memoryEntry{
+		value:     append([]byte{}, value...),
+		expiresAt: expiresAt(ttl),
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Replace(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry := ms.lookup(key)
+	if entry == nil || entry.value == nil {
+		return ErrKeyNotFound
+	}
+	entry.value = append([]byte{}, value...)
+	entry.expiresAt = expiresAt(ttl)
+	return nil
+}
+
+func (ms *MemoryStore) Delete(ctx context.Context, keys ...string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, key := range keys {
+		delete(ms.entries, key)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Take(ctx context.Context, key string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry := ms.lookup(key)
+	if entry == nil || entry.value == nil {
+		return nil, ErrKeyNotFound
+	}
+	delete(ms.entries, key)
+	return entry.value, nil
+}
+
+func (ms *MemoryStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, time.Duration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry := ms.lookup(key)
+	if entry == nil || entry.value == nil {
+		entry = &memoryEntry{value: []byte("0"), expiresAt: expiresAt(ttl)}
+		ms.entries[key] = entry
+	}
+	count, err := strconv.ParseInt(string(entry.value), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	count++
+	entry.value = []byte(strconv.FormatInt(count, 10))
+
+	var remaining time.Duration
+	if !entry.expiresAt.IsZero() {
+		remaining = time.Until(entry.expiresAt)
+	}
+	return count, remaining, nil
+}
+
+func (ms *MemoryStore) SetField(ctx context.Context, key string, field string, value string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry := ms.lookup(key)
+	if entry == nil {
+		entry = &memoryEntry{}
+		ms.entries[key] = entry
+	}
+	if entry.fields == nil {
+		entry.fields = make(map[string]string)
+	}
+	entry.fields[field] = value
+	entry.expiresAt = expiresAt(ttl)
+	return nil
+}
+
+func (ms *MemoryStore) GetField(ctx context.Context, key string, field string) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry := ms.lookup(key)
+	if entry == nil {
+		return "", ErrKeyNotFound
+	}
+	value, ok := entry.fields[field]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (ms *MemoryStore) GetFields(ctx context.Context, key string) (map[string]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	fields := make(map[string]string)
+	if entry := ms.lookup(key); entry != nil {
+		for field, value := range entry.fields {
+			fields[field] = value
+		}
+	}
+	return fields, nil
+}
+
+func (ms *MemoryStore) DeleteField(ctx context.Context, key string, fields ...string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry := ms.lookup(key)
+	if entry == nil {
+		return nil
+	}
+	for _, field := range fields {
+		delete(entry.fields, field)
+	}
+	if len(entry.fields) == 0 && entry.value == nil {
+		delete(ms.entries, key)
+	}
+	return nil
+}
+
+// lookup returns the live entry of the key, dropping it when it has expired.
+// Callers must hold ms.mu.
+func (ms *MemoryStore) lookup(key string) *memoryEntry {
+	entry, ok := ms.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(time.Now()) {
+		delete(ms.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// sweep periodically drops expired entries that nobody asked for again
+func (ms *MemoryStore) sweep() {
+	ticker := time.NewTicker(memoryStoreSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ms.done:
+			return
+		case now := <-ticker.C:
+			ms.mu.Lock()
+			for key, entry := range ms.entries {
+				if entry.expired(now) {
+					delete(ms.entries, key)
+				}
+			}
+			ms.mu.Unlock()
+		}
+	}
+}
+
+// expiresAt mirrors Redis semantics where a zero TTL means the key never expires
+func expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
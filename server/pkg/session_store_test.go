@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStore(t *testing.T) {
+	miniRedis := miniredis.RunT(t)
+
+	stores := map[string]struct {
+		store       SessionStore
+		fastForward func(time.Duration)
+	}{
+		"memory": {
+			store: memoryStore(t),
+			fastForward: func(d time.Duration) {
+				time.Sleep(d)
+			},
+		},
+		"redis": {
+			store:       &RedisStore{Client: redis.NewClient(&redis.Options{Addr: miniRedis.Addr()})},
+			fastForward: miniRedis.FastForward,
+		},
+	}
+
+	for name, tc := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := tc.store
+
+			t.Run("missing key", func(t *testing.T) {
+				_, err := store.Get(ctx, "missing")
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+				_, err = store.GetField(ctx, "missing", "field")
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+			})
+
+			t.Run("set, get and delete", func(t *testing.T) {
+				assert.NoError(t, store.Set(ctx, "key", []byte("value"), time.Minute))
+				value, err := store.Get(ctx, "key")
+				assert.NoError(t, err)
+				assert.Equal(t, []byte("value"), value)
+
+				assert.NoError(t, store.Delete(ctx, "key"))
+				_, err = store.Get(ctx, "key")
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+			})
+
+			t.Run("replace", func(t *testing.T) {
+				err := store.Replace(ctx, "gone", []byte("value"), time.Minute)
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+				_, err = store.Get(ctx, "gone")
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+
+				assert.NoError(t, store.Set(ctx, "kept", []byte("old"), time.Minute))
+				assert.NoError(t, store.Replace(ctx, "kept", []byte("new"), time.Minute))
+				value, err := store.Get(ctx, "kept")
+				assert.NoError(t, err)
+				assert.Equal(t, []byte("new"), value)
+			})
+
+			t.Run("take", func(t *testing.T) {
+				assert.NoError(t, store.Set(ctx, "once", []byte("value"), time.Minute))
+				value, err := store.Take(ctx, "once")
+				assert.NoError(t, err)
+				assert.Equal(t, []byte("value"), value)
+
+				_, err = store.Take(ctx, "once")
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+			})
+
+			t.Run("incr", func(t *testing.T) {
+				count, remaining, err := store.Incr(ctx, "counter", time.Minute)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(1), count)
+				assert.InDelta(t, time.Minute, remaining, float64(time.Second))
+
+				count, _, err = store.Incr(ctx, "counter", time.Hour)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(2), count)
+
+				// the expiry of the first call is kept
+				_, remaining, err = store.Incr(ctx, "counter", time.Hour)
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, remaining, time.Minute)
+			})
+
+			t.Run("fields", func(t *testing.T) {
+				assert.NoError(t, store.SetField(ctx, "index", "a", "1", time.Minute))
+				assert.NoError(t, store.SetField(ctx, "index", "b", "2", time.Minute))
+
+				value, err := store.GetField(ctx, "index", "a")
+				assert.NoError(t, err)
+				assert.Equal(t, "1", value)
+
+				assert.NoError(t, store.DeleteField(ctx, "index", "a"))
+				fields, err := store.GetFields(ctx, "index")
+				assert.NoError(t, err)
+				assert.Equal(t, map[string]string{"b": "2"}, fields)
+			})
+
+			t.Run("expiry", func(t *testing.T) {
+				assert.NoError(t, store.Set(ctx, "short", []byte("value"), 50*time.Millisecond))
+				assert.NoError(t, store.SetField(ctx, "short_index", "a", "1", 50*time.Millisecond))
+				tc.fastForward(100 * time.Millisecond)
+
+				_, err := store.Get(ctx, "short")
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+				fields, err := store.GetFields(ctx, "short_index")
+				assert.NoError(t, err)
+				assert.Empty(t, fields)
+			})
+		})
+	}
+}
+
+func TestMemoryStore_Close(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	assert.NoError(t, store.Close())
+	assert.NoError(t, store.Close())
+
+	// only the sweeper stops, the store itself keeps working
+	assert.NoError(t, store.Set(ctx, "key", []byte("value"), 50*time.Millisecond))
+	value, err := store.Get(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = store.Get(ctx, "key")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+// memoryStore returns a MemoryStore that is closed when the test ends
+func memoryStore(t *testing.T) *MemoryStore {
+	store := NewMemoryStore()
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
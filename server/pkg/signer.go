@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+)
+
+// minSecretLength is the size of the HMAC-SHA256 key, a shorter secret is guessable
+const minSecretLength = 32
+
+// Signer authenticates values handed to the browser with an HMAC over
+// SESSION_SECRET, so tampered or made up values are rejected before any lookup
+type Signer struct {
+	Secret []byte
+}
+
+// NewSigner reads SESSION_SECRET and refuses to start with a missing or short one,
+// everything signed with it could be forged otherwise
+func NewSigner() (Signer, error) {
+	secret := os.Getenv("SESSION_SECRET")
+	if len(secret) < minSecretLength {
+		return Signer{}, errors.New("SESSION_SECRET has to be at least 32 bytes long")
+	}
+	return Signer{Secret: []byte(secret)}, nil
+}
+
+// Sign returns value with its signature appended
+func (s Signer) Sign(value string) string {
+	return value + "." + s.signature(value)
+}
+
+// Verify returns the original value of a signed value
+func (s Signer) Verify(signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value, signature := signed[:i], signed[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.signature(value))) {
+		return "", false
+	}
+	return value, true
+}
+
+// MAC returns the raw HMAC of value, for values that have to be derived from
+// the secret instead of being signed
+func (s Signer) MAC(value string) []byte {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+func (s Signer) signature(value string) string {
+	return base64.RawURLEncoding.EncodeToString(s.MAC(value))
+}
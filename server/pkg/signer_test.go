@@ -0,0 +1,24 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSigner(t *testing.T) {
+	t.Setenv("SESSION_SECRET", "")
+	_, err := NewSigner()
+	assert.Error(t, err)
+
+	t.Setenv("SESSION_SECRET", "secret")
+	_, err = NewSigner()
+	assert.Error(t, err)
+
+	t.Setenv("SESSION_SECRET", "0123456789abcdef0123456789abcdef")
+	signer, err := NewSigner()
+	assert.NoError(t, err)
+	value, ok := signer.Verify(signer.Sign("value"))
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+}
@@ -0,0 +1,52 @@
+package pkg
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTP(t *testing.T) {
+	// test vector of RFC 6238 (SHA-1), truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	at := time.Unix(59, 0)
+
+	code, err := TOTPCode(secret, at)
+	assert.NoError(t, err)
+	assert.Equal(t, "287082", code)
+
+	t.Run("accepts the neighbouring steps", func(t *testing.T) {
+		step, ok := ValidateTOTP(secret, code, at.Add(totpStep))
+		assert.True(t, ok)
+		assert.Equal(t, int64(1), step)
+
+		_, ok = ValidateTOTP(secret, code, at.Add(3*totpStep))
+		assert.False(t, ok)
+	})
+
+	t.Run("rejects wrong codes", func(t *testing.T) {
+		_, ok := ValidateTOTP(secret, "000000", at)
+		assert.False(t, ok)
+		_, ok = ValidateTOTP(secret, "28708", at)
+		assert.False(t, ok)
+	})
+}
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBoxWithKey("key")
+	assert.NoError(t, err)
+
+	sealed, err := box.Seal("secret")
+	assert.NoError(t, err)
+	assert.NotContains(t, sealed, "secret")
+
+	opened, err := box.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", opened)
+
+	other, _ := NewSecretBoxWithKey("other key")
+	_, err = other.Open(sealed)
+	assert.Error(t, err)
+}
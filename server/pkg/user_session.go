@@ -1,37 +1,474 @@
 package pkg
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/random"
-	"github.com/redis/go-redis/v9"
 )
 
-const sessionDuration = 30 * 24 * time.Hour
+const (
+	sessionCookieName = "auth"
+
+	sessionKeyPrefix      = "session:"
+	userSessionsKeyPrefix = "user_sessions:"
+)
+
+const (
+	AuthMethodPassword  = "password"
+	AuthMethodPasskey   = "passkey"
+	AuthMethodMagicLink = "magic_link"
+	AuthMethodTOTP      = "totp"
+	// recovery codes only let the user in to register a new passkey
+	AuthMethodRecoveryCode = "recovery_code"
+
+	// a password login waiting for its second factor has to finish quickly
+	mfaPendingTimeout = 5 * time.Minute
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is the server side record of a signed in browser.
+// ID is a public handle that is safe to show to the user; the token
+// stored in the auth cookie never leaves the session store.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     uuid.UUID `json:"user_id"`
+	AuthMethod string    `json:"auth_method"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// VerifiedAt is the last time the user proved who they are in this
+	// session, either by signing in or by re-authenticating for a sensitive action
+	VerifiedAt     time.Time `json:"verified_at"`
+	VerifiedMethod string    `json:"verified_method"`
+	// LowAssurance marks sessions that only prove access to the email inbox.
+	// They never count as verified, so sensitive actions need a passkey or password.
+	LowAssurance bool `json:"low_assurance"`
+	// MFAPending sessions passed the password but still need the second
+	// factor. They are not signed in until CompleteMFA.
+	MFAPending  bool `json:"mfa_pending"`
+	MFAAttempts int  `json:"mfa_attempts"`
+	// Restricted sessions may only register a new passkey, see AuthMiddleware
+	Restricted bool `json:"restricted"`
+
+	token string
+}
+
+// RecentlyVerified reports whether the user authenticated within maxAge
+func (s *Session) RecentlyVerified(maxAge time.Duration) bool {
+	return !s.VerifiedAt.IsZero() && time.Since(s.VerifiedAt) <= maxAge
+}
+
+// Token returns the secret value stored in the auth cookie, or "" for a nil session
+func (s *Session) Token() string {
+	if s == nil {
+		return ""
+	}
+	return s.token
+}
+
+// SessionConfig controls how long sessions live and how the auth cookie is sent
+type SessionConfig struct {
+	// AbsoluteTimeout is the hard limit of a session, no matter how active it is
+	AbsoluteTimeout time.Duration
+	// IdleTimeout ends a session that has not been used for this long
+	IdleTimeout time.Duration
+	// ReauthMaxAge is how long a re-authentication unlocks sensitive actions
+	ReauthMaxAge time.Duration
+	// ConditionalLoginTimeout is how long the passkey autofill of an open
+	// sign in page stays valid
+	ConditionalLoginTimeout time.Duration
+
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+	CookieDomain   string
+}
+
+func NewSessionConfig() SessionConfig {
+	// plain http origins (local dev) cannot receive Secure cookies
+	secure := strings.HasPrefix(os.Getenv("RP_ORIGIN"), "https://")
+
+	return SessionConfig{
+		AbsoluteTimeout:         getEnvDuration("SESSION_ABSOLUTE_TIMEOUT", 30*24*time.Hour),
+		IdleTimeout:             getEnvDuration("SESSION_IDLE_TIMEOUT", 7*24*time.Hour),
+		ReauthMaxAge:            getEnvDuration("REAUTH_MAX_AGE", 5*time.Minute),
+		ConditionalLoginTimeout: getEnvDuration("CONDITIONAL_LOGIN_TIMEOUT", 30*time.Minute),
+		CookieSecure:            getEnvBool("SESSION_COOKIE_SECURE", secure),
+		CookieSameSite:          parseSameSite(os.Getenv("SESSION_COOKIE_SAMESITE")),
+		CookieDomain:            os.Getenv("SESSION_COOKIE_DOMAIN"),
+	}
+}
+
+func parseSameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
 
 type UserSession struct {
-	RedisClient *redis.Client
+	Store  SessionStore
+	Config SessionConfig
+}
+
+func (ss *UserSession) Create(ctx echo.Context, userID uuid.UUID, authMethod string) error {
+	session := ss.newSession(ctx, userID, authMethod)
+	switch authMethod {
+	case AuthMethodMagicLink:
+		session.LowAssurance = true
+	case AuthMethodRecoveryCode:
+		session.LowAssurance = true
+		session.Restricted = true
+	default:
+		// signing in counts as a fresh verification
+		session.VerifiedAt = session.CreatedAt
+		session.VerifiedMethod = authMethod
+	}
+	return ss.start(ctx, session)
+}
+
+// CreateMFAPending starts a session that can only be used to complete the second factor
+func (ss *UserSession) CreateMFAPending(ctx echo.Context, userID uuid.UUID, authMethod string) error {
+	session := ss.newSession(ctx, userID, authMethod)
+	session.MFAPending = true
+	session.LowAssurance = authMethod == AuthMethodMagicLink
+	session.ExpiresAt = session.CreatedAt.Add(mfaPendingTimeout)
+	return ss.start(ctx, session)
+}
+
+// Unrestrict lifts the restriction of a recovery session once the user
+// registered a new passkey
+func (ss *UserSession) Unrestrict(ctx echo.Context, session *Session) error {
+	session.Restricted = false
+	return ss.Rotate(ctx, session)
 }
 
-func (ss *UserSession) Create(ctx echo.Context, userID uuid.UUID) error {
-	sessionID := random.String(20)
+// CompleteMFA signs in a pending session after the second factor checked out.
+// A low assurance session stays unverified, the code does not make up for the
+// passkey or password it was started without.
+func (ss *UserSession) CompleteMFA(ctx echo.Context, session *Session, method string) error {
+	now := time.Now()
+	session.MFAPending = false
+	session.MFAAttempts = 0
+	session.ExpiresAt = now.Add(ss.Config.AbsoluteTimeout)
+	if !session.LowAssurance {
+		session.VerifiedAt = now
+		session.VerifiedMethod = method
+	}
+	return ss.Rotate(ctx, session)
+}
+
+func (ss *UserSession) newSession(ctx echo.Context, userID uuid.UUID, authMethod string) *Session {
+	now := time.Now()
+	userAgent := ctx.Request().UserAgent()
+
+	return &Session{
+		ID:         uuid.New().String(),
+		UserID:     userID,
+		AuthMethod: authMethod,
+		Device:     deviceFromUserAgent(userAgent),
+		UserAgent:  userAgent,
+		IP:         ctx.RealIP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ss.Config.AbsoluteTimeout),
+		token:      random.String(32),
+	}
+}
+
+func (ss *UserSession) start(ctx echo.Context, session *Session) error {
+	if err := ss.save(ctx.Request().Context(), session); err != nil {
+		return err
+	}
 
-	if err := ss.RedisClient.Set(ctx.Request().Context(), sessionID, userID.String(), sessionDuration).Err(); err != nil {
+	ss.setCookie(ctx, session.token, session.ExpiresAt)
+	return nil
+}
+
+// Rotate moves the session to a fresh token, e.g. after the user re-authenticated,
+// so a token captured before the privilege change becomes useless
+func (ss *UserSession) Rotate(ctx echo.Context, session *Session) error {
+	oldToken := session.token
+	session.token = random.String(32)
+	session.LastSeenAt = time.Now()
+
+	if err := ss.save(ctx.Request().Context(), session); err != nil {
+		return err
+	}
+	if err := ss.Store.Delete(ctx.Request().Context(), sessionKeyPrefix+oldToken); err != nil {
+		return fmt.Errorf("failed to delete session data: %v", err)
+	}
+
+	ss.setCookie(ctx, session.token, session.ExpiresAt)
+	return nil
+}
+
+// MarkVerified records a successful re-authentication. The session is rotated
+// as it now grants access to sensitive actions.
+func (ss *UserSession) MarkVerified(ctx echo.Context, session *Session, method string) error {
+	session.VerifiedAt = time.Now()
+	session.VerifiedMethod = method
+	session.LowAssurance = false
+	return ss.Rotate(ctx, session)
+}
+
+// Get returns the session stored under the given cookie token
+func (ss *UserSession) Get(ctx context.Context, token string) (*Session, error) {
+	bytes, err := ss.Store.Get(ctx, sessionKeyPrefix+token)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session data: %v", err)
+	}
+
+	var session Session
+	if err := json.Unmarshal(bytes, &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session data: %v", err)
+	}
+	session.token = token
+
+	if ss.expired(&session, time.Now()) {
+		_ = ss.Store.Delete(ctx, sessionKeyPrefix+token)
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+// Touch records that the session has just been used and slides its idle timeout.
+// A session revoked or rotated while the request was running stays gone.
+func (ss *UserSession) Touch(ctx context.Context, session *Session) error {
+	now := time.Now()
+	if err := ss.update(ctx, session.token, func(stored *Session) {
+		stored.LastSeenAt = now
+	}); err != nil {
+		return err
+	}
+	session.LastSeenAt = now
+	return nil
+}
+
+// RecordMFAFailure counts a wrong second factor on a pending session and
+// returns how many wrong codes it has seen so far
+func (ss *UserSession) RecordMFAFailure(ctx context.Context, session *Session) (int, error) {
+	if err := ss.update(ctx, session.token, func(stored *Session) {
+		stored.MFAAttempts++
+		stored.LastSeenAt = time.Now()
+		session.MFAAttempts = stored.MFAAttempts
+	}); err != nil {
+		return 0, err
+	}
+	return session.MFAAttempts, nil
+}
+
+// update changes the stored copy of a session in place. It starts from what is
+// in the store rather than the copy read at the start of the request, so changes
+// of concurrent requests are kept, and it never recreates a deleted session.
+func (ss *UserSession) update(ctx context.Context, token string, change func(*Session)) error {
+	stored, err := ss.Get(ctx, token)
+	if err != nil {
+		return err
+	}
+	change(stored)
+
+	bytes, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to encode session data: %v", err)
+	}
+	err = ss.Store.Replace(ctx, sessionKeyPrefix+token, bytes, ss.ttl(stored))
+	if errors.Is(err, ErrKeyNotFound) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
 		return fmt.Errorf("failed to save session data: %v", err)
 	}
+	return nil
+}
 
-	ctx.SetCookie(&http.Cookie{
-		Name: "auth",
-		Value: sessionID,
-		Path: "/",
+// List returns all live sessions of a user, most recently used first.
+// Index entries whose session already expired are dropped on the way.
+func (ss *UserSession) List(ctx context.Context, userID uuid.UUID) ([]Session, error) {
+	indexKey := userSessionsKeyPrefix + userID.String()
+
+	tokens, err := ss.Store.GetFields(ctx, indexKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %v", err)
+	}
+
+	sessions := make([]Session, 0, len(tokens))
+	for id, token := range tokens {
+		session, err := ss.Get(ctx, token)
+		if errors.Is(err, ErrSessionNotFound) {
+			_ = ss.Store.DeleteField(ctx, indexKey, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
 	})
+	return sessions, nil
+}
+
+// Revoke deletes the session with the given public ID if it belongs to the user
+func (ss *UserSession) Revoke(ctx context.Context, userID uuid.UUID, sessionID string) error {
+	indexKey := userSessionsKeyPrefix + userID.String()
+
+	token, err := ss.Store.GetField(ctx, indexKey, sessionID)
+	if errors.Is(err, ErrKeyNotFound) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get session data: %v", err)
+	}
+
+	if err := ss.Store.Delete(ctx, sessionKeyPrefix+token); err != nil {
+		return fmt.Errorf("failed to delete session data: %v", err)
+	}
+	return ss.Store.DeleteField(ctx, indexKey, sessionID)
+}
+
+// RevokeOthers deletes every session of the user except the one identified by keepToken
+func (ss *UserSession) RevokeOthers(ctx context.Context, userID uuid.UUID, keepToken string) error {
+	indexKey := userSessionsKeyPrefix + userID.String()
+
+	tokens, err := ss.Store.GetFields(ctx, indexKey)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %v", err)
+	}
+
+	for id, token := range tokens {
+		if token == keepToken {
+			continue
+		}
+		if err := ss.Store.Delete(ctx, sessionKeyPrefix+token); err != nil {
+			return fmt.Errorf("failed to delete session data: %v", err)
+		}
+		if err := ss.Store.DeleteField(ctx, indexKey, id); err != nil {
+			return fmt.Errorf("failed to delete session data: %v", err)
+		}
+	}
 	return nil
 }
 
+// RevokeAll deletes every session of the user, e.g. when the account is deleted
+func (ss *UserSession) RevokeAll(ctx context.Context, userID uuid.UUID) error {
+	if err := ss.RevokeOthers(ctx, userID, ""); err != nil {
+		return err
+	}
+	return ss.Store.Delete(ctx, userSessionsKeyPrefix+userID.String())
+}
+
+// Delete removes the session and tells the browser to drop the auth cookie
 func (ss *UserSession) Delete(ctx echo.Context, sessionID string) {
-	_ = ss.RedisClient.Del(ctx.Request().Context(), sessionID).Err()
+	session, err := ss.Get(ctx.Request().Context(), sessionID)
+	if err == nil {
+		_ = ss.Store.DeleteField(ctx.Request().Context(), userSessionsKeyPrefix+session.UserID.String(), session.ID)
+	}
+	_ = ss.Store.Delete(ctx.Request().Context(), sessionKeyPrefix+sessionID)
+	ss.ClearCookie(ctx)
+}
+
+// ClearCookie tells the browser to drop the auth cookie
+func (ss *UserSession) ClearCookie(ctx echo.Context) {
+	ss.setCookie(ctx, "", time.Unix(0, 0))
+}
+
+func (ss *UserSession) save(ctx context.Context, session *Session) error {
+	bytes, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode session data: %v", err)
+	}
+
+	if err := ss.Store.Set(ctx, sessionKeyPrefix+session.token, bytes, ss.ttl(session)); err != nil {
+		return fmt.Errorf("failed to save session data: %v", err)
+	}
+
+	// the index has to outlive every session it points to
+	indexKey := userSessionsKeyPrefix + session.UserID.String()
+	if err := ss.Store.SetField(ctx, indexKey, session.ID, session.token, ss.Config.AbsoluteTimeout); err != nil {
+		return fmt.Errorf("failed to save session data: %v", err)
+	}
+	return nil
+}
+
+// ttl keeps a session in the store until it goes idle or hits its absolute limit, whichever is first
+func (ss *UserSession) ttl(session *Session) time.Duration {
+	remaining := ss.Config.AbsoluteTimeout
+	if !session.ExpiresAt.IsZero() {
+		remaining = time.Until(session.ExpiresAt)
+	}
+	if ss.Config.IdleTimeout > 0 && ss.Config.IdleTimeout < remaining {
+		return ss.Config.IdleTimeout
+	}
+	return remaining
+}
+
+func (ss *UserSession) expired(session *Session, now time.Time) bool {
+	if !session.ExpiresAt.IsZero() && now.After(session.ExpiresAt) {
+		return true
+	}
+	return ss.Config.IdleTimeout > 0 && now.Sub(session.LastSeenAt) > ss.Config.IdleTimeout
+}
+
+func (ss *UserSession) setCookie(ctx echo.Context, token string, expires time.Time) {
+	maxAge := int(time.Until(expires).Seconds())
+	if maxAge <= 0 {
+		maxAge = -1
+	}
+
+	ctx.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Domain:   ss.Config.CookieDomain,
+		Expires:  expires,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   ss.Config.CookieSecure,
+		SameSite: ss.Config.CookieSameSite,
+	})
+}
+
+// deviceFromUserAgent gives a rough, human readable device name for the session list
+func deviceFromUserAgent(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPhone"):
+		return "iPhone"
+	case strings.Contains(userAgent, "iPad"):
+		return "iPad"
+	case strings.Contains(userAgent, "Android"):
+		return "Android"
+	case strings.Contains(userAgent, "CrOS"):
+		return "ChromeOS"
+	case strings.Contains(userAgent, "Macintosh"):
+		return "Mac"
+	case strings.Contains(userAgent, "Windows"):
+		return "Windows"
+	case strings.Contains(userAgent, "Linux"):
+		return "Linux"
+	default:
+		return "Unknown device"
+	}
 }
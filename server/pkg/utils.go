@@ -1,8 +1,11 @@
 package pkg
 
 import (
+	"errors"
+	"math"
 	"net/http"
 	"net/mail"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 )
@@ -15,8 +18,34 @@ type Params struct {
 type Response struct {
 	Status string `json:"status"`
 	ErrorMessage string `json:"errorMessage"`
+	// Code is a machine readable reason for errors the client has to react to
+	Code string `json:"code,omitempty"`
 }
 
+const (
+	ErrorCodeReauthRequired   = "reauth_required"
+	ErrorCodeLastSignInMethod = "last_sign_in_method"
+	ErrorCodePasskeyRequired  = "passkey_required"
+	ErrorCodeRateLimited      = "rate_limited"
+	// changing the password needs the current one, or a passkey confirmation
+	ErrorCodeCurrentPasswordRequired = "current_password_required"
+	// the account has no password to change, POST /set_password sets the first one
+	ErrorCodeNoPassword = "no_password"
+	// the account already has a password, POST /change_password replaces it
+	ErrorCodeHasPassword = "has_password"
+	// a new passkey broke the authenticator policy, see AuthenticatorPolicy
+	ErrorCodeAuthenticatorNotAllowed   = "authenticator_not_allowed"
+	ErrorCodeAttestationTypeNotAllowed = "attestation_type_not_allowed"
+	ErrorCodeAttestationRequired       = "attestation_required"
+	ErrorCodeBackupEligibilityRequired = "backup_eligibility_required"
+	ErrorCodeBackupEligibilityDenied   = "backup_eligibility_denied"
+	ErrorCodeCertificationRequired     = "certification_required"
+	// sent with an ok status when the password was right but a code is still needed
+	CodeTOTPRequired = "totp_required"
+	// sent with an ok status when the next step is in the user's inbox
+	CodeCheckEmail = "check_email"
+)
+
 func IsValidEmail(email string) bool {
 	_, err := mail.ParseAddress(email)
 	return err == nil
@@ -30,9 +59,37 @@ func SendError(ctx echo.Context, err error, code int) error {
 	})
 }
 
+func SendErrorCode(ctx echo.Context, err error, code int, errorCode string) error {
+	ctx.Logger().Error("Error: %v", err)
+	return ctx.JSON(code, Response{
+		Status:       "error",
+		ErrorMessage: err.Error(),
+		Code:         errorCode,
+	})
+}
+
 func SendOK(ctx echo.Context) error {
 	return ctx.JSON(http.StatusOK, Response{
 		Status:       "ok",
 		ErrorMessage: "",
 	})
 }
+
+// SendOKCode is SendOK with a code telling the client which step comes next
+func SendOKCode(ctx echo.Context, code string) error {
+	return ctx.JSON(http.StatusOK, Response{
+		Status: "ok",
+		Code:   code,
+	})
+}
+
+// SendRateLimited answers a RateLimitedError with 429 and a Retry-After header,
+// any other error is answered as an internal error
+func SendRateLimited(ctx echo.Context, err error) error {
+	var limited *RateLimitedError
+	if !errors.As(err, &limited) {
+		return SendError(ctx, err, http.StatusInternalServerError)
+	}
+	ctx.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+	return SendErrorCode(ctx, limited, http.StatusTooManyRequests, ErrorCodeRateLimited)
+}
@@ -2,15 +2,32 @@ package pkg
 
 import (
 	"os"
+	"time"
 
 	"github.com/go-webauthn/webauthn/webauthn"
 )
 
-func NewWebAuthnAPI() (*webauthn.WebAuthn, error) {
-	webauthn, err := webauthn.New(&webauthn.Config{
+func NewWebAuthnAPI(metadataService *MetadataService) (*webauthn.WebAuthn, error) {
+	timeout := getEnvDuration("WEBAUTHN_TIMEOUT", 5*time.Minute)
+	ceremonyTimeout := webauthn.TimeoutConfig{
+		Enforce: true,
+		Timeout: timeout,
+		TimeoutUVD: timeout,
+	}
+
+	config := &webauthn.Config{
 		RPDisplayName: os.Getenv("RP_DISPLAY_NAME"),
 		RPID: os.Getenv("RP_ID"),
 		RPOrigins: []string{os.Getenv("RP_ORIGIN")},
-	})
-	return webauthn, err
+		Timeouts: webauthn.TimeoutsConfig{
+			Login: ceremonyTimeout,
+			Registration: ceremonyTimeout,
+		},
+		AttestationPreference: NewAttestationConveyance(),
+	}
+	// a nil *MetadataService must not end up as a non-nil interface
+	if metadataService != nil {
+		config.MDS = metadataService
+	}
+	return webauthn.New(config)
 }
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -9,63 +10,236 @@ import (
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
-	"github.com/redis/go-redis/v9"
 )
 
-const webauthnSessionDuration = 30 * 24 * time.Hour
+const (
+	CeremonyRegistration = "registration"
+	CeremonyLogin        = "login"
+	// CeremonyConditionalLogin is the passkey autofill of the sign in page. It
+	// has its own cookie, so a button started login does not replace it.
+	CeremonyConditionalLogin = "conditional_login"
+
+	webauthnCeremonyKeyPrefix = "webauthn_ceremony:"
+	// used when the library did not set an expiry on the session data
+	defaultCeremonyTimeout = 5 * time.Minute
+	// expired ceremonies are kept a little longer so that an expired
+	// challenge can be told apart from one that never existed
+	ceremonyGracePeriod = 5 * time.Minute
+)
+
+var (
+	ErrCeremonyNotFound = errors.New("No passkey ceremony in progress, please try again")
+	ErrCeremonyExpired  = errors.New("The passkey ceremony has expired, please try again")
+	ErrCeremonyMismatch = errors.New("The passkey ceremony does not belong to this request")
+)
+
+// ceremony is the server side state of a single registration or login attempt
+type ceremony struct {
+	Type string `json:"type"`
+	// ID of the signed in user that started the ceremony, empty for sign in and sign up
+	SessionUserID string `json:"session_user_id"`
+	// SignupEmail is set when the registration signs up a new user. The user
+	// only exists in this state until the ceremony succeeds.
+	SignupEmail string `json:"signup_email,omitempty"`
+	// Upgrade is set for the conditional create after a password sign in
+	Upgrade   bool                  `json:"upgrade,omitempty"`
+	ExpiresAt time.Time             `json:"expires_at"`
+	Data      *webauthn.SessionData `json:"data"`
+	// Options sent to the client, kept for ceremonies that are offered again
+	Options json.RawMessage `json:"options,omitempty"`
+}
 
 type WebAuthnSession struct {
-	RedisClient *redis.Client
+	Store  SessionStore
+	Config SessionConfig
 }
 
-func (session *WebAuthnSession) Get(ctx echo.Context, sessionName string) (string,*webauthn.SessionData, error) {
-	cookie, err := ctx.Cookie(sessionName)
+// Get consumes the ceremony of the given type. It can only succeed once per
+// challenge, so a captured response cannot be replayed.
+func (session *WebAuthnSession) Get(ctx echo.Context, ceremonyType string) (*webauthn.SessionData, error) {
+	state, err := session.take(ctx, ceremonyType)
+	if err != nil {
+		return nil, err
+	}
+	return state.Data, nil
+}
 
+// Registration is the state of a registration ceremony
+type Registration struct {
+	Data *webauthn.SessionData
+	// SignupEmail is the address of the pending user for signups, empty otherwise
+	SignupEmail string
+	// Upgrade is true for the automatic passkey upgrade, see CreateUpgrade
+	Upgrade bool
+}
+
+// GetRegistration consumes a registration ceremony like Get
+func (session *WebAuthnSession) GetRegistration(ctx echo.Context) (*Registration, error) {
+	state, err := session.take(ctx, CeremonyRegistration)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to get session data: %v", err)
+		return nil, err
 	}
+	return &Registration{Data: state.Data, SignupEmail: state.SignupEmail, Upgrade: state.Upgrade}, nil
+}
 
-	id := cookie.Value
+// GetOptions returns the options of a ceremony created with CreateReusable
+// without consuming it, so the page can start the same ceremony again until
+// the challenge is used
+func (session *WebAuthnSession) GetOptions(ctx echo.Context, ceremonyType string) (json.RawMessage, error) {
+	cookie, err := ctx.Cookie(ceremonyType)
+	if err != nil {
+		return nil, ErrCeremonyNotFound
+	}
+
+	bytes, err := session.Store.Get(ctx.Request().Context(), webauthnCeremonyKeyPrefix+cookie.Value)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrCeremonyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session data: %v", err)
+	}
+
+	state, err := decodeCeremony(ctx, ceremonyType, bytes)
+	if err != nil {
+		return nil, err
+	}
+	if state.Options == nil {
+		return nil, ErrCeremonyNotFound
+	}
+	return state.Options, nil
+}
+
+// Discard ends a ceremony the user will not finish, e.g. the passkey autofill
+// after signing in with a password
+func (session *WebAuthnSession) Discard(ctx echo.Context, ceremonyType string) error {
+	cookie, err := ctx.Cookie(ceremonyType)
+	if err != nil {
+		return nil
+	}
+	session.clearCookie(ctx, ceremonyType)
+
+	if err := session.Store.Delete(ctx.Request().Context(), webauthnCeremonyKeyPrefix+cookie.Value); err != nil {
+		return fmt.Errorf("failed to delete session data: %v", err)
+	}
+	return nil
+}
 
-	bytes, err := session.RedisClient.Get(ctx.Request().Context(), id).Bytes()
+func (session *WebAuthnSession) take(ctx echo.Context, ceremonyType string) (*ceremony, error) {
+	cookie, err := ctx.Cookie(ceremonyType)
+	if err != nil {
+		return nil, ErrCeremonyNotFound
+	}
+	session.clearCookie(ctx, ceremonyType)
 
+	bytes, err := session.Store.Take(ctx.Request().Context(), webauthnCeremonyKeyPrefix+cookie.Value)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrCeremonyNotFound
+	}
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to get session data: %v", err)
+		return nil, fmt.Errorf("failed to get session data: %v", err)
+	}
+	return decodeCeremony(ctx, ceremonyType, bytes)
+}
+
+func decodeCeremony(ctx echo.Context, ceremonyType string, bytes []byte) (*ceremony, error) {
+	var state ceremony
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session data: %v", err)
 	}
 
-	// Unmarshal session data from JSON
-	var data *webauthn.SessionData
-	if err := json.Unmarshal(bytes, &data); err != nil {
-		return "", nil, fmt.Errorf("failed to unmarshal session data: %v", err)
+	if state.Type != ceremonyType {
+		return nil, ErrCeremonyMismatch
+	}
+	if time.Now().After(state.ExpiresAt) {
+		return nil, ErrCeremonyExpired
 	}
-	return id, data, nil
+	if state.SessionUserID != sessionUserID(ctx) {
+		return nil, ErrCeremonyMismatch
+	}
+	return &state, nil
+}
+
+func (session *WebAuthnSession) Create(ctx echo.Context, ceremonyType string, data *webauthn.SessionData) error {
+	return session.create(ctx, ceremony{Type: ceremonyType, Data: data})
 }
 
-func (session *WebAuthnSession) Create(ctx echo.Context, sessionName string, data *webauthn.SessionData) ( error) {
+// CreateUpgrade starts the conditional create of the automatic passkey upgrade
+func (session *WebAuthnSession) CreateUpgrade(ctx echo.Context, data *webauthn.SessionData) error {
+	return session.create(ctx, ceremony{Type: CeremonyRegistration, Upgrade: true, Data: data})
+}
+
+// CreateReusable starts a ceremony whose options GetOptions returns again
+// until Get consumes it
+func (session *WebAuthnSession) CreateReusable(ctx echo.Context, ceremonyType string, data *webauthn.SessionData, options any) error {
+	bytes, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("failed to encode options: %v", err)
+	}
+	return session.create(ctx, ceremony{Type: ceremonyType, Data: data, Options: bytes})
+}
+
+// CreateSignup starts the registration of a user that is not stored yet
+func (session *WebAuthnSession) CreateSignup(ctx echo.Context, email string, data *webauthn.SessionData) error {
+	return session.create(ctx, ceremony{Type: CeremonyRegistration, SignupEmail: email, Data: data})
+}
+
+func (session *WebAuthnSession) create(ctx echo.Context, state ceremony) error {
+	expiresAt := state.Data.Expires
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(defaultCeremonyTimeout)
+	}
+	state.SessionUserID = sessionUserID(ctx)
+	state.ExpiresAt = expiresAt
+
 	// Marshal session data to JSON
-	bytes, err := json.Marshal(data)
+	bytes, err := json.Marshal(state)
 	if err != nil {
-		return  fmt.Errorf("failed to encode session data: %v", err)	
+		return fmt.Errorf("failed to encode session data: %v", err)
 	}
 
 	id := uuid.New().String()
+	ttl := time.Until(expiresAt) + ceremonyGracePeriod
 
-	if err := session.RedisClient.Set(ctx.Request().Context(), id, bytes, webauthnSessionDuration).Err(); err != nil {
+	if err := session.Store.Set(ctx.Request().Context(), webauthnCeremonyKeyPrefix+id, bytes, ttl); err != nil {
 		return fmt.Errorf("failed to save session data: %v", err)
 	}
 
 	ctx.SetCookie(&http.Cookie{
-		Name: sessionName,
-		Value: id,
-		Path: "/",
+		Name:     state.Type,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   session.Config.CookieSecure,
+		SameSite: session.Config.CookieSameSite,
 	})
 
 	return nil
 }
 
-func (session *WebAuthnSession) Delete(ctx echo.Context, id string) error {
-	if err := session.RedisClient.Del(ctx.Request().Context(), id).Err(); err != nil {
-		return fmt.Errorf("failed to delete session data: %v", err)
+func (session *WebAuthnSession) clearCookie(ctx echo.Context, ceremonyType string) {
+	ctx.SetCookie(&http.Cookie{
+		Name:     ceremonyType,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   session.Config.CookieSecure,
+		SameSite: session.Config.CookieSameSite,
+	})
+}
+
+// sessionUserID returns the signed in user set by the auth middleware, if any
+func sessionUserID(ctx echo.Context) string {
+	userID, _ := ctx.Get("userID").(string)
+	return userID
+}
+
+// CeremonyErrorStatus maps errors of Get to a response status: problems with
+// the ceremony itself are the client's to retry, anything else is ours
+func CeremonyErrorStatus(err error) int {
+	if errors.Is(err, ErrCeremonyNotFound) || errors.Is(err, ErrCeremonyExpired) || errors.Is(err, ErrCeremonyMismatch) {
+		return http.StatusBadRequest
 	}
-	return nil
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebAuthnSession(t *testing.T) {
+	e := echo.New()
+	session := WebAuthnSession{Store: memoryStore(t), Config: NewSessionConfig()}
+
+	// begin creates the ceremony and returns the cookie the browser would send back
+	begin := func(t *testing.T, ceremonyType string, userID string, expires time.Time) *http.Cookie {
+		rec := httptest.NewRecorder()
+		ctx := e.NewContext(httptest.NewRequest(echo.POST, "/begin", nil), rec)
+		ctx.Set("userID", userID)
+		data := &webauthn.SessionData{Challenge: "challenge", Expires: expires}
+		assert.NoError(t, session.Create(ctx, ceremonyType, data))
+		return rec.Result().Cookies()[0]
+	}
+	finish := func(cookie *http.Cookie, ceremonyType string, userID string) (*webauthn.SessionData, error) {
+		req := httptest.NewRequest(echo.POST, "/finish", nil)
+		req.AddCookie(cookie)
+		ctx := e.NewContext(req, httptest.NewRecorder())
+		ctx.Set("userID", userID)
+		return session.Get(ctx, ceremonyType)
+	}
+
+	t.Run("single use", func(t *testing.T) {
+		cookie := begin(t, CeremonyLogin, "", time.Now().Add(time.Minute))
+
+		data, err := finish(cookie, CeremonyLogin, "")
+		assert.NoError(t, err)
+		assert.Equal(t, "challenge", data.Challenge)
+
+		_, err = finish(cookie, CeremonyLogin, "")
+		assert.ErrorIs(t, err, ErrCeremonyNotFound)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		cookie := begin(t, CeremonyLogin, "", time.Now().Add(-time.Second))
+
+		_, err := finish(cookie, CeremonyLogin, "")
+		assert.ErrorIs(t, err, ErrCeremonyExpired)
+	})
+
+	t.Run("bound to the ceremony type", func(t *testing.T) {
+		cookie := begin(t, CeremonyRegistration, "", time.Now().Add(time.Minute))
+		cookie.Name = CeremonyLogin
+
+		_, err := finish(cookie, CeremonyLogin, "")
+		assert.ErrorIs(t, err, ErrCeremonyMismatch)
+	})
+
+	t.Run("signup keeps the pending user", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		ctx := e.NewContext(httptest.NewRequest(echo.POST, "/register/begin", nil), rec)
+		assert.NoError(t, session.CreateSignup(ctx, "new@email.com", &webauthn.SessionData{Challenge: "challenge"}))
+
+		req := httptest.NewRequest(echo.POST, "/register/finish", nil)
+		req.AddCookie(rec.Result().Cookies()[0])
+		registration, err := session.GetRegistration(e.NewContext(req, httptest.NewRecorder()))
+		assert.NoError(t, err)
+		assert.Equal(t, "challenge", registration.Data.Challenge)
+		assert.Equal(t, "new@email.com", registration.SignupEmail)
+		assert.False(t, registration.Upgrade)
+	})
+
+	t.Run("upgrade is kept with the ceremony", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		ctx := e.NewContext(httptest.NewRequest(echo.POST, "/register/begin", nil), rec)
+		ctx.Set("userID", "user-a")
+		assert.NoError(t, session.CreateUpgrade(ctx, &webauthn.SessionData{Challenge: "challenge"}))
+
+		req := httptest.NewRequest(echo.POST, "/register/finish", nil)
+		req.AddCookie(rec.Result().Cookies()[0])
+		ctx = e.NewContext(req, httptest.NewRecorder())
+		ctx.Set("userID", "user-a")
+		registration, err := session.GetRegistration(ctx)
+		assert.NoError(t, err)
+		assert.True(t, registration.Upgrade)
+		assert.Empty(t, registration.SignupEmail)
+	})
+
+	t.Run("bound to the signed in user", func(t *testing.T) {
+		cookie := begin(t, CeremonyLogin, "user-a", time.Now().Add(time.Minute))
+
+		_, err := finish(cookie, CeremonyLogin, "user-b")
+		assert.ErrorIs(t, err, ErrCeremonyMismatch)
+	})
+
+	t.Run("reusable until used", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		ctx := e.NewContext(httptest.NewRequest(echo.POST, "/conditional_login/begin", nil), rec)
+		data := &webauthn.SessionData{Challenge: "challenge", Expires: time.Now().Add(time.Hour)}
+		assert.NoError(t, session.CreateReusable(ctx, CeremonyConditionalLogin, data, map[string]string{"challenge": "challenge"}))
+		cookie := rec.Result().Cookies()[0]
+		assert.Equal(t, CeremonyConditionalLogin, cookie.Name)
+
+		getOptions := func() (string, error) {
+			req := httptest.NewRequest(echo.POST, "/conditional_login/begin", nil)
+			req.AddCookie(cookie)
+			options, err := session.GetOptions(e.NewContext(req, httptest.NewRecorder()), CeremonyConditionalLogin)
+			return string(options), err
+		}
+		for range 2 {
+			options, err := getOptions()
+			assert.NoError(t, err)
+			assert.JSONEq(t, `{"challenge":"challenge"}`, options)
+		}
+
+		_, err := finish(cookie, CeremonyConditionalLogin, "")
+		assert.NoError(t, err)
+		_, err = getOptions()
+		assert.ErrorIs(t, err, ErrCeremonyNotFound)
+
+		// ceremonies created without options are never offered again
+		_, err = session.GetOptions(func() echo.Context {
+			req := httptest.NewRequest(echo.POST, "/login/begin", nil)
+			req.AddCookie(begin(t, CeremonyLogin, "", time.Now().Add(time.Minute)))
+			return e.NewContext(req, httptest.NewRecorder())
+		}(), CeremonyLogin)
+		assert.ErrorIs(t, err, ErrCeremonyNotFound)
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		cookie := begin(t, CeremonyConditionalLogin, "", time.Now().Add(time.Minute))
+
+		req := httptest.NewRequest(echo.POST, "/login/password", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, session.Discard(e.NewContext(req, rec), CeremonyConditionalLogin))
+		assert.Equal(t, -1, rec.Result().Cookies()[0].MaxAge)
+
+		_, err := finish(cookie, CeremonyConditionalLogin, "")
+		assert.ErrorIs(t, err, ErrCeremonyNotFound)
+
+		// nothing to discard without a cookie
+		assert.NoError(t, session.Discard(e.NewContext(httptest.NewRequest(echo.POST, "/login/password", nil), httptest.NewRecorder()), CeremonyConditionalLogin))
+	})
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+type PasswordHistoryRepository struct {
+	DB *bun.DB
+}
+
+// Recent returns the hashes of the last replaced passwords, newest first
+func (pr *PasswordHistoryRepository) Recent(ctx context.Context, userID uuid.UUID, limit int) ([]string, error) {
+	var hashes []string
+	err := pr.DB.NewSelect().
+		Model((*model.PasswordHistory)(nil)).
+		Column("password_hash").
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Limit(limit).
+		Scan(ctx, &hashes)
+	return hashes, err
+}
+
+// Add records a replaced password and forgets all but the newest keep ones
+func (pr *PasswordHistoryRepository) Add(ctx context.Context, userID uuid.UUID, passwordHash string, keep int) error {
+	return pr.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().
+			Model(&model.PasswordHistory{
+				ID:           uuid.New(),
+				UserID:       userID,
+				PasswordHash: passwordHash,
+				CreatedAt:    time.Now().UTC(),
+			}).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		newest := tx.NewSelect().
+			Model((*model.PasswordHistory)(nil)).
+			Column("id").
+			Where("user_id = ?", userID).
+			Order("created_at DESC").
+			Limit(keep)
+		_, err = tx.NewDelete().
+			Model((*model.PasswordHistory)(nil)).
+			Where("user_id = ?", userID).
+			Where("id NOT IN (?)", newest).
+			Exec(ctx)
+		return err
+	})
+}
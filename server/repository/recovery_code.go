@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+const (
+	recoveryCodeCount = 10
+	// codes look like "abcde-fghij-klmno", the first group selects the row
+	recoveryCodeGroups    = 3
+	recoveryCodeGroupSize = 5
+	recoveryCodeAlphabet  = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+var ErrRecoveryCodeInvalid = errors.New("recovery code is invalid or already used")
+
+// RecoveryCodeRepository stores recovery codes hashed like passwords, with the
+// parameters of PasswordHasher. A code is used up when it matches, so a hash
+// made with older parameters is never verified twice and needs no rehash.
+type RecoveryCodeRepository struct {
+	DB             *bun.DB
+	PasswordHasher pkg.PasswordHasher
+}
+
+// Regenerate replaces all codes of the user and returns the new ones. This is
+// the only time the codes are known in plain text.
+func (rr *RecoveryCodeRepository) Regenerate(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]model.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		selector, verifier, _ := splitRecoveryCode(code)
+		hash, err := rr.PasswordHasher.Hash(verifier)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		rows[i] = model.RecoveryCode{ID: uuid.New(), UserID: userID, Selector: selector, CodeHash: hash}
+	}
+
+	err := rr.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().
+			Model((*model.RecoveryCode)(nil)).
+			Where("user_id = ?", userID).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewInsert().
+			Model(&rows).
+			Column("id", "user_id", "selector", "code_hash").
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CountUnused returns how many codes the user has left
+func (rr *RecoveryCodeRepository) CountUnused(ctx context.Context, userID uuid.UUID) (int, error) {
+	return rr.DB.NewSelect().
+		Model((*model.RecoveryCode)(nil)).
+		Where("user_id = ?", userID).
+		Where("used_at IS NULL").
+		Count(ctx)
+}
+
+// Use marks the code as used. It fails with ErrRecoveryCodeInvalid for wrong,
+// unknown and already used codes alike.
+func (rr *RecoveryCodeRepository) Use(ctx context.Context, userID uuid.UUID, code string) error {
+	selector, verifier, ok := splitRecoveryCode(normalizeRecoveryCode(code))
+	if !ok {
+		return ErrRecoveryCodeInvalid
+	}
+
+	var candidates []model.RecoveryCode
+	err := rr.DB.NewSelect().
+		Model(&candidates).
+		Where("user_id = ?", userID).
+		Where("selector = ?", selector).
+		Where("used_at IS NULL").
+		Scan(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, candidate := range candidates {
+		match, _, err := rr.PasswordHasher.Verify(verifier, candidate.CodeHash)
+		if err != nil {
+			return err
+		}
+		if !match {
+			continue
+		}
+
+		// only one of two concurrent logins with the same code wins
+		result, err := rr.DB.NewUpdate().
+			Model((*model.RecoveryCode)(nil)).
+			Set("used_at = ?", time.Now().UTC()).
+			Where("id = ?", candidate.ID).
+			Where("used_at IS NULL").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+			return ErrRecoveryCodeInvalid
+		}
+		return nil
+	}
+	return ErrRecoveryCodeInvalid
+}
+
+func newRecoveryCode() (string, error) {
+	bytes := make([]byte, recoveryCodeGroups*recoveryCodeGroupSize)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	var code strings.Builder
+	for i, b := range bytes {
+		if i > 0 && i%recoveryCodeGroupSize == 0 {
+			code.WriteByte('-')
+		}
+		// the alphabet is short enough for the modulo bias not to matter
+		code.WriteByte(recoveryCodeAlphabet[int(b)%len(recoveryCodeAlphabet)])
+	}
+	return code.String(), nil
+}
+
+// normalizeRecoveryCode accepts codes typed in upper case or with spaces
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, " ", "-")
+}
+
+func splitRecoveryCode(code string) (selector string, verifier string, ok bool) {
+	selector, verifier, ok = strings.Cut(code, "-")
+	if !ok || len(selector) != recoveryCodeGroupSize || len(verifier) == 0 {
+		return "", "", false
+	}
+	return selector, verifier, true
+}
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+var ErrTokenInvalid = errors.New("token is invalid, expired or already used")
+
+type TokenRepository struct {
+	DB *bun.DB
+}
+
+// CreateToken stores a new token for the user and returns its plain value,
+// which only ever leaves the server in the message sent to the user
+func (tr *TokenRepository) CreateToken(ctx context.Context, userID uuid.UUID, purpose string, ttl time.Duration) (string, error) {
+	return tr.CreateEmailToken(ctx, userID, purpose, "", ttl)
+}
+
+// CreateEmailToken creates a token that is bound to the address it is sent to
+func (tr *TokenRepository) CreateEmailToken(ctx context.Context, userID uuid.UUID, purpose string, email string, ttl time.Duration) (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(bytes)
+
+	_, err := tr.DB.NewInsert().
+		Model(&model.UserToken{
+			ID:        uuid.New(),
+			UserID:    userID,
+			Purpose:   purpose,
+			Email:     email,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(ttl).UTC(),
+		}).
+		Column("id", "user_id", "purpose", "email", "token_hash", "expires_at").
+		Exec(ctx)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// FindToken returns a token that could still be consumed, without consuming
+// it, e.g. to validate the rest of a request first
+func (tr *TokenRepository) FindToken(ctx context.Context, purpose string, token string) (*model.UserToken, error) {
+	var userToken model.UserToken
+	err := tr.DB.NewSelect().
+		Model(&userToken).
+		Where("token_hash = ?", hashToken(token)).
+		Where("purpose = ?", purpose).
+		Where("consumed_at IS NULL").
+		Where("expires_at > ?", time.Now().UTC()).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &userToken, nil
+}
+
+// ConsumeToken marks the token as used and returns it. Checking and consuming
+// happen in one statement, so a token can only be redeemed once.
+func (tr *TokenRepository) ConsumeToken(ctx context.Context, purpose string, token string) (*model.UserToken, error) {
+	var userToken model.UserToken
+	now := time.Now().UTC()
+	err := tr.DB.NewUpdate().
+		Model(&userToken).
+		Set("consumed_at = ?", now).
+		Where("token_hash = ?", hashToken(token)).
+		Where("purpose = ?", purpose).
+		Where("consumed_at IS NULL").
+		Where("expires_at > ?", now).
+		Returning("*").
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &userToken, nil
+}
+
+// DeleteTokens invalidates all outstanding tokens of the user for the purpose
+func (tr *TokenRepository) DeleteTokens(ctx context.Context, userID uuid.UUID, purpose string) error {
+	_, err := tr.DB.NewDelete().
+		Model((*model.UserToken)(nil)).
+		Where("user_id = ?", userID).
+		Where("purpose = ?", purpose).
+		Exec(ctx)
+	return err
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
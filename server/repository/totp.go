@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/baala3/passkeys/model"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+var ErrTOTPCodeUsed = errors.New("totp code was already used")
+
+type TOTPRepository struct {
+	DB *bun.DB
+}
+
+// FindTOTPCredential returns nil when the user has no authenticator app
+func (tr *TOTPRepository) FindTOTPCredential(ctx context.Context, userID uuid.UUID) (*model.TOTPCredential, error) {
+	var credential model.TOTPCredential
+	err := tr.DB.NewSelect().
+		Model(&credential).
+		Where("user_id = ?", userID).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// StartEnrollment replaces any unconfirmed enrollment of the user with a new secret
+func (tr *TOTPRepository) StartEnrollment(ctx context.Context, userID uuid.UUID, sealedSecret string) error {
+	return tr.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().
+			Model((*model.TOTPCredential)(nil)).
+			Where("user_id = ?", userID).
+			Where("confirmed_at IS NULL").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewInsert().
+			Model(&model.TOTPCredential{UserID: userID, Secret: sealedSecret}).
+			Column("user_id", "secret", "last_used_step").
+			Exec(ctx)
+		return err
+	})
+}
+
+func (tr *TOTPRepository) Confirm(ctx context.Context, userID uuid.UUID, step int64) error {
+	_, err := tr.DB.NewUpdate().
+		Model((*model.TOTPCredential)(nil)).
+		Set("confirmed_at = ?", time.Now().UTC()).
+		Set("last_used_step = ?", step).
+		Where("user_id = ?", userID).
+		Exec(ctx)
+	return err
+}
+
+// UseStep records an accepted code. It fails with ErrTOTPCodeUsed when the
+// step or a later one was already used, so each code works only once.
+func (tr *TOTPRepository) UseStep(ctx context.Context, userID uuid.UUID, step int64) error {
+	result, err := tr.DB.NewUpdate().
+		Model((*model.TOTPCredential)(nil)).
+		Set("last_used_step = ?", step).
+		Where("user_id = ?", userID).
+		Where("last_used_step < ?", step).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+func (tr *TOTPRepository) Delete(ctx context.Context, userID uuid.UUID) error {
+	_, err := tr.DB.NewDelete().
+		Model((*model.TOTPCredential)(nil)).
+		Where("user_id = ?", userID).
+		Exec(ctx)
+	return err
+}
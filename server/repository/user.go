@@ -2,25 +2,41 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
 
 	"github.com/baala3/passkeys/model"
+	"github.com/baala3/passkeys/pkg"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+)
+
+// emailIndex keeps addresses unique regardless of case
+const emailIndex = "users_email_lower_key"
+
+var (
+	ErrLastSignInMethod = errors.New("cannot remove the last sign in method")
+	ErrEmailTaken = errors.New("email is already taken")
 )
 
 type UserRepository struct {
 	DB *bun.DB
 }
 
-// FindUserByName returns a user by name
+// FindUserByEmail returns a user by email, ignoring case like the unique index
 func (ur *UserRepository) FindUserByEmail(ctx context.Context, email string) (*model.User, error) {
 	var user model.User
 	err := ur.DB.NewSelect().
 		Model(&user).
 		Relation("WebauthnCredentials").
 		Column("*").
-		Where("email = ?", email).Scan(ctx)
+		Where("lower(email) = lower(?)", email).Scan(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -46,52 +62,207 @@ func (ur *UserRepository) FindUserById(ctx context.Context, rawUserID []byte) (*
 	return &user, nil
 }
 
-// CreateUser creates a new user in the database
-func (ur *UserRepository) CreateUser(ctx context.Context, email string, passwordHash string) (*model.User, error) {
+// CreateUser creates a new user in the database. hasPassword is false when
+// passwordHash is a placeholder the user cannot sign in with. It fails with
+// ErrEmailTaken when the address is in use.
+func (ur *UserRepository) CreateUser(ctx context.Context, email string, passwordHash string, hasPassword bool) (*model.User, error) {
 	user := &model.User{
 		ID: uuid.New(),
 		Email: email,
 		PasswordHash: passwordHash,
+		HasPassword: hasPassword,
 	}
 
 	_, err := ur.DB.NewInsert().
 		Model(user).
-		Column("id", "email", "password_hash").
+		Column("id", "email", "password_hash", "has_password").
 		Returning("*").
 		Exec(ctx)
 	if err != nil {
-		return nil, err
+		return nil, emailTakenError(err)
 	}
 	return user, nil
 }
 
-func (ur *UserRepository) AddWebauthnCredential(ctx context.Context, userID uuid.UUID, credential *webauthn.Credential) error {
-	newWebauthnCredential := &model.WebauthnCredentials{
+// CreateUserWithCredential stores a user signed up with a passkey together with
+// that passkey, so a failed signup never leaves an account behind
+func (ur *UserRepository) CreateUserWithCredential(ctx context.Context, user *model.User, credential *webauthn.Credential, name string, attestation pkg.AuthenticatorAttestation) error {
+	return ur.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		exists, err := tx.NewSelect().
+			Model((*model.User)(nil)).
+			Where("lower(email) = lower(?)", user.Email).
+			Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrEmailTaken
+		}
+
+		_, err = tx.NewInsert().
+			Model(user).
+			Column("id", "email", "password_hash", "has_password").
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return emailTakenError(err)
+		}
+
+		_, err = tx.NewInsert().
+			Model(newWebauthnCredential(user.ID, credential, name, attestation)).
+			Column("id", "user_id", "credential_id", "name", "public_key", "attestation_type", "transport","flags", "authenticator", "attestation_verified", "authenticator_status", "attestation").
+			Exec(ctx)
+		return err
+	})
+}
+
+func (ur *UserRepository) AddWebauthnCredential(ctx context.Context, userID uuid.UUID, credential *webauthn.Credential, name string, attestation pkg.AuthenticatorAttestation) error {
+	_, err := ur.DB.NewInsert().
+		Model(newWebauthnCredential(userID, credential, name, attestation)).
+		Column("id", "user_id", "credential_id", "name", "public_key", "attestation_type", "transport","flags", "authenticator", "attestation_verified", "authenticator_status", "attestation").
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddUpgradeCredential adds the passkey of an automatic upgrade and records
+// when the user was first upgraded
+func (ur *UserRepository) AddUpgradeCredential(ctx context.Context, userID uuid.UUID, credential *webauthn.Credential, name string, attestation pkg.AuthenticatorAttestation) error {
+	return ur.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().
+			Model(newWebauthnCredential(userID, credential, name, attestation)).
+			Column("id", "user_id", "credential_id", "name", "public_key", "attestation_type", "transport","flags", "authenticator", "attestation_verified", "authenticator_status", "attestation").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewUpdate().
+			Model((*model.User)(nil)).
+			Set("passkey_upgraded_at = ?", time.Now().UTC()).
+			Where("id = ?", userID).
+			Where("passkey_upgraded_at IS NULL").
+			Exec(ctx)
+		return err
+	})
+}
+
+func newWebauthnCredential(userID uuid.UUID, credential *webauthn.Credential, name string, attestation pkg.AuthenticatorAttestation) *model.WebauthnCredentials {
+	return &model.WebauthnCredentials{
 		ID: uuid.New(),
 		UserID: userID,
 		CredentialID: credential.ID,
+		Name: name,
 		PublicKey: credential.PublicKey,
 		AttestationType: credential.AttestationType,
 		Transport: credential.Transport,
 		Flags: credential.Flags,
 		Authenticator: credential.Authenticator,
+		AttestationVerified: attestation.Verified,
+		AuthenticatorStatus: string(attestation.Status),
+		Attestation: credential.Attestation,
 	}
+}
 
-	_, err := ur.DB.NewInsert().
-		Model(newWebauthnCredential).
-		Column("id", "user_id", "credential_id", "public_key", "attestation_type", "transport","flags", "authenticator").
+// UpdateWebauthnCredential stores the sign counter, flags and clone warning
+// reported by the authenticator during a login, whether or not it succeeds
+func (ur *UserRepository) UpdateWebauthnCredential(ctx context.Context, credential *webauthn.Credential) error {
+	webauthnCredential := &model.WebauthnCredentials{
+		Flags: credential.Flags,
+		Authenticator: credential.Authenticator,
+		UpdatedAt: time.Now(),
+	}
+
+	_, err := ur.DB.NewUpdate().
+		Model(webauthnCredential).
+		Column("flags", "authenticator", "updated_at").
+		Where("credential_id = ?", credential.ID).
+		Exec(ctx)
+	return err
+}
+
+// MarkCredentialUsed records a successful login with the credential
+func (ur *UserRepository) MarkCredentialUsed(ctx context.Context, credentialID []byte) error {
+	_, err := ur.DB.NewUpdate().
+		Model((*model.WebauthnCredentials)(nil)).
+		Set("last_used_at = ?", time.Now()).
+		Where("credential_id = ?", credentialID).
+		Exec(ctx)
+	return err
+}
+
+// RenameWebauthnCredential returns sql.ErrNoRows when the user has no such credential
+func (ur *UserRepository) RenameWebauthnCredential(ctx context.Context, userID uuid.UUID, credentialID []byte, name string) error {
+	result, err := ur.DB.NewUpdate().
+		Model((*model.WebauthnCredentials)(nil)).
+		Set("name = ?", name).
+		Set("updated_at = ?", time.Now()).
+		Where("user_id = ?", userID).
+		Where("credential_id = ?", credentialID).
 		Exec(ctx)
 	if err != nil {
 		return err
 	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
 
+// DeleteWebauthnCredential returns ErrLastSignInMethod instead of deleting the
+// only passkey of an account without a usable password
 func (ur *UserRepository) DeleteWebauthnCredential(ctx context.Context, userID uuid.UUID, credentialID []byte) error {
-	_, err := ur.DB.NewDelete().
-		Model(&model.WebauthnCredentials{}).
-		Where("user_id = ?", userID).
-		Where("credential_id = ?", credentialID).
+	return ur.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// concurrent deletes wait here, so each sees what the other left
+		var user model.User
+		err := forUpdate(tx.NewSelect().
+			Model(&user).
+			Column("has_password").
+			Where("id = ?", userID)).
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !user.HasPassword {
+			count, err := tx.NewSelect().
+				Model((*model.WebauthnCredentials)(nil)).
+				Where("user_id = ?", userID).
+				Where("credential_id != ?", credentialID).
+				Count(ctx)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return ErrLastSignInMethod
+			}
+		}
+
+		_, err = tx.NewDelete().
+			Model(&model.WebauthnCredentials{}).
+			Where("user_id = ?", userID).
+			Where("credential_id = ?", credentialID).
+			Exec(ctx)
+		return err
+	})
+}
+
+// MarkHasPassword records that the password of the user is usable, e.g. after
+// it matched at sign in
+func (ur *UserRepository) MarkHasPassword(ctx context.Context, userID uuid.UUID) error {
+	_, err := ur.DB.NewUpdate().
+		Model((*model.User)(nil)).
+		Set("has_password = ?", true).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", userID).
+		Where("has_password = ?", false).
 		Exec(ctx)
 	return err
 }
@@ -107,6 +278,38 @@ func (ur *UserRepository) DeleteUser(ctx context.Context, user *model.User) erro
 			return err
 		}
 
+		_, err = tx.NewDelete().
+			Model((*model.UserToken)(nil)).
+			Where("user_id = ?", user.ID).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().
+			Model((*model.TOTPCredential)(nil)).
+			Where("user_id = ?", user.ID).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().
+			Model((*model.RecoveryCode)(nil)).
+			Where("user_id = ?", user.ID).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().
+			Model((*model.PasswordHistory)(nil)).
+			Where("user_id = ?", user.ID).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
 		// Delete the user
 		_, err = tx.NewDelete().
 			Model(user).
@@ -118,6 +321,56 @@ func (ur *UserRepository) DeleteUser(ctx context.Context, user *model.User) erro
 	return err
 }
 
+// DeleteOrphanedUsers deletes passkey signups that were created before
+// createdBefore and never got a passkey, i.e. accounts nobody can sign in to.
+// Their tokens and other rows go with them.
+func (ur *UserRepository) DeleteOrphanedUsers(ctx context.Context, createdBefore time.Time) (int64, error) {
+	var deleted int64
+	err := ur.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var userIDs []uuid.UUID
+		err := tx.NewSelect().
+			Model((*model.User)(nil)).
+			Column("id").
+			Where("has_password = ?", false).
+			Where("email_verified_at IS NULL").
+			Where("created_at < ?", createdBefore).
+			Where("NOT EXISTS (SELECT 1 FROM webauthn_credentials WHERE webauthn_credentials.user_id = ?TableAlias.id)").
+			Scan(ctx, &userIDs)
+		if err != nil || len(userIDs) == 0 {
+			return err
+		}
+
+		for _, table := range []interface{}{
+			(*model.UserToken)(nil),
+			(*model.TOTPCredential)(nil),
+			(*model.RecoveryCode)(nil),
+			(*model.PasswordHistory)(nil),
+		} {
+			_, err := tx.NewDelete().
+				Model(table).
+				Where("user_id IN (?)", bun.In(userIDs)).
+				Exec(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		result, err := tx.NewDelete().
+			Model((*model.User)(nil)).
+			Where("id IN (?)", bun.In(userIDs)).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
 func (ur *UserRepository) FindUserIDByCredentialID(ctx context.Context, credentialID []byte) (*uuid.UUID, error) {
 	var credential model.WebauthnCredentials
 	err := ur.DB.NewSelect().
@@ -130,6 +383,69 @@ func (ur *UserRepository) FindUserIDByCredentialID(ctx context.Context, credenti
 	return &credential.UserID, nil
 }
 
+// MarkEmailVerified confirms the address of the user. It returns sql.ErrNoRows
+// when the user no longer has that address.
+func (ur *UserRepository) MarkEmailVerified(ctx context.Context, userID uuid.UUID, email string) error {
+	result, err := ur.DB.NewUpdate().
+		Model((*model.User)(nil)).
+		Set("email_verified_at = ?", time.Now().UTC()).
+		Where("id = ?", userID).
+		Where("email = ?", email).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ChangeEmail switches the user to a confirmed new address, failing with
+// ErrEmailTaken if someone else took it in the meantime
+func (ur *UserRepository) ChangeEmail(ctx context.Context, userID uuid.UUID, email string) error {
+	return ur.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		exists, err := tx.NewSelect().
+			Model((*model.User)(nil)).
+			Where("lower(email) = lower(?)", email).
+			Where("id != ?", userID).
+			Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrEmailTaken
+		}
+
+		now := time.Now().UTC()
+		_, err = tx.NewUpdate().
+			Model((*model.User)(nil)).
+			Set("email = ?", email).
+			Set("email_verified_at = ?", now).
+			Set("updated_at = ?", now).
+			Where("id = ?", userID).
+			Exec(ctx)
+		return emailTakenError(err)
+	})
+}
+
+// UpgradePasswordHash replaces a hash with one of the same password. It does
+// nothing when the password was changed in the meantime.
+func (ur *UserRepository) UpgradePasswordHash(ctx context.Context, userID uuid.UUID, oldHash string, newHash string) error {
+	_, err := ur.DB.NewUpdate().
+		Model((*model.User)(nil)).
+		Set("password_hash = ?", newHash).
+		Where("id = ?", userID).
+		Where("password_hash = ?", oldHash).
+		Exec(ctx)
+	return err
+}
+
 func (ur *UserRepository) UpdateUser(ctx context.Context, user *model.User) error {
 	_, err := ur.DB.NewUpdate().
 		Model(user).
@@ -137,3 +453,26 @@ func (ur *UserRepository) UpdateUser(ctx context.Context, user *model.User) erro
 		Exec(ctx)
 	return err
 }
+
+// forUpdate locks the selected rows until the transaction ends. SQLite, which
+// the tests run on, has no row locks and serializes writing transactions instead.
+func forUpdate(query *bun.SelectQuery) *bun.SelectQuery {
+	if query.Dialect().Name() == dialect.SQLite {
+		return query
+	}
+	return query.For("UPDATE")
+}
+
+// emailTakenError turns a violation of the unique email index, i.e. a
+// concurrent signup or email change that won the race, into ErrEmailTaken
+func emailTakenError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Constraint == emailIndex {
+		return ErrEmailTaken
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique && strings.Contains(err.Error(), emailIndex) {
+		return ErrEmailTaken
+	}
+	return err
+}
@@ -4,7 +4,9 @@ import (
 	"embed"
 
 	"github.com/baala3/passkeys/controller"
+	"github.com/baala3/passkeys/jobs"
 	"github.com/baala3/passkeys/middleware"
+	"github.com/baala3/passkeys/pkg"
 	"github.com/labstack/echo/v4"
 )
 
@@ -14,10 +16,25 @@ type Server struct {
 	webauthnCredentialController controller.WebAuthnCredentialController
 	passwordController controller.PasswordController
 	emailController controller.EmailController
+	passwordResetController controller.PasswordResetController
+	magicLinkController controller.MagicLinkController
+	totpController controller.TOTPController
+	recoveryCodeController controller.RecoveryCodeController
+	loginGuard controller.LoginGuard
+	sessionController controller.SessionController
+	authenticatorController controller.AuthenticatorController
+	authMiddleware middleware.AuthMiddleware
+	orphanedUserCleanup jobs.OrphanedUserCleanup
+	providerCatalog *pkg.PasskeyProviderCatalog
+	metadataService *pkg.MetadataService
 }
 
 func (s *Server) Start() {
+	s.router.IPExtractor = pkg.NewIPExtractor()
 	s.registerEndpoints()
+	go s.orphanedUserCleanup.Start()
+	go s.providerCatalog.Watch()
+	go s.metadataService.Watch()
 	s.router.Logger.Fatal(s.router.Start(":9044"))
 }
 
@@ -34,28 +51,66 @@ var (
 func (s *Server) registerEndpoints() {
 	s.router.StaticFS("/", distDirFS)
 
-	s.router.FileFS("/", "index.html", distIndexHTML, middleware.NoAuth)
-	s.router.FileFS("/sign-up", "index.html", distIndexHTML, middleware.NoAuth)
-	s.router.FileFS("/home", "index.html", distIndexHTML, middleware.Auth)
-	s.router.FileFS("/passkeys", "index.html", distIndexHTML, middleware.Auth)
-	s.router.FileFS("/delete_account", "index.html", distIndexHTML, middleware.Auth)
-	s.router.FileFS("/edit_email", "index.html", distIndexHTML, middleware.Auth)
-	s.router.FileFS("/edit_password", "index.html", distIndexHTML, middleware.Auth)
-
-	s.router.POST("/register/begin", s.webauthnCredentialController.BeginRegistration(), middleware.ConditionalAuth)
-	s.router.POST("/register/finish", s.webauthnCredentialController.FinishRegistration(), middleware.ConditionalAuth)
-	s.router.GET("/credentials", s.webauthnCredentialController.GetCredentials(), middleware.Auth)
-	s.router.DELETE("/credentials", s.webauthnCredentialController.DeleteCredential(), middleware.Auth)
-
-	s.router.POST("/login/begin", s.webauthnAssertionsController.BeginLogin(), middleware.ConditionalAuth)
-	s.router.POST("/login/finish", s.webauthnAssertionsController.FinishLogin(), middleware.ConditionalAuth)
-	s.router.POST("/discoverable_login/begin", s.webauthnAssertionsController.BeginDiscoverableLogin(), middleware.NoAuth)
-	s.router.POST("/discoverable_login/finish", s.webauthnAssertionsController.FinishDiscoverableLogin(), middleware.NoAuth)
-
-	s.router.POST("/register/password", s.passwordController.SignUp(), middleware.NoAuth)
-	s.router.POST("/login/password", s.passwordController.Login(), middleware.NoAuth)
-	s.router.POST("/logout", s.passwordController.Logout(), middleware.Auth)
-	s.router.DELETE("/delete_account", s.passwordController.DeleteAccount(), middleware.Auth)
-	s.router.POST("/change_email", s.emailController.ChangeEmail(), middleware.Auth)
-	s.router.POST("/change_password", s.passwordController.ChangePassword(), middleware.Auth)
+	s.router.FileFS("/", "index.html", distIndexHTML, s.authMiddleware.NoAuth)
+	s.router.FileFS("/sign-up", "index.html", distIndexHTML, s.authMiddleware.NoAuth)
+	s.router.FileFS("/forgot_password", "index.html", distIndexHTML, s.authMiddleware.NoAuth)
+	s.router.FileFS("/reset_password", "index.html", distIndexHTML, s.authMiddleware.NoAuth)
+	s.router.FileFS("/verify_email", "index.html", distIndexHTML)
+	s.router.FileFS("/email_verified", "index.html", distIndexHTML)
+	s.router.FileFS("/magic_link", "index.html", distIndexHTML, s.authMiddleware.NoAuth)
+	s.router.FileFS("/login/magic_link", "index.html", distIndexHTML, s.authMiddleware.NoAuth)
+	s.router.FileFS("/home", "index.html", distIndexHTML, s.authMiddleware.Auth)
+	s.router.FileFS("/passkeys", "index.html", distIndexHTML, s.authMiddleware.AllowRestricted)
+	s.router.FileFS("/delete_account", "index.html", distIndexHTML, s.authMiddleware.Auth)
+	s.router.FileFS("/edit_email", "index.html", distIndexHTML, s.authMiddleware.Auth)
+	s.router.FileFS("/edit_password", "index.html", distIndexHTML, s.authMiddleware.Auth)
+	s.router.FileFS("/two_factor", "index.html", distIndexHTML, s.authMiddleware.Auth)
+	s.router.FileFS("/recovery_codes", "index.html", distIndexHTML, s.authMiddleware.Auth)
+	s.router.FileFS("/login/recovery", "index.html", distIndexHTML, s.authMiddleware.NoAuth)
+	s.router.FileFS("/login/totp", "index.html", distIndexHTML)
+	s.router.FileFS("/login/unlock", "index.html", distIndexHTML)
+
+	s.router.POST("/register/begin", s.webauthnCredentialController.BeginRegistration(), s.authMiddleware.ConditionalAuth)
+	s.router.POST("/register/finish", s.webauthnCredentialController.FinishRegistration(), s.authMiddleware.ConditionalAuth)
+	s.router.GET("/credentials", s.webauthnCredentialController.GetCredentials(), s.authMiddleware.AllowRestricted)
+	s.router.PATCH("/credentials", s.webauthnCredentialController.RenameCredential(), s.authMiddleware.Auth)
+	s.router.DELETE("/credentials", s.webauthnCredentialController.DeleteCredential(), s.authMiddleware.Auth)
+	s.router.GET("/authenticators/:aaguid", s.authenticatorController.GetAuthenticator())
+
+	s.router.POST("/login/begin", s.webauthnAssertionsController.BeginLogin(), s.authMiddleware.ConditionalAuth)
+	s.router.POST("/login/finish", s.webauthnAssertionsController.FinishLogin(), s.authMiddleware.ConditionalAuth)
+	s.router.POST("/discoverable_login/begin", s.webauthnAssertionsController.BeginDiscoverableLogin(), s.authMiddleware.NoAuth)
+	s.router.POST("/discoverable_login/finish", s.webauthnAssertionsController.FinishDiscoverableLogin(), s.authMiddleware.NoAuth)
+	s.router.POST("/conditional_login/begin", s.webauthnAssertionsController.BeginConditionalLogin(), s.authMiddleware.NoAuth)
+	s.router.POST("/conditional_login/finish", s.webauthnAssertionsController.FinishConditionalLogin(), s.authMiddleware.NoAuth)
+
+	s.router.POST("/register/password", s.passwordController.SignUp(), s.authMiddleware.NoAuth)
+	s.router.POST("/login/password", s.passwordController.Login(), s.authMiddleware.NoAuth)
+	s.router.POST("/login/totp", s.totpController.Login())
+	s.router.POST("/login/recovery", s.recoveryCodeController.Login(), s.authMiddleware.NoAuth)
+	s.router.POST("/login/magic_link", s.magicLinkController.SendLink(), s.authMiddleware.NoAuth)
+	s.router.POST("/login/magic_link/confirm", s.magicLinkController.Login(), s.authMiddleware.NoAuth)
+	s.router.POST("/login/unlock", s.loginGuard.Unlock())
+	s.router.POST("/password/forgot", s.passwordResetController.ForgotPassword(), s.authMiddleware.NoAuth)
+	s.router.POST("/password/reset", s.passwordResetController.ResetPassword(), s.authMiddleware.NoAuth)
+	s.router.POST("/logout", s.passwordController.Logout(), s.authMiddleware.AllowRestricted)
+	s.router.POST("/reauth/password", s.passwordController.Reauthenticate(), s.authMiddleware.Auth)
+	s.router.DELETE("/delete_account", s.passwordController.DeleteAccount(), s.authMiddleware.Auth, s.authMiddleware.RequireRecentAuth)
+	s.router.POST("/change_email", s.emailController.ChangeEmail(), s.authMiddleware.Auth, s.authMiddleware.RequireRecentAuth)
+	s.router.POST("/verify_email", s.emailController.VerifyEmail())
+	s.router.POST("/verify_email/resend", s.emailController.ResendVerification(), s.authMiddleware.Auth)
+	s.router.POST("/change_password", s.passwordController.ChangePassword(), s.authMiddleware.Auth)
+	s.router.POST("/set_password", s.passwordController.SetPassword(), s.authMiddleware.Auth, s.authMiddleware.RequireRecentAuth)
+
+	s.router.GET("/totp", s.totpController.GetStatus(), s.authMiddleware.Auth)
+	s.router.POST("/totp/enroll", s.totpController.Enroll(), s.authMiddleware.Auth, s.authMiddleware.RequireRecentAuth)
+	s.router.POST("/totp/confirm", s.totpController.Confirm(), s.authMiddleware.Auth, s.authMiddleware.RequireRecentAuth)
+	s.router.DELETE("/totp", s.totpController.Disable(), s.authMiddleware.Auth, s.authMiddleware.RequireRecentAuth)
+
+	s.router.GET("/recovery_codes", s.recoveryCodeController.GetStatus(), s.authMiddleware.Auth)
+	s.router.POST("/recovery_codes", s.recoveryCodeController.Regenerate(), s.authMiddleware.Auth, s.authMiddleware.RequireRecentAuth)
+
+	s.router.GET("/sessions", s.sessionController.GetSessions(), s.authMiddleware.Auth)
+	s.router.DELETE("/sessions/:id", s.sessionController.RevokeSession(), s.authMiddleware.Auth)
+	s.router.POST("/sessions/revoke_others", s.sessionController.RevokeOtherSessions(), s.authMiddleware.Auth)
 }
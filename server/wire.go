@@ -6,6 +6,8 @@ package main
 import (
 	"github.com/baala3/passkeys/controller"
 	"github.com/baala3/passkeys/db"
+	"github.com/baala3/passkeys/jobs"
+	"github.com/baala3/passkeys/middleware"
 	"github.com/baala3/passkeys/pkg"
 	"github.com/baala3/passkeys/repository"
 	"github.com/google/wire"
@@ -18,14 +20,43 @@ func NewServer() (*Server, error) {
 		wire.Struct(new(Server), "*"),
 		echo.New,
 		wire.Struct(new(repository.UserRepository), "*"),
+		wire.Struct(new(repository.TokenRepository), "*"),
+		wire.Struct(new(repository.TOTPRepository), "*"),
+		wire.Struct(new(repository.RecoveryCodeRepository), "*"),
+		wire.Struct(new(repository.PasswordHistoryRepository), "*"),
 		db.GetDB,
 		wire.Struct(new(controller.WebAuthnAssertionsController), "*"),
 		wire.Struct(new(controller.WebAuthnCredentialController), "*"),
 		wire.Struct(new(controller.PasswordController), "*"),
 		wire.Struct(new(controller.EmailController), "*"),
+		wire.Struct(new(controller.PasswordResetController), "*"),
+		wire.Struct(new(controller.EmailVerifier), "*"),
+		wire.Struct(new(controller.MagicLinkController), "*"),
+		wire.Struct(new(controller.TOTPController), "*"),
+		wire.Struct(new(controller.RecoveryCodeController), "*"),
+		wire.Struct(new(controller.SessionController), "*"),
+		wire.Struct(new(controller.AuthenticatorController), "*"),
+		wire.Struct(new(controller.LoginGuard), "*"),
+		wire.Struct(new(controller.PasswordSetter), "*"),
 		pkg.NewWebAuthnAPI,
-		pkg.GetRedisClient,
+		pkg.NewMetadataConfig,
+		pkg.NewMetadataService,
+		pkg.NewAuthenticatorPolicy,
+		pkg.NewPasskeyProviderCatalog,
+		pkg.NewSessionStore,
+		pkg.NewSessionConfig,
+		pkg.NewMailer,
+		pkg.NewSigner,
+		pkg.NewSecretBox,
+		pkg.NewRateLimitConfig,
+		pkg.NewAntiEnumeration,
+		pkg.NewPasswordHasher,
+		pkg.NewPasswordPolicy,
+		pkg.NewBackground,
+		wire.Struct(new(pkg.RateLimiter), "*"),
 		wire.Struct(new(pkg.UserSession), "*"),
 		wire.Struct(new(pkg.WebAuthnSession), "*"),
+		wire.Struct(new(middleware.AuthMiddleware), "*"),
+		wire.Struct(new(jobs.OrphanedUserCleanup), "*"),
 	))
 }
@@ -9,6 +9,8 @@ package main
 import (
 	"github.com/baala3/passkeys/controller"
 	"github.com/baala3/passkeys/db"
+	"github.com/baala3/passkeys/jobs"
+	"github.com/baala3/passkeys/middleware"
 	"github.com/baala3/passkeys/pkg"
 	"github.com/baala3/passkeys/repository"
 	"github.com/labstack/echo/v4"
@@ -19,7 +21,12 @@ import (
 // run `wire` to generate server and all dependencies
 func NewServer() (*Server, error) {
 	echoEcho := echo.New()
-	webAuthn, err := pkg.NewWebAuthnAPI()
+	metadataConfig := pkg.NewMetadataConfig()
+	metadataService, err := pkg.NewMetadataService(metadataConfig)
+	if err != nil {
+		return nil, err
+	}
+	webAuthn, err := pkg.NewWebAuthnAPI(metadataService)
 	if err != nil {
 		return nil, err
 	}
@@ -27,32 +34,153 @@ func NewServer() (*Server, error) {
 	userRepository := repository.UserRepository{
 		DB: bunDB,
 	}
-	client := pkg.GetRedisClient()
+	sessionStore := pkg.NewSessionStore()
+	sessionConfig := pkg.NewSessionConfig()
 	webAuthnSession := pkg.WebAuthnSession{
-		RedisClient: client,
+		Store:  sessionStore,
+		Config: sessionConfig,
 	}
 	userSession := pkg.UserSession{
-		RedisClient: client,
+		Store:  sessionStore,
+		Config: sessionConfig,
+	}
+	tokenRepository := repository.TokenRepository{
+		DB: bunDB,
+	}
+	mailer := pkg.NewMailer()
+	emailVerifier := controller.EmailVerifier{
+		TokenRepository: tokenRepository,
+		Mailer:          mailer,
+	}
+	rateLimitConfig := pkg.NewRateLimitConfig()
+	rateLimiter := pkg.RateLimiter{
+		Store:  sessionStore,
+		Config: rateLimitConfig,
+	}
+	signer, err := pkg.NewSigner()
+	if err != nil {
+		return nil, err
+	}
+	background := pkg.NewBackground()
+	loginGuard := controller.LoginGuard{
+		RateLimiter:     rateLimiter,
+		UserRepository:  userRepository,
+		TokenRepository: tokenRepository,
+		Mailer:          mailer,
+		Signer:          signer,
+		Background:      background,
+	}
+	passwordHasher := pkg.NewPasswordHasher()
+	antiEnumeration := pkg.NewAntiEnumeration(signer, passwordHasher)
+	authenticatorPolicy, err := pkg.NewAuthenticatorPolicy(metadataConfig)
+	if err != nil {
+		return nil, err
 	}
 	webAuthnAssertionsController := controller.WebAuthnAssertionsController{
 		WebAuthnAPI:     webAuthn,
 		UserRepository:  userRepository,
 		WebAuthnSession: webAuthnSession,
 		UserSession:     userSession,
+		LoginGuard:      loginGuard,
+		AntiEnumeration: antiEnumeration,
+	}
+	passkeyProviderCatalog, err := pkg.NewPasskeyProviderCatalog()
+	if err != nil {
+		return nil, err
 	}
 	webAuthnCredentialController := controller.WebAuthnCredentialController{
-		WebAuthnAPI:     webAuthn,
+		WebAuthnAPI:         webAuthn,
+		UserRepository:      userRepository,
+		WebAuthnSession:     webAuthnSession,
+		UserSession:         userSession,
+		EmailVerifier:       emailVerifier,
+		AntiEnumeration:     antiEnumeration,
+		PasswordHasher:      passwordHasher,
+		MetadataService:     metadataService,
+		AuthenticatorPolicy: authenticatorPolicy,
+		ProviderCatalog:     passkeyProviderCatalog,
+	}
+	totpRepository := repository.TOTPRepository{
+		DB: bunDB,
+	}
+	passwordPolicy := pkg.NewPasswordPolicy()
+	passwordHistoryRepository := repository.PasswordHistoryRepository{
+		DB: bunDB,
+	}
+	passwordSetter := controller.PasswordSetter{
+		PasswordPolicy:            passwordPolicy,
+		PasswordHasher:            passwordHasher,
+		UserRepository:            userRepository,
+		PasswordHistoryRepository: passwordHistoryRepository,
+	}
+	passwordController := controller.PasswordController{
 		UserRepository:  userRepository,
+		UserSession:     userSession,
+		EmailVerifier:   emailVerifier,
+		TOTPRepository:  totpRepository,
+		LoginGuard:      loginGuard,
+		AntiEnumeration: antiEnumeration,
+		PasswordHasher:  passwordHasher,
+		PasswordSetter:  passwordSetter,
 		WebAuthnSession: webAuthnSession,
+	}
+	emailController := controller.EmailController{
+		UserRepository:  userRepository,
+		TokenRepository: tokenRepository,
 		UserSession:     userSession,
+		EmailVerifier:   emailVerifier,
 	}
-	passwordController := controller.PasswordController{
+	passwordResetController := controller.PasswordResetController{
+		UserRepository:  userRepository,
+		TokenRepository: tokenRepository,
+		UserSession:     userSession,
+		Mailer:          mailer,
+		LoginGuard:      loginGuard,
+		PasswordSetter:  passwordSetter,
+		Background:      background,
+	}
+	magicLinkController := controller.MagicLinkController{
+		UserRepository:  userRepository,
+		TokenRepository: tokenRepository,
+		TOTPRepository:  totpRepository,
+		UserSession:     userSession,
+		Mailer:          mailer,
+		Signer:          signer,
+		LoginGuard:      loginGuard,
+		Background:      background,
+	}
+	secretBox, err := pkg.NewSecretBox()
+	if err != nil {
+		return nil, err
+	}
+	totpController := controller.TOTPController{
 		UserRepository: userRepository,
+		TOTPRepository: totpRepository,
 		UserSession:    userSession,
+		SecretBox:      secretBox,
+		LoginGuard:     loginGuard,
 	}
-	emailController := controller.EmailController{
+	recoveryCodeRepository := repository.RecoveryCodeRepository{
+		DB:             bunDB,
+		PasswordHasher: passwordHasher,
+	}
+	recoveryCodeController := controller.RecoveryCodeController{
+		UserRepository:         userRepository,
+		RecoveryCodeRepository: recoveryCodeRepository,
+		UserSession:            userSession,
+		LoginGuard:             loginGuard,
+	}
+	sessionController := controller.SessionController{
+		UserSession: userSession,
+	}
+	authenticatorController := controller.AuthenticatorController{
+		ProviderCatalog: passkeyProviderCatalog,
+	}
+	authMiddleware := middleware.AuthMiddleware{
+		UserSession: userSession,
+	}
+	orphanedUserCleanup := jobs.OrphanedUserCleanup{
 		UserRepository: userRepository,
-		UserSession:    userSession,
 	}
 	server := &Server{
 		router:                       echoEcho,
@@ -60,6 +188,17 @@ func NewServer() (*Server, error) {
 		webauthnCredentialController: webAuthnCredentialController,
 		passwordController:           passwordController,
 		emailController:              emailController,
+		passwordResetController:      passwordResetController,
+		magicLinkController:          magicLinkController,
+		totpController:               totpController,
+		recoveryCodeController:       recoveryCodeController,
+		sessionController:            sessionController,
+		authenticatorController:      authenticatorController,
+		loginGuard:                   loginGuard,
+		authMiddleware:               authMiddleware,
+		orphanedUserCleanup:          orphanedUserCleanup,
+		providerCatalog:              passkeyProviderCatalog,
+		metadataService:              metadataService,
 	}
 	return server, nil
 }